@@ -0,0 +1,263 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+)
+
+const (
+	headerAsyncModule = "Gojinn-Module"
+	headerJobID       = "Gojinn-Job-Id"
+
+	// asyncWorkersKey files the async pool of a tenant next to its function
+	// pools; it cannot collide with a function key, which is a hex digest.
+	asyncWorkersKey = "async"
+)
+
+func asyncStreamName(tenantID string) string {
+	return fmt.Sprintf("ASYNC_%s", strings.ToUpper(tenantID))
+}
+
+func asyncSubject(tenantID string) string {
+	return fmt.Sprintf("gojinn.tenant.%s.async", tenantID)
+}
+
+func asyncQueueGroup(tenantID string) string {
+	return "ASYNC_WORKERS_" + tenantID
+}
+
+// asyncFunction resolves the limits a module runs with when a guest enqueues
+// it by name. A module that is also a declared function keeps that
+// function's settings; any other module gets the block defaults.
+func (r *Gojinn) asyncFunction(tenantID, wasmFile string) *functionSpec {
+	fn := r.defaultFunction()
+	if table := r.routeTable.Load(); table != nil {
+		for _, declared := range table.functions {
+			if declared.WasmFile == wasmFile {
+				c := *declared
+				fn = &c
+				break
+			}
+		}
+	}
+	fn.Name = wasmFile
+	fn.Key = hashString("async|" + wasmFile)
+	fn.WasmFile = wasmFile
+	fn.Mode = ModeAsync
+	return r.tenantFunction(tenantID, fn)
+}
+
+// enqueueAsyncJob persists a fire-and-forget job running wasmFile on the
+// async stream of the calling tenant and returns its job ID. A non-zero runAt
+// defers the job until then. The caller's enqueue permission must cover the
+// module.
+func (r *Gojinn) enqueueAsyncJob(ctx context.Context, wasmFile, payload string, runAt time.Time) (string, error) {
+	ctx, span := otel.Tracer("gojinn-publisher").Start(ctx, "publish_async_job")
+	defer span.End()
+
+	jobID, err := r.publishAsyncJob(ctx, wasmFile, payload, runAt)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	r.logger.Info("Async Job Persisted & Queued",
+		zap.String("file", wasmFile),
+		zap.String("job_id", jobID),
+		zap.String("trace_id", span.SpanContext().TraceID().String()),
+	)
+	return jobID, nil
+}
+
+func (r *Gojinn) publishAsyncJob(ctx context.Context, wasmFile, payload string, runAt time.Time) (string, error) {
+	if r.js == nil {
+		return "", fmt.Errorf("JetStream not ready")
+	}
+	if strings.Contains(wasmFile, "..") {
+		return "", fmt.Errorf("module path %q must not contain '..'", wasmFile)
+	}
+	if !isAllowed(wasmFile, r.permissionsFor(ctx).Enqueue) {
+		return "", fmt.Errorf("enqueue of %q is not permitted", wasmFile)
+	}
+
+	tenantID, parentJob := tenantOf(ctx), ""
+	if inv := invocationFrom(ctx); inv != nil {
+		parentJob = inv.JobID
+	}
+
+	jobID := nuid.Next()
+	headers := map[string][]string{"X-Source": {"async"}}
+	if parentJob != "" {
+		headers["X-Parent-Job"] = []string{parentJob}
+	}
+	jobReq := JobRequest{
+		Method:  "ASYNC",
+		URI:     "internal://async/" + jobID,
+		Headers: headers,
+		Body:    payload,
+	}
+	if err := r.submitAsyncJob(ctx, tenantID, jobID, wasmFile, jobReq, nil, runAt); err != nil {
+		return "", err
+	}
+	return jobID, nil
+}
+
+// submitAsyncJob persists jobReq as job jobID running wasmFile on the async
+// stream of tenantID, deferred until runAt when it is non-zero. Extra headers
+// travel with the message to the worker that runs it.
+func (r *Gojinn) submitAsyncJob(ctx context.Context, tenantID, jobID, wasmFile string, jobReq JobRequest, extra nats.Header, runAt time.Time) error {
+	if _, err := r.EnsureTenantResources(tenantID); err != nil {
+		return fmt.Errorf("failed to provision tenant: %w", err)
+	}
+	if err := r.ensureAsyncWorkers(tenantID); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(jobReq)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(asyncSubject(tenantID))
+	msg.Data = data
+	for k, v := range extra {
+		msg.Header[k] = v
+	}
+	msg.Header.Set(headerAsyncModule, wasmFile)
+	msg.Header.Set(headerJobID, jobID)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(msg.Header))
+
+	if !runAt.IsZero() {
+		return r.scheduleJob(tenantID, jobID, msg, asyncWorkersKey, runAt)
+	}
+
+	// Record the job first: an idle worker may pick it up before the
+	// publish returns.
+	r.recordJobQueued(tenantID, jobID)
+	if _, err := r.js.PublishMsg(msg, nats.MsgId(jobID)); err != nil {
+		r.updateJob(tenantID, jobID, func(j *JobRecord) {
+			j.State = JobDead
+			j.Error = err.Error()
+		})
+		return fmt.Errorf("failed to persist async job: %w", err)
+	}
+	return nil
+}
+
+// ensureAsyncWorkers starts the pool consuming the async stream of tenantID.
+// Its size follows the block pool settings and the tenant override.
+func (r *Gojinn) ensureAsyncWorkers(tenantID string) error {
+	r.subsMu.Lock()
+	defer r.subsMu.Unlock()
+
+	r.admitTenant(tenantID)
+	if _, exists := r.tenantSubs[tenantID][asyncWorkersKey]; exists {
+		return nil
+	}
+
+	fn := r.tenantFunction(tenantID, r.defaultFunction())
+	maxDeliver := r.asyncRetryPolicy().maxDeliver()
+	r.reconcileConsumer(asyncStreamName(tenantID), asyncQueueGroup(tenantID), maxDeliver)
+
+	pool := newWorkerPool(tenantID, asyncWorkersKey, asyncWorkersKey, asyncStreamName(tenantID), asyncQueueGroup(tenantID), fn)
+	pool.start = func(id int) (*nats.Subscription, error) {
+		return r.startAsyncWorker(tenantID, id, maxDeliver, pool)
+	}
+	_, initial, _ := fn.poolBounds()
+	if pool.grow(initial, r.logger) == 0 {
+		return fmt.Errorf("failed to start async workers for tenant %s", tenantID)
+	}
+
+	r.addWorkerPool(pool)
+	r.logger.Info("Async Workers Provisioned", zap.String("tenant", tenantID), zap.Int("count", pool.size()))
+	return nil
+}
+
+// holdAsyncWorker marks worker, an async worker of tenantID, as blocked on
+// async jobs of its own and returns the function unmarking it. It refuses
+// when no other worker of the pool would be left to run those jobs.
+func (r *Gojinn) holdAsyncWorker(tenantID string, worker *nats.Subscription) (func(), error) {
+	r.subsMu.Lock()
+	defer r.subsMu.Unlock()
+
+	pool := r.tenantSubs[tenantID][asyncWorkersKey]
+	if pool == nil || pool.size()-len(pool.blocked) <= 1 {
+		return nil, fmt.Errorf("no spare async worker for tenant %s: raise pool_size", tenantID)
+	}
+	if pool.blocked == nil {
+		pool.blocked = make(map[*nats.Subscription]bool)
+	}
+	pool.blocked[worker] = true
+	return func() {
+		r.subsMu.Lock()
+		delete(pool.blocked, worker)
+		r.subsMu.Unlock()
+	}, nil
+}
+
+// startAsyncWorker subscribes one worker to the async stream of tenantID.
+// Unlike function workers it is not bound to a module: it compiles each
+// module named by a job on first use and keeps the runtime for later jobs.
+func (r *Gojinn) startAsyncWorker(tenantID string, id, maxDeliver int, pool *workerPool) (*nats.Subscription, error) {
+	runtimes := make(map[string]*EnginePair)
+
+	sub, err := r.js.QueueSubscribe(asyncSubject(tenantID), asyncQueueGroup(tenantID), func(m *nats.Msg) {
+		meta, err := m.Metadata()
+		if err != nil {
+			r.logger.Error("Failed to get msg metadata", zap.Error(err))
+			_ = m.Nak()
+			return
+		}
+
+		jobID := m.Header.Get(headerJobID)
+		fn := r.asyncFunction(tenantID, m.Header.Get(headerAsyncModule))
+
+		pair, ok := runtimes[fn.WasmFile]
+		if !ok {
+			pair, err = r.asyncRuntime(fn)
+			if err != nil {
+				// Reloading the same module will fail the same way.
+				errMsg := fmt.Sprintf("Async module unavailable: %v", err)
+				r.logger.Error(errMsg, zap.String("tenant", tenantID), zap.Int("worker", id), zap.String("job_id", jobID))
+				r.buryJob(m, tenantID, jobID, fn, "", "", errMsg, false)
+				pool.observe(meta.Timestamp)
+				return
+			}
+			runtimes[fn.WasmFile] = pair
+		}
+
+		r.executeJob(m, meta, tenantID, jobID, fn, pair)
+		pool.observe(meta.Timestamp)
+	}, nats.ManualAck(), nats.BindStream(asyncStreamName(tenantID)), nats.MaxDeliver(maxDeliver))
+	if err != nil {
+		return nil, err
+	}
+
+	// The callback owns the runtimes; they are closed once a drained
+	// subscription has delivered its last message.
+	sub.SetClosedHandler(func(string) {
+		for _, pair := range runtimes {
+			_ = pair.Runtime.Close(context.Background())
+		}
+	})
+	return sub, nil
+}
+
+func (r *Gojinn) asyncRuntime(fn *functionSpec) (*EnginePair, error) {
+	wasmBytes, err := r.loadWasmSecurely(fn.WasmFile)
+	if err != nil {
+		return nil, err
+	}
+	return r.createWazeroRuntime(wasmBytes, fn.MemoryLimit, fn.FuelLimit)
+}
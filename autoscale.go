@@ -0,0 +1,290 @@
+package gojinn
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	// scaleInterval is how often the autoscaler samples the consumers of
+	// the pools that may change size.
+	scaleInterval = 2 * time.Second
+
+	// scaleUpLatency is the queue-to-ack latency above which a pool with a
+	// backlog grows even when the backlog is smaller than the pool.
+	scaleUpLatency = time.Second
+
+	// scaleDownDelay is how long a pool must stay idle before it gives a
+	// worker back.
+	scaleDownDelay = 30 * time.Second
+
+	// sandboxWaitHeartbeat keeps a job waiting for a sandbox slot from being
+	// redelivered while it waits.
+	sandboxWaitHeartbeat = 10 * time.Second
+)
+
+// workerPool is the set of queue subscribers serving one function, or the
+// async stream, of one tenant on this node. Its size moves between min and
+// max with the backlog of its consumer. Callers hold subsMu.
+type workerPool struct {
+	tenantID string
+	key      string
+	name     string
+	stream   string
+	consumer string
+	min, max int
+	start    func(id int) (*nats.Subscription, error)
+
+	subs     []*nats.Subscription
+	nextID   int
+	lastBusy time.Time
+
+	// blocked holds the workers waiting in host_map on jobs of this pool.
+	blocked map[*nats.Subscription]bool
+
+	// latency is a moving average of the time from publish to ack, in
+	// nanoseconds, fed by the workers.
+	latency atomic.Int64
+}
+
+// poolBounds resolves the size limits of the pool of fn: it starts at
+// pool_size and moves between pool_min and pool_max. Without pool_min and
+// pool_max the pool keeps pool_size workers.
+func (f *functionSpec) poolBounds() (lo, initial, hi int) {
+	initial = f.PoolSize
+	if initial < 1 {
+		initial = 1
+	}
+	lo = f.PoolMin
+	if lo <= 0 {
+		lo = initial
+	}
+	hi = f.PoolMax
+	if hi < lo {
+		hi = lo
+	}
+	return lo, min(max(initial, lo), hi), hi
+}
+
+func newWorkerPool(tenantID, key, name, stream, consumer string, fn *functionSpec) *workerPool {
+	lo, _, hi := fn.poolBounds()
+	return &workerPool{
+		tenantID: tenantID,
+		key:      key,
+		name:     name,
+		stream:   stream,
+		consumer: consumer,
+		min:      lo,
+		max:      hi,
+		lastBusy: time.Now(),
+	}
+}
+
+func (p *workerPool) size() int {
+	return len(p.subs)
+}
+
+// grow starts up to n more workers and returns how many started.
+func (p *workerPool) grow(n int, logger *zap.Logger) int {
+	started := 0
+	for i := 0; i < n; i++ {
+		sub, err := p.start(p.nextID)
+		p.nextID++
+		if err != nil {
+			logger.Error("Failed to start worker subscriber", zap.String("tenant", p.tenantID), zap.String("function", p.name), zap.Error(err))
+			continue
+		}
+		p.subs = append(p.subs, sub)
+		started++
+	}
+	return started
+}
+
+// shrink drains up to n workers, the most recently started first, leaving
+// out those blocked in host_map. A draining worker finishes the job it holds
+// before it stops.
+func (p *workerPool) shrink(n int, logger *zap.Logger) {
+	for i := len(p.subs) - 1; n > 0 && i >= 0; i-- {
+		sub := p.subs[i]
+		if p.blocked[sub] {
+			continue
+		}
+		p.subs = append(p.subs[:i], p.subs[i+1:]...)
+		n--
+		if err := sub.Drain(); err != nil {
+			logger.Warn("Failed to drain worker sub", zap.String("tenant", p.tenantID), zap.Error(err))
+		}
+	}
+}
+
+// observe feeds the latency of a job published at queued and just settled.
+func (p *workerPool) observe(queued time.Time) {
+	sample := int64(time.Since(queued))
+	for {
+		old := p.latency.Load()
+		next := sample
+		if old > 0 {
+			next = old - old/5 + sample/5
+		}
+		if p.latency.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// setupAutoscaler starts the loop resizing the pools of this node.
+func (r *Gojinn) setupAutoscaler() {
+	if r.MaxSandboxes > 0 {
+		r.sandboxSlots = make(chan struct{}, r.MaxSandboxes)
+	}
+	r.scalerStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(scaleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.autoscale()
+			case <-r.scalerStop:
+				return
+			}
+		}
+	}()
+}
+
+// autoscale resizes every pool that has room to move according to the
+// backlog and latency of its consumer, within the node-wide sandbox cap.
+func (r *Gojinn) autoscale() {
+	r.subsMu.Lock()
+	var pools []*workerPool
+	for _, byKey := range r.tenantSubs {
+		for _, pool := range byKey {
+			if pool.min != pool.max {
+				pools = append(pools, pool)
+			}
+		}
+	}
+	r.subsMu.Unlock()
+
+	for _, pool := range pools {
+		info, err := r.js.ConsumerInfo(pool.stream, pool.consumer)
+		if err != nil {
+			continue
+		}
+		r.resizePool(pool, int(info.NumPending), info.NumAckPending) //nolint:gosec
+	}
+}
+
+func (r *Gojinn) resizePool(pool *workerPool, pending, inFlight int) {
+	r.subsMu.Lock()
+	defer r.subsMu.Unlock()
+
+	// The pool may have been recycled while its consumer was sampled.
+	if r.tenantSubs[pool.tenantID][pool.key] != pool {
+		return
+	}
+
+	// Deliveries beyond one per worker wait in a worker's buffer, so they
+	// are backlog as much as the undelivered ones.
+	workers := pool.size()
+	pending += max(inFlight-workers, 0)
+	latency := time.Duration(pool.latency.Load())
+	if pending > 0 || inFlight >= workers {
+		pool.lastBusy = time.Now()
+	}
+
+	switch {
+	case pending > 0 && workers < pool.max && (pending >= workers || latency > scaleUpLatency):
+		step := min(max(pending, 1), max(workers, 1), pool.max-workers)
+		if r.MaxSandboxes > 0 {
+			step = min(step, r.MaxSandboxes-r.totalWorkers())
+		}
+		if step <= 0 {
+			return
+		}
+		started := pool.grow(step, r.logger)
+		r.reportScaling(pool, "up", started, pending, latency)
+
+	// Workers blocked in host_map wait on jobs of the pool itself, which
+	// needs one more worker to run them.
+	case pending == 0 && inFlight < workers && workers > pool.min && workers-len(pool.blocked) > 1 && time.Since(pool.lastBusy) > scaleDownDelay:
+		pool.shrink(1, r.logger)
+		r.reportScaling(pool, "down", 1, pending, latency)
+	}
+}
+
+func (r *Gojinn) reportScaling(pool *workerPool, direction string, n, pending int, latency time.Duration) {
+	if n == 0 {
+		return
+	}
+	r.logger.Info("Worker Pool Scaled",
+		zap.String("tenant", pool.tenantID),
+		zap.String("function", pool.name),
+		zap.String("direction", direction),
+		zap.Int("workers", pool.size()),
+		zap.Int("pending", pending),
+		zap.Duration("ack_latency", latency),
+	)
+	if r.metrics != nil {
+		r.metrics.poolScaling.WithLabelValues(pool.tenantID, pool.name, direction).Add(float64(n))
+		r.metrics.poolWorkers.WithLabelValues(pool.tenantID, pool.name).Set(float64(pool.size()))
+	}
+}
+
+// addWorkerPool registers a freshly provisioned pool. Callers hold subsMu.
+func (r *Gojinn) addWorkerPool(pool *workerPool) {
+	if r.tenantSubs[pool.tenantID] == nil {
+		r.tenantSubs[pool.tenantID] = make(map[string]*workerPool)
+	}
+	r.tenantSubs[pool.tenantID][pool.key] = pool
+	if r.metrics != nil {
+		r.metrics.poolWorkers.WithLabelValues(pool.tenantID, pool.name).Set(float64(pool.size()))
+	}
+}
+
+// dropWorkerPool drains every worker of pool. Callers hold subsMu and remove
+// the pool from tenantSubs.
+func (r *Gojinn) dropWorkerPool(pool *workerPool) {
+	// Blocked workers go as well; they finish their job first.
+	pool.blocked = nil
+	pool.shrink(pool.size(), r.logger)
+	if r.metrics != nil {
+		r.metrics.poolWorkers.DeleteLabelValues(pool.tenantID, pool.name)
+	}
+}
+
+// totalWorkers counts the workers of every pool on this node.
+func (r *Gojinn) totalWorkers() int {
+	n := 0
+	for _, byKey := range r.tenantSubs {
+		for _, pool := range byKey {
+			n += pool.size()
+		}
+	}
+	return n
+}
+
+// acquireSandbox waits for one of the max_sandboxes slots of this node, until
+// ctx ends, and returns the function releasing it. Without a cap it returns
+// at once.
+func (r *Gojinn) acquireSandbox(ctx context.Context, m *nats.Msg) (func(), error) {
+	if r.sandboxSlots == nil {
+		return func() {}, nil
+	}
+	ticker := time.NewTicker(sandboxWaitHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case r.sandboxSlots <- struct{}{}:
+			return func() { <-r.sandboxSlots }, nil
+		case <-ticker.C:
+			_ = m.InProgress()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -90,6 +90,7 @@ func (g *Gojinn) startEmbeddedNATS() error {
 		StoreDir:           storeDir,
 		JetStreamMaxStore:  1 * 1024 * 1024 * 1024,
 		JetStreamMaxMemory: 64 * 1024 * 1024,
+		MaxPayload:         8 * 1024 * 1024,
 
 		Nkeys: nkeyUsers,
 
@@ -189,27 +190,79 @@ func (g *Gojinn) connectLocalClient() error {
 	return nil
 }
 
+// stateBucket names the KV bucket holding the state of tenantID, the one its
+// functions reach through the KV and mutex host functions.
+func stateBucket(tenantID string) string {
+	return fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID))
+}
+
+// EnsureTenantResources provisions the streams and buckets of tenantID and
+// returns its STATE bucket. Once a tenant is checked it is served from memory
+// until the reaper forgets it, so hot paths pay no JetStream round trip.
 func (g *Gojinn) EnsureTenantResources(tenantID string) (nats.KeyValue, error) {
 	if g.js == nil {
 		return nil, fmt.Errorf("JetStream not initialized")
 	}
+	if kv, ok := g.provisioned.Load(tenantID); ok {
+		return kv.(nats.KeyValue), nil
+	}
+
+	// Every stream is created under the lock, after the tenant limit check,
+	// so concurrent first requests cannot provision past max_tenants.
+	g.provisionMu.Lock()
+	defer g.provisionMu.Unlock()
+	if kv, ok := g.provisioned.Load(tenantID); ok {
+		return kv.(nats.KeyValue), nil
+	}
 
 	streamName := fmt.Sprintf("WORKER_%s", strings.ToUpper(tenantID))
-	kvBucket := fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID))
+	kvBucket := stateBucket(tenantID)
 	subject := fmt.Sprintf("gojinn.tenant.%s.exec.>", tenantID)
 
-	_, err := g.js.StreamInfo(streamName)
+	info, err := g.js.StreamInfo(streamName)
 	if err != nil {
+		if err := g.checkTenantLimit(tenantID); err != nil {
+			return nil, err
+		}
 		g.logger.Info("Provisioning Isolated Tenant Stream...", zap.String("tenant", tenantID), zap.String("stream", streamName))
 		_, err = g.js.AddStream(&nats.StreamConfig{
-			Name:      streamName,
-			Subjects:  []string{subject},
+			Name:       streamName,
+			Subjects:   []string{subject},
+			Storage:    nats.FileStorage,
+			Retention:  nats.WorkQueuePolicy,
+			Replicas:   g.ClusterReplicas,
+			Duplicates: g.dedupeWindow(tenantID),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to provision tenant stream: %w", err)
+		}
+	} else {
+		g.syncDedupeWindow(tenantID, info)
+	}
+
+	if _, err := g.js.StreamInfo(asyncStreamName(tenantID)); err != nil {
+		_, err = g.js.AddStream(&nats.StreamConfig{
+			Name:      asyncStreamName(tenantID),
+			Subjects:  []string{asyncSubject(tenantID)},
 			Storage:   nats.FileStorage,
 			Retention: nats.WorkQueuePolicy,
 			Replicas:  g.ClusterReplicas,
 		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to provision tenant stream: %w", err)
+			return nil, fmt.Errorf("failed to provision tenant async stream: %w", err)
+		}
+	}
+
+	if _, err := g.js.StreamInfo(dlqStreamName(tenantID)); err != nil {
+		_, err = g.js.AddStream(&nats.StreamConfig{
+			Name:      dlqStreamName(tenantID),
+			Subjects:  []string{dlqSubject(tenantID)},
+			Storage:   nats.FileStorage,
+			Retention: nats.LimitsPolicy,
+			Replicas:  g.ClusterReplicas,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to provision tenant dead-letter stream: %w", err)
 		}
 	}
 
@@ -220,7 +273,7 @@ func (g *Gojinn) EnsureTenantResources(tenantID string) (nats.KeyValue, error) {
 			Bucket:      kvBucket,
 			Description: fmt.Sprintf("Isolated State for %s", tenantID),
 			Storage:     nats.FileStorage,
-			History:     1,
+			History:     uint8(g.stateHistory(nil)), //nolint:gosec
 			TTL:         0,
 			Replicas:    g.ClusterReplicas,
 		})
@@ -229,6 +282,11 @@ func (g *Gojinn) EnsureTenantResources(tenantID string) (nats.KeyValue, error) {
 		}
 	}
 
+	if err := g.ensureJobStore(tenantID); err != nil {
+		return nil, err
+	}
+
+	g.provisioned.Store(tenantID, kv)
 	return kv, nil
 }
 
@@ -238,20 +296,20 @@ func (g *Gojinn) ReloadWorkers() error {
 	g.subsMu.Lock()
 	defer g.subsMu.Unlock()
 
-	for tenantID, subs := range g.tenantSubs {
-		for _, sub := range subs {
-			if err := sub.Drain(); err != nil {
-				g.logger.Warn("Failed to drain worker sub", zap.String("tenant", tenantID), zap.Error(err))
-			}
+	for _, pools := range g.tenantSubs {
+		for _, pool := range pools {
+			g.dropWorkerPool(pool)
 		}
 	}
 
-	g.tenantSubs = make(map[string][]*nats.Subscription)
+	g.tenantSubs = make(map[string]map[string]*workerPool)
+	g.tenantLastSeen = make(map[string]time.Time)
+	g.provisioned.Clear()
+
+	if err := g.buildRouter(); err != nil {
+		return err
+	}
 
 	g.logger.Info("Hot Reload Complete. Workers will spin up on-demand.")
 	return nil
 }
-
-func (g *Gojinn) getFunctionTopic(tenantID string) string {
-	return fmt.Sprintf("gojinn.tenant.%s.exec.%s", tenantID, hashString(g.Path))
-}
@@ -0,0 +1,160 @@
+package gojinn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	callbackStream       = "CALLBACKS"
+	callbackQueue        = "CALLBACK_DELIVERY"
+	callbackMaxAttempts  = 8
+	callbackTimeout      = 10 * time.Second
+	headerCallbackURL    = "Gojinn-Callback-Url"
+	headerCallbackSecret = "Gojinn-Callback-Secret"
+)
+
+func callbackSubject(tenantID string) string {
+	return fmt.Sprintf("gojinn.callbacks.%s", tenantID)
+}
+
+// validateCallbackURL rejects callback targets that are not plain http(s)
+// URLs or that fall outside the configured egress allow-list.
+func (r *Gojinn) validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid callback url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback url must use http or https")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("callback url has no host")
+	}
+	return r.checkEgress(u.Hostname())
+}
+
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (r *Gojinn) setupCallbacks() error {
+	if _, err := r.js.StreamInfo(callbackStream); err != nil {
+		_, err = r.js.AddStream(&nats.StreamConfig{
+			Name:      callbackStream,
+			Subjects:  []string{"gojinn.callbacks.>"},
+			Storage:   nats.FileStorage,
+			Retention: nats.WorkQueuePolicy,
+			Replicas:  r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision callback stream: %w", err)
+		}
+	}
+
+	_, err := r.js.QueueSubscribe("gojinn.callbacks.>", callbackQueue, r.deliverCallback,
+		nats.ManualAck(), nats.BindStream(callbackStream), nats.MaxDeliver(callbackMaxAttempts))
+	if err != nil {
+		return fmt.Errorf("failed to start callback dispatcher: %w", err)
+	}
+	return nil
+}
+
+// enqueueCallback persists a webhook delivery for a finished job so that it
+// survives restarts and is retried by JetStream until it succeeds.
+func (r *Gojinn) enqueueCallback(m *nats.Msg, tenantID string, rec *JobRecord) {
+	target := m.Header.Get(headerCallbackURL)
+	if target == "" || rec == nil {
+		return
+	}
+
+	body, err := json.Marshal(rec)
+	if err != nil {
+		r.logger.Error("Failed to marshal callback event", zap.Error(err))
+		return
+	}
+
+	msg := nats.NewMsg(callbackSubject(tenantID))
+	msg.Header.Set(headerCallbackURL, target)
+	if secret := m.Header.Get(headerCallbackSecret); secret != "" {
+		msg.Header.Set(headerCallbackSecret, secret)
+	}
+	msg.Data = body
+
+	if _, err := r.js.PublishMsg(msg, nats.MsgId(fmt.Sprintf("cb_%s_%s_%s", tenantID, rec.ID, rec.State))); err != nil {
+		r.logger.Error("Failed to queue job callback", zap.String("tenant", tenantID), zap.String("job_id", rec.ID), zap.Error(err))
+	}
+}
+
+func (r *Gojinn) deliverCallback(m *nats.Msg) {
+	meta, err := m.Metadata()
+	if err != nil {
+		_ = m.Nak()
+		return
+	}
+
+	target := m.Header.Get(headerCallbackURL)
+	if err := r.validateCallbackURL(target); err != nil {
+		r.logger.Warn("Dropping callback to disallowed target", zap.String("url", target), zap.Error(err))
+		_ = m.Term()
+		return
+	}
+
+	secret := m.Header.Get(headerCallbackSecret)
+	if secret == "" {
+		secret = r.signingSecret()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(m.Data))
+	if err != nil {
+		_ = m.Term()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Gojinn-Webhook/1.0")
+	req.Header.Set("X-Gojinn-Signature", "sha256="+signPayload(secret, m.Data))
+	req.Header.Set("X-Gojinn-Delivery-Attempt", strconv.FormatUint(meta.NumDelivered, 10))
+
+	client := &http.Client{Timeout: callbackTimeout}
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			_ = m.Ack()
+			return
+		}
+		err = fmt.Errorf("callback endpoint answered %d", resp.StatusCode)
+	}
+
+	if meta.NumDelivered >= callbackMaxAttempts {
+		r.logger.Error("Giving up on job callback", zap.String("url", target), zap.Uint64("attempts", meta.NumDelivered), zap.Error(err))
+		_ = m.Ack()
+		return
+	}
+
+	backoff := time.Duration(1<<meta.NumDelivered) * time.Second
+	r.logger.Warn("Job callback failed, retrying", zap.String("url", target), zap.Duration("backoff", backoff), zap.Error(err))
+	_ = m.NakWithDelay(backoff)
+}
+
+func stripCallbackSecret(headers http.Header) http.Header {
+	if headers.Get("X-Gojinn-Callback-Secret") == "" {
+		return headers
+	}
+	clean := headers.Clone()
+	clean.Del("X-Gojinn-Callback-Secret")
+	return clean
+}
@@ -50,6 +50,20 @@ func init() {
 		Func:  wrapCobra(upCmd),
 	})
 
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:      "schedule",
+		Usage:     "[route_path] --at <time> | --in <delay>",
+		Short:     "Schedule a one-off async job (Cobra Bridge)",
+		CobraFunc: wrapCobraWithFlags(scheduleCmd),
+	})
+
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:      "cancel",
+		Usage:     "[job_id]",
+		Short:     "Cancel a scheduled job (Cobra Bridge)",
+		CobraFunc: wrapCobraWithFlags(cancelCmd),
+	})
+
 }
 
 func wrapCobra(cmd *cobra.Command) caddycmd.CommandFunc {
@@ -61,3 +75,12 @@ func wrapCobra(cmd *cobra.Command) caddycmd.CommandFunc {
 		return 0, nil
 	}
 }
+
+// wrapCobraWithFlags is wrapCobra for commands with flags, which Caddy must
+// accept on its side of the bridge before handing over.
+func wrapCobraWithFlags(cmd *cobra.Command) func(*cobra.Command) {
+	return func(bridge *cobra.Command) {
+		bridge.Flags().AddFlagSet(cmd.Flags())
+		bridge.RunE = caddycmd.WrapCommandFuncForCobra(wrapCobra(cmd))
+	}
+}
@@ -89,6 +89,13 @@ var replayCmd = &cobra.Command{
 			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_ws_upgrade").
 			NewFunctionBuilder().WithFunc(func() uint64 { return 0 }).Export("host_ws_read").
 			NewFunctionBuilder().WithFunc(func() {}).Export("host_ws_write").
+			NewFunctionBuilder().WithFunc(func(ctx context.Context, status, hPtr, hLen uint32) uint32 { return 0 }).Export("host_stream_open").
+			NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, ptr, len uint32) uint32 {
+			mem, _ := mod.Memory().Read(ptr, len)
+			fmt.Print(string(mem))
+			return 0
+		}).Export("host_stream_write").
+			NewFunctionBuilder().WithFunc(func() uint32 { return 0 }).Export("host_stream_flush").
 			Instantiate(ctx)
 
 		if err != nil {
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	scheduleServer string
+	scheduleAPIKey string
+	scheduleAt     string
+	scheduleIn     time.Duration
+	scheduleData   string
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{scheduleCmd, cancelCmd} {
+		cmd.Flags().StringVar(&scheduleServer, "server", "http://localhost:8080", "Base URL of the Gojinn server")
+		cmd.Flags().StringVar(&scheduleAPIKey, "api-key", "", "API key of the tenant (sent as X-API-Key)")
+	}
+	scheduleCmd.Flags().StringVar(&scheduleAt, "at", "", "Run at this RFC 3339 time (e.g. 2026-01-02T15:04:05Z)")
+	scheduleCmd.Flags().DurationVar(&scheduleIn, "in", 0, "Run after this delay (e.g. 90s, 2h)")
+	scheduleCmd.Flags().StringVarP(&scheduleData, "data", "d", "", "Request body; @file reads it from a file")
+
+	rootCmd.AddCommand(scheduleCmd)
+	rootCmd.AddCommand(cancelCmd)
+}
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule [route_path]",
+	Short: "Schedule a one-off run of an async function",
+	Long:  `POSTs to the route with X-Gojinn-Run-At so the job is persisted now and queued at the given time.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runAt := scheduleAt
+		switch {
+		case runAt != "" && scheduleIn != 0:
+			fmt.Println("Use either --at or --in, not both")
+			os.Exit(1)
+		case runAt == "" && scheduleIn == 0:
+			fmt.Println("One of --at or --in is required")
+			os.Exit(1)
+		case runAt == "":
+			runAt = scheduleIn.String()
+		}
+
+		body := []byte(scheduleData)
+		if strings.HasPrefix(scheduleData, "@") {
+			data, err := os.ReadFile(strings.TrimPrefix(scheduleData, "@"))
+			if err != nil {
+				fmt.Printf("Failed to read body: %v\n", err)
+				os.Exit(1)
+			}
+			body = data
+		}
+
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(scheduleServer, "/")+args[0], bytes.NewReader(body))
+		if err != nil {
+			fmt.Printf("Invalid request: %v\n", err)
+			os.Exit(1)
+		}
+		req.Header.Set("X-Gojinn-Run-At", runAt)
+
+		resp, err := sendJobRequest(req)
+		if err != nil {
+			fmt.Printf("Schedule failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		var out struct {
+			JobID  string    `json:"job_id"`
+			RunAt  time.Time `json:"run_at"`
+			Tenant string    `json:"tenant"`
+		}
+		if err := json.Unmarshal(resp, &out); err != nil {
+			fmt.Printf("Unexpected response: %s\n", resp)
+			os.Exit(1)
+		}
+		fmt.Printf("Scheduled job %s for %s (tenant %s)\n", out.JobID, out.RunAt.Local().Format(time.RFC3339), out.Tenant)
+		fmt.Printf("Cancel with: gojinn cancel %s\n", out.JobID)
+	},
+}
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [job_id]",
+	Short: "Cancel a scheduled job before it runs",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req, err := http.NewRequest(http.MethodDelete, strings.TrimSuffix(scheduleServer, "/")+"/_sys/jobs/"+args[0], nil)
+		if err != nil {
+			fmt.Printf("Invalid request: %v\n", err)
+			os.Exit(1)
+		}
+		if _, err := sendJobRequest(req); err != nil {
+			fmt.Printf("Cancel failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Job %s cancelled\n", args[0])
+	},
+}
+
+func sendJobRequest(req *http.Request) ([]byte, error) {
+	if scheduleAPIKey != "" {
+		req.Header.Set("X-API-Key", scheduleAPIKey)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
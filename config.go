@@ -2,19 +2,55 @@ package gojinn
 
 import (
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
+const (
+	ModeAsync = "async"
+	ModeSync  = "sync"
+)
+
 type CronJob struct {
-	Schedule string `json:"schedule"`
-	WasmFile string `json:"wasm_file"`
+	Schedule string         `json:"schedule"`
+	WasmFile string         `json:"wasm_file"`
+	Tenant   string         `json:"tenant,omitempty"`
+	Timezone string         `json:"timezone,omitempty"`
+	Jitter   caddy.Duration `json:"jitter,omitempty"`
+}
+
+type Route struct {
+	Method      string            `json:"method,omitempty"`
+	Pattern     string            `json:"pattern"`
+	WasmFile    string            `json:"wasm_file"`
+	Mode        string            `json:"mode,omitempty"`
+	PoolSize    int               `json:"pool_size,omitempty"`
+	PoolMin     int               `json:"pool_min,omitempty"`
+	PoolMax     int               `json:"pool_max,omitempty"`
+	Timeout     caddy.Duration    `json:"timeout,omitempty"`
+	MemoryLimit string            `json:"memory_limit,omitempty"`
+	FuelLimit   uint64            `json:"fuel_limit,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Perms       *Permissions      `json:"permissions,omitempty"`
+	Retry       *RetryPolicy      `json:"retry,omitempty"`
 }
 
 type MQTTSub struct {
-	Topic    string `json:"topic"`
+	Topic         string `json:"topic"`
+	WasmFile      string `json:"wasm_file"`
+	QoS           byte   `json:"qos,omitempty"`
+	Tenant        string `json:"tenant,omitempty"`
+	TenantSegment int    `json:"tenant_segment,omitempty"`
+}
+
+// KVTrigger runs WasmFile for every change to the keys of a tenant STATE
+// bucket matching Keys, a NATS subject pattern such as orders.>.
+type KVTrigger struct {
+	Keys     string `json:"keys"`
 	WasmFile string `json:"wasm_file"`
 }
 
@@ -90,6 +126,104 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 						m.PoolSize = val
 					}
 				}
+			case "kv_history":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := strconv.Atoi(h.Val())
+				if err != nil || val < 1 || val > maxKVHistory {
+					return nil, h.Errf("invalid kv_history '%s': must be between 1 and %d", h.Val(), maxKVHistory)
+				}
+				m.KVHistory = val
+			case "kv_ttl":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := caddy.ParseDuration(h.Val())
+				if err != nil || val <= 0 {
+					return nil, h.Errf("invalid kv_ttl '%s'", h.Val())
+				}
+				m.KVTTL = caddy.Duration(val)
+			case "on_kv_change":
+				var trigger KVTrigger
+				if !h.NextArg() {
+					return nil, h.Err("on_kv_change expects a key pattern")
+				}
+				trigger.Keys = h.Val()
+				if !validKeyPattern(trigger.Keys) {
+					return nil, h.Errf("invalid on_kv_change key pattern '%s'", trigger.Keys)
+				}
+				if !h.NextArg() {
+					return nil, h.Err("on_kv_change expects a wasm file path")
+				}
+				trigger.WasmFile = h.Val()
+				m.KVTriggers = append(m.KVTriggers, trigger)
+			case "tenant_idle_timeout":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := caddy.ParseDuration(h.Val())
+				if err != nil || val <= 0 {
+					return nil, h.Errf("invalid tenant_idle_timeout '%s'", h.Val())
+				}
+				m.TenantIdleTimeout = caddy.Duration(val)
+			case "max_hot_tenants", "max_tenants":
+				directive := h.Val()
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := strconv.Atoi(h.Val())
+				if err != nil || val < 1 {
+					return nil, h.Errf("invalid %s '%s': must be a positive number", directive, h.Val())
+				}
+				if directive == "max_tenants" {
+					m.MaxTenants = val
+				} else {
+					m.MaxHotTenants = val
+				}
+			case "pool_min", "pool_max", "max_sandboxes":
+				directive := h.Val()
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := strconv.Atoi(h.Val())
+				if err != nil || val < 1 {
+					return nil, h.Errf("invalid %s '%s': must be a positive number", directive, h.Val())
+				}
+				switch directive {
+				case "pool_min":
+					m.PoolMin = val
+				case "pool_max":
+					m.PoolMax = val
+				default:
+					m.MaxSandboxes = val
+				}
+			case "mode":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				if h.Val() != ModeAsync && h.Val() != ModeSync {
+					return nil, h.Errf("mode expects '%s' or '%s', got '%s'", ModeAsync, ModeSync, h.Val())
+				}
+				m.Mode = h.Val()
+			case "job_retention":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := caddy.ParseDuration(h.Val())
+				if err != nil {
+					return nil, h.Errf("invalid job_retention: %v", err)
+				}
+				m.JobRetention = caddy.Duration(val)
+			case "dedupe_window":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := caddy.ParseDuration(h.Val())
+				if err != nil || val <= 0 {
+					return nil, h.Errf("invalid dedupe_window '%s'", h.Val())
+				}
+				m.DedupeWindow = caddy.Duration(val)
 			case "debug_secret":
 				if h.NextArg() {
 					m.DebugSecret = h.Val()
@@ -134,17 +268,29 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				}
 
 			case "permissions":
+				parsePermissions(h, &m.Perms)
+
+			case "retry":
+				policy, err := parseRetry(h)
+				if err != nil {
+					return nil, err
+				}
+				m.Retry = policy
+
+			case "workflow":
+				wf, err := parseWorkflow(h)
+				if err != nil {
+					return nil, err
+				}
+				m.Workflows = append(m.Workflows, wf)
+
+			case "routes":
 				for nesting := h.Nesting(); h.NextBlock(nesting); {
-					switch h.Val() {
-					case "kv_read":
-						m.Perms.KVRead = append(m.Perms.KVRead, h.RemainingArgs()...)
-					case "kv_write":
-						m.Perms.KVWrite = append(m.Perms.KVWrite, h.RemainingArgs()...)
-					case "s3_read":
-						m.Perms.S3Read = append(m.Perms.S3Read, h.RemainingArgs()...)
-					case "s3_write":
-						m.Perms.S3Write = append(m.Perms.S3Write, h.RemainingArgs()...)
+					route, err := parseRoute(h)
+					if err != nil {
+						return nil, err
 					}
+					m.Routes = append(m.Routes, route)
 				}
 
 			case "ai_tool":
@@ -213,6 +359,37 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 					return nil, h.Err("cron expects a wasm file path")
 				}
 				job.WasmFile = h.Val()
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					switch h.Val() {
+					case "tenant":
+						if !h.NextArg() {
+							return nil, h.ArgErr()
+						}
+						if !tenantIDPattern.MatchString(h.Val()) {
+							return nil, h.Errf("invalid cron tenant '%s'", h.Val())
+						}
+						job.Tenant = h.Val()
+					case "timezone":
+						if !h.NextArg() {
+							return nil, h.ArgErr()
+						}
+						if _, err := time.LoadLocation(h.Val()); err != nil {
+							return nil, h.Errf("invalid cron timezone: %v", err)
+						}
+						job.Timezone = h.Val()
+					case "jitter":
+						if !h.NextArg() {
+							return nil, h.ArgErr()
+						}
+						val, err := caddy.ParseDuration(h.Val())
+						if err != nil {
+							return nil, h.Errf("invalid cron jitter: %v", err)
+						}
+						job.Jitter = caddy.Duration(val)
+					default:
+						return nil, h.Errf("unknown cron option '%s'", h.Val())
+					}
+				}
 				m.CronJobs = append(m.CronJobs, job)
 
 			case "mqtt_broker":
@@ -241,6 +418,48 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 					return nil, h.Err("mqtt_subscribe expects a wasm file path")
 				}
 				sub.WasmFile = h.Val()
+				for nesting := h.Nesting(); h.NextBlock(nesting); {
+					switch h.Val() {
+					case "qos":
+						if !h.NextArg() {
+							return nil, h.ArgErr()
+						}
+						qos, err := strconv.Atoi(h.Val())
+						if err != nil || qos < 0 || qos > 2 {
+							return nil, h.Errf("invalid mqtt qos '%s': must be 0, 1 or 2", h.Val())
+						}
+						sub.QoS = byte(qos)
+					case "tenant":
+						if !h.NextArg() {
+							return nil, h.ArgErr()
+						}
+						if !tenantIDPattern.MatchString(h.Val()) {
+							return nil, h.Errf("invalid mqtt tenant '%s'", h.Val())
+						}
+						sub.Tenant = h.Val()
+					case "tenant_segment":
+						if !h.NextArg() {
+							return nil, h.ArgErr()
+						}
+						seg, err := strconv.Atoi(h.Val())
+						if err != nil || seg < 1 {
+							return nil, h.Errf("invalid mqtt tenant_segment '%s': must be a positive topic level", h.Val())
+						}
+						sub.TenantSegment = seg
+					default:
+						return nil, h.Errf("unknown mqtt_subscribe option '%s'", h.Val())
+					}
+				}
+				if sub.Tenant != "" && sub.TenantSegment > 0 {
+					return nil, h.Err("mqtt_subscribe accepts either tenant or tenant_segment, not both")
+				}
+				if sub.TenantSegment > 0 {
+					levels := strings.Split(sub.Topic, "/")
+					wildcard := levels[len(levels)-1] == "#" && sub.TenantSegment >= len(levels)
+					if !wildcard && (sub.TenantSegment > len(levels) || levels[sub.TenantSegment-1] != "+") {
+						return nil, h.Errf("mqtt tenant_segment %d must point at a wildcard level of '%s'", sub.TenantSegment, sub.Topic)
+					}
+				}
 				m.MQTTSubs = append(m.MQTTSubs, sub)
 
 			case "ai_provider":
@@ -264,6 +483,11 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				if h.NextArg() {
 					m.APIKeys = append(m.APIKeys, h.Val())
 				}
+			case "admin_key":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				m.AdminKey = h.Val()
 			case "allow_host":
 				if h.NextArg() {
 					m.AllowedHosts = append(m.AllowedHosts, h.Val())
@@ -331,24 +555,11 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				m.ClusterReplicas = val
 
 			case "consensus":
-				for nesting := h.Nesting(); h.NextBlock(nesting); {
-					var policy ConsensusPolicy
-					policy.Namespace = h.Val()
-
-					for nesting2 := h.Nesting(); h.NextBlock(nesting2); {
-						switch h.Val() {
-						case "mode":
-							if h.NextArg() {
-								policy.Mode = h.Val()
-							}
-						case "stale_reads":
-							if h.NextArg() {
-								policy.StaleReads = h.Val() == "true"
-							}
-						}
-					}
-					m.Consensus = append(m.Consensus, policy)
+				policies, err := parseConsensus(h)
+				if err != nil {
+					return nil, err
 				}
+				m.Consensus = append(m.Consensus, policies...)
 			case "store_cipher_key":
 				if !h.NextArg() {
 					return nil, h.Err("store_cipher_key requires a master password or cipher string")
@@ -373,3 +584,112 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 	}
 	return &m, nil
 }
+
+func parsePermissions(h httpcaddyfile.Helper, perms *Permissions) {
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "kv_read":
+			perms.KVRead = append(perms.KVRead, h.RemainingArgs()...)
+		case "kv_write":
+			perms.KVWrite = append(perms.KVWrite, h.RemainingArgs()...)
+		case "s3_read":
+			perms.S3Read = append(perms.S3Read, h.RemainingArgs()...)
+		case "s3_write":
+			perms.S3Write = append(perms.S3Write, h.RemainingArgs()...)
+		case "enqueue":
+			perms.Enqueue = append(perms.Enqueue, h.RemainingArgs()...)
+		}
+	}
+}
+
+// parseRoute reads one `<METHOD> <pattern> <wasm_file> [{ ... }]` line of a
+// routes block. METHOD may be * to match any method.
+func parseRoute(h httpcaddyfile.Helper) (Route, error) {
+	route := Route{Method: strings.ToUpper(h.Val())}
+	args := h.RemainingArgs()
+	if len(args) != 2 {
+		return route, h.Err("route expects <METHOD> <pattern> <wasm_file>")
+	}
+	route.Pattern = args[0]
+	route.WasmFile = args[1]
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "mode":
+			if !h.NextArg() {
+				return route, h.ArgErr()
+			}
+			if h.Val() != ModeAsync && h.Val() != ModeSync {
+				return route, h.Errf("mode expects '%s' or '%s', got '%s'", ModeAsync, ModeSync, h.Val())
+			}
+			route.Mode = h.Val()
+		case "pool_size":
+			if !h.NextArg() {
+				return route, h.ArgErr()
+			}
+			val, err := strconv.Atoi(h.Val())
+			if err != nil {
+				return route, h.Errf("invalid pool_size: %v", err)
+			}
+			route.PoolSize = val
+		case "pool_min", "pool_max":
+			directive := h.Val()
+			if !h.NextArg() {
+				return route, h.ArgErr()
+			}
+			val, err := strconv.Atoi(h.Val())
+			if err != nil || val < 1 {
+				return route, h.Errf("invalid %s '%s': must be a positive number", directive, h.Val())
+			}
+			if directive == "pool_min" {
+				route.PoolMin = val
+			} else {
+				route.PoolMax = val
+			}
+		case "timeout":
+			if !h.NextArg() {
+				return route, h.ArgErr()
+			}
+			val, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return route, h.Errf("invalid timeout: %v", err)
+			}
+			route.Timeout = caddy.Duration(val)
+		case "memory_limit":
+			if !h.NextArg() {
+				return route, h.ArgErr()
+			}
+			route.MemoryLimit = h.Val()
+		case "fuel_limit":
+			if !h.NextArg() {
+				return route, h.ArgErr()
+			}
+			val, err := strconv.ParseUint(h.Val(), 10, 64)
+			if err != nil {
+				return route, h.Errf("invalid fuel_limit: %v", err)
+			}
+			route.FuelLimit = val
+		case "env":
+			args := h.RemainingArgs()
+			if len(args) != 2 {
+				return route, h.Err("env expects <key> <value>")
+			}
+			if route.Env == nil {
+				route.Env = make(map[string]string)
+			}
+			route.Env[args[0]] = args[1]
+		case "permissions":
+			route.Perms = &Permissions{}
+			parsePermissions(h, route.Perms)
+		case "retry":
+			policy, err := parseRetry(h)
+			if err != nil {
+				return route, err
+			}
+			route.Retry = policy
+		default:
+			return route, h.Errf("unknown route option '%s'", h.Val())
+		}
+	}
+	return route, nil
+}
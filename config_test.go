@@ -104,3 +104,385 @@ func TestParseCaddyfile(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCaddyfile_Routes(t *testing.T) {
+	input := `gojinn {
+		routes {
+			GET /users/{id} ./users.wasm
+			POST /orders ./orders.wasm {
+				mode sync
+				pool_size 4
+				timeout 3s
+				env REGION eu
+				permissions {
+					kv_read orders.*
+				}
+			}
+			* /files/{path...} ./files.wasm
+		}
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Len(t, g.Routes, 3)
+
+	assert.Equal(t, Route{Method: "GET", Pattern: "/users/{id}", WasmFile: "./users.wasm"}, g.Routes[0])
+
+	orders := g.Routes[1]
+	assert.Equal(t, "POST", orders.Method)
+	assert.Equal(t, ModeSync, orders.Mode)
+	assert.Equal(t, 4, orders.PoolSize)
+	assert.Equal(t, caddy.Duration(3*time.Second), orders.Timeout)
+	assert.Equal(t, map[string]string{"REGION": "eu"}, orders.Env)
+	assert.Equal(t, []string{"orders.*"}, orders.Perms.KVRead)
+
+	assert.Equal(t, "*", g.Routes[2].Method)
+
+	bad := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(`gojinn {
+		routes {
+			GET /users ./users.wasm {
+				replicas 3
+			}
+		}
+	}`)}
+	_, err = parseCaddyfile(bad)
+	assert.Error(t, err)
+}
+
+func TestParseCaddyfile_Cron(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		cron "0 */5 * * * *" ./report.wasm {
+			tenant acme
+			timezone Europe/Lisbon
+			jitter 30s
+		}
+		cron "@hourly" ./cleanup.wasm
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, []CronJob{
+		{Schedule: "0 */5 * * * *", WasmFile: "./report.wasm", Tenant: "acme", Timezone: "Europe/Lisbon", Jitter: caddy.Duration(30 * time.Second)},
+		{Schedule: "@hourly", WasmFile: "./cleanup.wasm"},
+	}, g.CronJobs)
+
+	for _, bad := range []string{"timezone Mars/Olympus", "tenant a.b", "jitter soon"} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+			cron "@hourly" ./cleanup.wasm {
+				` + bad + `
+			}
+		}`)}
+		_, err := parseCaddyfile(h)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseCaddyfile_MQTTSubscribe(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		mqtt_broker tcp://localhost:1883
+		mqtt_subscribe devices/+/telemetry ./telemetry.wasm {
+			qos 1
+			tenant_segment 2
+		}
+		mqtt_subscribe alerts/# ./alerts.wasm {
+			tenant acme
+		}
+		mqtt_subscribe status ./status.wasm
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, []MQTTSub{
+		{Topic: "devices/+/telemetry", WasmFile: "./telemetry.wasm", QoS: 1, TenantSegment: 2},
+		{Topic: "alerts/#", WasmFile: "./alerts.wasm", Tenant: "acme"},
+		{Topic: "status", WasmFile: "./status.wasm"},
+	}, g.MQTTSubs)
+
+	for _, bad := range []string{"qos 3", "tenant a.b", "tenant_segment 0", "tenant_segment 1", "tenant acme\ntenant_segment 2", "retain yes"} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+			mqtt_subscribe devices/+/telemetry ./telemetry.wasm {
+				` + bad + `
+			}
+		}`)}
+		_, err := parseCaddyfile(h)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseCaddyfile_Retry(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		retry {
+			max 10
+			backoff exponential 500ms 5m
+			jitter 20%
+			retry_on trap,timeout
+		}
+		routes {
+			POST /orders ./orders.wasm {
+				retry {
+					max 1
+				}
+			}
+		}
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, &RetryPolicy{
+		Max:        10,
+		Backoff:    BackoffExponential,
+		Initial:    caddy.Duration(500 * time.Millisecond),
+		MaxBackoff: caddy.Duration(5 * time.Minute),
+		Jitter:     0.2,
+		RetryOn:    []string{FailureTrap, FailureTimeout},
+	}, g.Retry)
+	assert.Equal(t, &RetryPolicy{Max: 1}, g.Routes[0].Retry)
+
+	for _, bad := range []string{"max 0", "backoff fibonacci", "backoff linear soon", "jitter 150%", "retry_on oom", "attempts 3"} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(`gojinn ./app.wasm {
+			retry {
+				` + bad + `
+			}
+		}`)}
+		_, err := parseCaddyfile(h)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	linear := RetryPolicy{}.withDefaults()
+	assert.Equal(t, 3*time.Second, linear.delay(3))
+
+	exp := RetryPolicy{Backoff: BackoffExponential, Initial: caddy.Duration(500 * time.Millisecond), MaxBackoff: caddy.Duration(5 * time.Second)}.withDefaults()
+	assert.Equal(t, 500*time.Millisecond, exp.delay(1))
+	assert.Equal(t, 2*time.Second, exp.delay(3))
+	assert.Equal(t, 5*time.Second, exp.delay(10))
+	assert.Equal(t, 5*time.Second, exp.delay(200))
+
+	jittered := RetryPolicy{Backoff: BackoffConstant, Initial: caddy.Duration(10 * time.Second), Jitter: 0.2}.withDefaults()
+	for i := 0; i < 50; i++ {
+		d := jittered.delay(1)
+		assert.True(t, d >= 8*time.Second && d <= 12*time.Second, d)
+	}
+
+	assert.True(t, linear.retries(FailureTrap))
+	assert.False(t, linear.retries(FailureFatal))
+	assert.False(t, RetryPolicy{RetryOn: []string{FailureTimeout}}.retries(FailureTrap))
+}
+
+func TestParseCaddyfile_Workflow(t *testing.T) {
+	input := `gojinn {
+		workflow checkout {
+			step reserve ./reserve.wasm {
+				compensate ./release.wasm
+			}
+			parallel {
+				step charge ./charge.wasm {
+					compensate ./refund.wasm
+				}
+				step email ./email.wasm
+			}
+			step ship ./ship.wasm
+		}
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, []Workflow{{
+		Name: "checkout",
+		Stages: [][]WorkflowStep{
+			{{Name: "reserve", WasmFile: "./reserve.wasm", Compensate: "./release.wasm"}},
+			{{Name: "charge", WasmFile: "./charge.wasm", Compensate: "./refund.wasm"}, {Name: "email", WasmFile: "./email.wasm"}},
+			{{Name: "ship", WasmFile: "./ship.wasm"}},
+		},
+	}}, g.Workflows)
+	assert.NoError(t, g.Workflows[0].validate())
+
+	for _, bad := range []string{"step only_name", "parallel {\n}", "retry 3", "step a ./a.wasm {\n undo ./b.wasm\n}"} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(`gojinn {
+			workflow w {
+				` + bad + `
+			}
+		}`)}
+		_, err := parseCaddyfile(h)
+		assert.Error(t, err, bad)
+	}
+
+	dup := Workflow{Name: "w", Stages: [][]WorkflowStep{{{Name: "a", WasmFile: "a.wasm"}}, {{Name: "a", WasmFile: "b.wasm"}}}}
+	assert.Error(t, dup.validate())
+}
+
+func TestParseCaddyfile_Capacity(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		pool_size 2
+		pool_min 1
+		pool_max 8
+		max_sandboxes 32
+		tenant_idle_timeout 5m
+		max_hot_tenants 100
+		max_tenants 1000
+		routes {
+			POST /resize ./resize.wasm {
+				pool_max 16
+			}
+		}
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, 1, g.PoolMin)
+	assert.Equal(t, 8, g.PoolMax)
+	assert.Equal(t, 32, g.MaxSandboxes)
+	assert.Equal(t, caddy.Duration(5*time.Minute), g.TenantIdleTimeout)
+	assert.Equal(t, 100, g.MaxHotTenants)
+	assert.Equal(t, 1000, g.MaxTenants)
+	assert.Equal(t, 16, g.Routes[0].PoolMax)
+
+	for _, bad := range []string{"pool_min 0", "pool_max lots", "max_sandboxes", "tenant_idle_timeout 0s", "max_tenants -1"} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser("gojinn ./app.wasm {\n" + bad + "\n}")}
+		_, err := parseCaddyfile(h)
+		assert.Error(t, err, bad)
+	}
+
+	cases := []struct {
+		fn              functionSpec
+		lo, initial, hi int
+	}{
+		{functionSpec{PoolSize: 4}, 4, 4, 4},
+		{functionSpec{PoolSize: 2, PoolMin: 1, PoolMax: 8}, 1, 2, 8},
+		{functionSpec{PoolSize: 2, PoolMin: 3}, 3, 3, 3},
+		{functionSpec{PoolSize: 10, PoolMax: 6}, 10, 10, 10},
+		{functionSpec{PoolSize: 10, PoolMin: 1, PoolMax: 6}, 1, 6, 6},
+	}
+	for _, c := range cases {
+		lo, initial, hi := c.fn.poolBounds()
+		assert.Equal(t, []int{c.lo, c.initial, c.hi}, []int{lo, initial, hi}, c.fn)
+	}
+}
+
+func TestParseCaddyfile_KVNamespaces(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		kv_history 3
+		kv_ttl 1h
+		consensus {
+			orders. {
+				history 20
+			}
+			sessions. {
+				mode ap
+				ttl 30m
+			}
+		}
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, 3, g.KVHistory)
+	assert.Equal(t, caddy.Duration(time.Hour), g.KVTTL)
+	assert.Equal(t, []ConsensusPolicy{
+		{Namespace: "orders.", Mode: ConsensusCP, History: 20},
+		{Namespace: "sessions.", Mode: ConsensusAP, StaleReads: true, TTL: caddy.Duration(30 * time.Minute)},
+	}, g.Consensus)
+	assert.Equal(t, 3, g.stateHistory(nil))
+	assert.Equal(t, 20, g.stateHistory(g.kvNamespace("orders.42")))
+	assert.Equal(t, 3, g.stateHistory(g.kvNamespace("carts.42")))
+	assert.Equal(t, 30*time.Minute, g.kvTTL("sessions.42"))
+	assert.Equal(t, time.Hour, g.kvTTL("orders.42"))
+
+	for _, bad := range []string{"kv_history 65", "consensus {\n a. {\n history 0\n }\n}", "kv_ttl 0s", "consensus {\n a. {\n ttl never\n }\n}"} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser("gojinn ./app.wasm {\n" + bad + "\n}")}
+		_, err := parseCaddyfile(h)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseCaddyfile_KVTriggers(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		on_kv_change "orders.>" ./view.wasm
+		on_kv_change carts.*.total ./totals.wasm
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+	assert.Equal(t, []KVTrigger{
+		{Keys: "orders.>", WasmFile: "./view.wasm"},
+		{Keys: "carts.*.total", WasmFile: "./totals.wasm"},
+	}, handler.(*Gojinn).KVTriggers)
+
+	for _, bad := range []string{"on_kv_change", "on_kv_change orders.>", "on_kv_change orders.>.x ./a.wasm", "on_kv_change orders..x ./a.wasm", "on_kv_change orders* ./a.wasm", "on_kv_change _gojinn.ttl.> ./a.wasm"} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser("gojinn ./app.wasm {\n" + bad + "\n}")}
+		_, err := parseCaddyfile(h)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseCaddyfile_Consensus(t *testing.T) {
+	input := `gojinn ./app.wasm {
+		consensus {
+			payments. {
+				mode cp
+				replicas 3
+			}
+			sessions. {
+				mode ap
+			}
+			prefs. {
+				mode ap
+				stale_reads false
+			}
+			locks. {
+			}
+		}
+	}`
+
+	h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser(input)}
+	handler, err := parseCaddyfile(h)
+	assert.NoError(t, err)
+
+	g := handler.(*Gojinn)
+	assert.Equal(t, []ConsensusPolicy{
+		{Namespace: "payments.", Mode: ConsensusCP, Replicas: 3},
+		{Namespace: "sessions.", Mode: ConsensusAP, StaleReads: true},
+		{Namespace: "prefs.", Mode: ConsensusAP},
+		{Namespace: "locks.", Mode: ConsensusCP},
+	}, g.Consensus)
+	assert.Equal(t, 0, g.consensusIndex("payments.42"))
+	assert.Equal(t, -1, g.consensusIndex("orders.42"))
+	assert.NotEqual(t, namespaceBucket("t1", "payments."), namespaceBucket("t1", "sessions."))
+
+	for _, bad := range []string{
+		"consensus {\n a. {\n mode ca\n }\n}",
+		"consensus {\n a. {\n mode cp\n stale_reads true\n }\n}",
+		"consensus {\n a. {\n stale_reads maybe\n }\n}",
+		"consensus {\n a. {\n replicas 7\n }\n}",
+		"consensus {\n a. {\n quorum 2\n }\n}",
+		"consensus {\n a. {\n }\n a. {\n }\n}",
+		"consensus {\n _gojinn.x {\n }\n}",
+	} {
+		h := httpcaddyfile.Helper{Dispenser: caddyfile.NewTestDispenser("gojinn ./app.wasm {\n" + bad + "\n}")}
+		_, err := parseCaddyfile(h)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,294 @@
+package gojinn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	// ConsensusCP namespaces are read from the stream leader, so a node cut
+	// off from the quorum rejects reads as well as writes.
+	ConsensusCP = "cp"
+	// ConsensusAP namespaces may be read from the local replica, which keeps
+	// answering, possibly stale, while the quorum is out of reach.
+	ConsensusAP = "ap"
+
+	// maxStateReplicas is the most replicas JetStream keeps of a stream.
+	maxStateReplicas = 5
+)
+
+// tenantState holds the STATE buckets of a tenant opened by this node: the
+// default one and one per consensus namespace, in the order of r.Consensus.
+type tenantState struct {
+	def        nats.KeyValue
+	namespaces []nats.KeyValue
+}
+
+// consensusIndex returns the index of the consensus namespace with the longest
+// prefix matching key, or -1 when key belongs to the default bucket.
+func (r *Gojinn) consensusIndex(key string) int {
+	best := -1
+	for i, p := range r.Consensus {
+		if strings.HasPrefix(key, p.Namespace) && (best < 0 || len(p.Namespace) > len(r.Consensus[best].Namespace)) {
+			best = i
+		}
+	}
+	return best
+}
+
+// bucketsFor returns the buckets that may hold keys starting with prefix.
+func (s *tenantState) bucketsFor(r *Gojinn, prefix string) []nats.KeyValue {
+	var buckets []nats.KeyValue
+	if r.consensusIndex(prefix) < 0 {
+		buckets = append(buckets, s.def)
+	}
+	for i, p := range r.Consensus {
+		if strings.HasPrefix(p.Namespace, prefix) || strings.HasPrefix(prefix, p.Namespace) {
+			buckets = append(buckets, s.namespaces[i])
+		}
+	}
+	return buckets
+}
+
+func (s *tenantState) forKey(r *Gojinn, key string) nats.KeyValue {
+	if i := r.consensusIndex(key); i >= 0 {
+		return s.namespaces[i]
+	}
+	return s.def
+}
+
+// namespaceBucket names the bucket of tenantID holding the keys of the
+// consensus namespace ns. Namespaces are key prefixes, which may hold
+// characters bucket names cannot, hence the hash.
+func namespaceBucket(tenantID, ns string) string {
+	return stateBucket(tenantID) + "_NS" + strings.ToUpper(hashString(ns)[:8])
+}
+
+// stateBucketNames names every STATE bucket of tenantID.
+func (r *Gojinn) stateBucketNames(tenantID string) []string {
+	names := []string{stateBucket(tenantID)}
+	for _, p := range r.Consensus {
+		names = append(names, namespaceBucket(tenantID, p.Namespace))
+	}
+	return names
+}
+
+func (p *ConsensusPolicy) mode() string {
+	if p.Mode == "" {
+		return ConsensusCP
+	}
+	return p.Mode
+}
+
+func (p *ConsensusPolicy) replicas(def int) int {
+	if p.Replicas > 0 {
+		return p.Replicas
+	}
+	return def
+}
+
+// tenantKV returns the STATE bucket holding key for the tenant running under
+// ctx, so the KV and mutex host functions never reach another tenant's keys.
+func (r *Gojinn) tenantKV(ctx context.Context, key string) (nats.KeyValue, error) {
+	state, err := r.tenantState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return state.forKey(r, key), nil
+}
+
+// tenantState opens the STATE buckets of the tenant running under ctx. The
+// first use on this node provisions the namespace buckets and starts
+// following them for on_kv_change triggers.
+func (r *Gojinn) tenantState(ctx context.Context) (*tenantState, error) {
+	tenantID := tenantOf(ctx)
+	if state, ok := r.stateBuckets.Load(tenantID); ok {
+		return state.(*tenantState), nil
+	}
+	kv, err := r.EnsureTenantResources(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	r.syncStateStream(stateBucket(tenantID), nil)
+
+	state := &tenantState{def: kv}
+	for i := range r.Consensus {
+		nkv, err := r.ensureNamespaceBucket(tenantID, &r.Consensus[i])
+		if err != nil {
+			return nil, err
+		}
+		state.namespaces = append(state.namespaces, nkv)
+	}
+	if err := r.watchKVChanges(tenantID); err != nil {
+		return nil, err
+	}
+	r.stateBuckets.Store(tenantID, state)
+	return state, nil
+}
+
+// ensureNamespaceBucket provisions the bucket of a consensus namespace with
+// the replicas of its policy. Direct gets, answered by any replica, are only
+// allowed when the policy accepts stale reads.
+func (r *Gojinn) ensureNamespaceBucket(tenantID string, p *ConsensusPolicy) (nats.KeyValue, error) {
+	bucket := namespaceBucket(tenantID, p.Namespace)
+	if _, err := r.js.KeyValue(bucket); errors.Is(err, nats.ErrBucketNotFound) {
+		r.logger.Info("Provisioning Tenant KV Namespace...", zap.String("tenant", tenantID), zap.String("namespace", p.Namespace), zap.String("bucket", bucket))
+		_, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: fmt.Sprintf("State namespace %s (%s) for %s", p.Namespace, p.mode(), tenantID),
+			Storage:     nats.FileStorage,
+			History:     uint8(r.stateHistory(p)), //nolint:gosec
+			Replicas:    p.replicas(r.ClusterReplicas),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to provision kv namespace %s: %w", p.Namespace, err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	r.syncStateStream(bucket, p)
+	// Bind after the stream is in line with the policy: the handle decides
+	// between direct and leader reads when it is opened.
+	return r.js.KeyValue(bucket)
+}
+
+// syncStateStream adjusts the stream of an existing STATE bucket when the
+// configuration changed its history depth or, for the bucket of consensus
+// policy p, its replicas and whether it allows direct gets.
+func (r *Gojinn) syncStateStream(bucket string, p *ConsensusPolicy) {
+	info, err := r.js.StreamInfo("KV_" + bucket)
+	if err != nil {
+		return
+	}
+	cfg := info.Config
+	cfg.MaxMsgsPerSubject = int64(r.stateHistory(p))
+	if p != nil {
+		cfg.Replicas = p.replicas(r.ClusterReplicas)
+		cfg.AllowDirect = p.StaleReads
+	}
+	if cfg.MaxMsgsPerSubject == info.Config.MaxMsgsPerSubject && cfg.Replicas == info.Config.Replicas && cfg.AllowDirect == info.Config.AllowDirect {
+		return
+	}
+	if _, err := r.js.UpdateStream(&cfg); err != nil {
+		r.logger.Warn("Failed to update kv bucket", zap.String("bucket", bucket), zap.Error(err))
+	}
+}
+
+// checkConsensus rejects the policies that cannot hold, such as a CP
+// namespace answering stale reads or two policies for one namespace.
+func (r *Gojinn) checkConsensus() error {
+	seen := make(map[string]bool)
+	for _, p := range r.Consensus {
+		switch {
+		case p.Namespace == "" || strings.HasPrefix(p.Namespace, kvReservedPrefix):
+			return fmt.Errorf("invalid consensus namespace '%s'", p.Namespace)
+		case seen[p.Namespace]:
+			return fmt.Errorf("duplicate consensus namespace '%s'", p.Namespace)
+		case p.mode() != ConsensusCP && p.mode() != ConsensusAP:
+			return fmt.Errorf("invalid consensus mode '%s' for namespace '%s'", p.Mode, p.Namespace)
+		case p.mode() == ConsensusCP && p.StaleReads:
+			return fmt.Errorf("consensus namespace '%s' is cp and cannot allow stale reads", p.Namespace)
+		case p.Replicas < 0 || p.Replicas > maxStateReplicas:
+			return fmt.Errorf("invalid replicas %d for consensus namespace '%s'", p.Replicas, p.Namespace)
+		case p.History < 0 || p.History > maxKVHistory:
+			return fmt.Errorf("invalid history %d for consensus namespace '%s'", p.History, p.Namespace)
+		case p.TTL < 0:
+			return fmt.Errorf("invalid ttl for consensus namespace '%s'", p.Namespace)
+		}
+		seen[p.Namespace] = true
+	}
+	return nil
+}
+
+// parseConsensus reads a consensus block, one namespace per entry:
+//
+//	consensus {
+//	    payments. {
+//	        mode     cp
+//	        replicas 3
+//	        history  20
+//	    }
+//	    sessions. {
+//	        mode        ap
+//	        stale_reads true
+//	        ttl         30m
+//	    }
+//	}
+//
+// AP namespaces allow stale reads unless stale_reads false says otherwise.
+func parseConsensus(h httpcaddyfile.Helper) ([]ConsensusPolicy, error) {
+	var policies []ConsensusPolicy
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		policy := ConsensusPolicy{Namespace: h.Val(), Mode: ConsensusCP}
+		staleSet := false
+		for nesting2 := h.Nesting(); h.NextBlock(nesting2); {
+			switch h.Val() {
+			case "mode":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				if h.Val() != ConsensusCP && h.Val() != ConsensusAP {
+					return nil, h.Errf("invalid consensus mode '%s': must be cp or ap", h.Val())
+				}
+				policy.Mode = h.Val()
+			case "stale_reads":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := strconv.ParseBool(h.Val())
+				if err != nil {
+					return nil, h.Errf("invalid stale_reads '%s'", h.Val())
+				}
+				policy.StaleReads, staleSet = val, true
+			case "replicas":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := strconv.Atoi(h.Val())
+				if err != nil || val < 1 || val > maxStateReplicas {
+					return nil, h.Errf("invalid replicas '%s': must be between 1 and %d", h.Val(), maxStateReplicas)
+				}
+				policy.Replicas = val
+			case "history":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := strconv.Atoi(h.Val())
+				if err != nil || val < 1 || val > maxKVHistory {
+					return nil, h.Errf("invalid history '%s': must be between 1 and %d", h.Val(), maxKVHistory)
+				}
+				policy.History = val
+			case "ttl":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				val, err := caddy.ParseDuration(h.Val())
+				if err != nil || val <= 0 {
+					return nil, h.Errf("invalid ttl '%s'", h.Val())
+				}
+				policy.TTL = caddy.Duration(val)
+			default:
+				return nil, h.Errf("unknown consensus option '%s'", h.Val())
+			}
+		}
+		if policy.Mode == ConsensusAP && !staleSet {
+			policy.StaleReads = true
+		}
+		policies = append(policies, policy)
+	}
+
+	probe := &Gojinn{Consensus: policies}
+	if err := probe.checkConsensus(); err != nil {
+		return nil, h.Err(err.Error())
+	}
+	return policies, nil
+}
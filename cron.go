@@ -0,0 +1,254 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const cronStateBucket = "GOJINN_CRON"
+
+// CronState is the queryable record of a cron entry, shared by every node.
+type CronState struct {
+	Name      string     `json:"name"`
+	Schedule  string     `json:"schedule"`
+	Timezone  string     `json:"timezone,omitempty"`
+	Tenant    string     `json:"tenant"`
+	WasmFile  string     `json:"wasm_file"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastJobID string     `json:"last_job_id,omitempty"`
+	NextRun   *time.Time `json:"next_run,omitempty"`
+}
+
+// cronTrigger turns the ticks of one cron entry into jobs on its tenant
+// stream. Every node schedules every entry; the message ID derived from the
+// scheduled time lets JetStream drop the copies published by other nodes.
+type cronTrigger struct {
+	r   *Gojinn
+	job CronJob
+	fn  *functionSpec
+	key string
+	id  cron.EntryID
+}
+
+func (t *cronTrigger) tenant() string {
+	if t.job.Tenant != "" {
+		return t.job.Tenant
+	}
+	return DefaultTriggerTenant
+}
+
+func (t *cronTrigger) Run() {
+	scheduled := t.r.scheduler.Entry(t.id).Prev
+	if scheduled.IsZero() {
+		scheduled = time.Now().Truncate(time.Second)
+	}
+
+	if delay := cronJitter(t.key, scheduled, time.Duration(t.job.Jitter)); delay > 0 {
+		time.Sleep(delay)
+	}
+	t.r.fireCron(t, scheduled)
+}
+
+// cronJitter derives the delay of a tick from the entry and its scheduled
+// time, so all nodes wait the same amount and their publishes still collide
+// inside the stream's duplicate window.
+func cronJitter(key string, scheduled time.Time, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d", key, scheduled.Unix())
+	return time.Duration(h.Sum64() % uint64(jitter)) //nolint:gosec
+}
+
+func (r *Gojinn) cronFunction(job CronJob) *functionSpec {
+	fn := r.defaultFunction()
+	fn.Name = job.WasmFile
+	fn.Key = hashString(job.WasmFile)
+	fn.WasmFile = job.WasmFile
+	fn.Mode = ModeAsync
+	return fn
+}
+
+func (r *Gojinn) setupCron() error {
+	if len(r.CronJobs) == 0 {
+		return nil
+	}
+
+	kv, err := r.js.KeyValue(cronStateBucket)
+	if err != nil {
+		kv, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      cronStateBucket,
+			Description: "Last and next run of cron triggers",
+			Storage:     nats.FileStorage,
+			History:     1,
+			Replicas:    r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision cron state bucket: %w", err)
+		}
+	}
+	r.cronState = kv
+
+	r.scheduler = cron.New(cron.WithSeconds())
+	var triggers []*cronTrigger
+	for _, job := range r.CronJobs {
+		if _, err := r.loadWasmSecurely(job.WasmFile); err != nil {
+			return fmt.Errorf("cron job security check failed for %s: %w", job.WasmFile, err)
+		}
+
+		spec := job.Schedule
+		if job.Timezone != "" {
+			spec = "CRON_TZ=" + job.Timezone + " " + spec
+		}
+
+		trigger := &cronTrigger{r: r, job: job, fn: r.cronFunction(job)}
+		trigger.key = hashString(fmt.Sprintf("%s|%s|%s|%s", trigger.tenant(), job.Timezone, job.Schedule, job.WasmFile))
+		trigger.id, err = r.scheduler.AddJob(spec, trigger)
+		if err != nil {
+			return fmt.Errorf("failed to schedule cron job: %v", err)
+		}
+		triggers = append(triggers, trigger)
+		r.logger.Info("Cron job scheduled", zap.String("schedule", job.Schedule), zap.String("wasm", job.WasmFile), zap.String("tenant", trigger.tenant()))
+	}
+	r.scheduler.Start()
+
+	for _, t := range triggers {
+		r.recordCronRun(t, nil, "")
+	}
+	return nil
+}
+
+func (r *Gojinn) fireCron(t *cronTrigger, scheduled time.Time) {
+	ctx, span := otel.Tracer("gojinn-scheduler").Start(context.Background(), "cron_trigger")
+	defer span.End()
+
+	tenantID := t.tenant()
+	fail := func(msg string, err error) {
+		r.logger.Error(msg, zap.String("wasm", t.job.WasmFile), zap.String("tenant", tenantID), zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, msg)
+	}
+
+	event, _ := json.Marshal(map[string]interface{}{
+		"event_type":   "cron",
+		"source":       "gojinn_scheduler",
+		"schedule":     t.job.Schedule,
+		"scheduled_at": scheduled.UTC(),
+	})
+	req := JobRequest{
+		Method:  "CRON",
+		URI:     "internal://cron/" + t.key[:12],
+		Headers: map[string][]string{"X-Source": {"cron"}},
+		Body:    string(event),
+	}
+
+	pubAck, err := r.enqueueFunctionJob(ctx, tenantID, t.fn, req, nats.MsgId(fmt.Sprintf("cron:%s:%d", t.key, scheduled.Unix())))
+	if err != nil {
+		fail("Failed to queue cron job", err)
+		return
+	}
+	if pubAck.Duplicate {
+		r.logger.Debug("Cron tick already queued by another node", zap.String("wasm", t.job.WasmFile), zap.Time("scheduled", scheduled))
+		return
+	}
+
+	jobID := strconv.FormatUint(pubAck.Sequence, 10)
+	r.recordCronRun(t, &scheduled, jobID)
+
+	r.logger.Info("Cron Job Persisted & Queued",
+		zap.String("wasm", t.job.WasmFile),
+		zap.String("tenant", tenantID),
+		zap.String("job_id", jobID),
+		zap.String("trace_id", span.SpanContext().TraceID().String()),
+	)
+}
+
+// recordCronRun refreshes the stored state of a cron entry. A nil lastRun
+// only updates the next run, keeping the history written by other nodes, and
+// an older tick finishing late never replaces a newer one.
+func (r *Gojinn) recordCronRun(t *cronTrigger, lastRun *time.Time, jobID string) {
+	if r.cronState == nil {
+		return
+	}
+
+	// Nodes refresh the same key concurrently; retry on revision conflicts so
+	// a next-run refresh never erases a last run recorded elsewhere.
+	const maxAttempts = 10
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		state, revision := CronState{}, uint64(0)
+		if entry, err := r.cronState.Get(t.key); err == nil {
+			_ = json.Unmarshal(entry.Value(), &state)
+			revision = entry.Revision()
+		}
+		r.fillCronState(t, &state, lastRun, jobID)
+
+		data, _ := json.Marshal(state)
+		var err error
+		if revision == 0 {
+			_, err = r.cronState.Create(t.key, data)
+		} else {
+			_, err = r.cronState.Update(t.key, data, revision)
+		}
+		if err == nil {
+			return
+		}
+		if attempt == maxAttempts {
+			r.logger.Warn("Failed to record cron run", zap.String("wasm", t.job.WasmFile), zap.Error(err))
+		}
+	}
+}
+
+func (r *Gojinn) fillCronState(t *cronTrigger, state *CronState, lastRun *time.Time, jobID string) {
+	state.Name = t.fn.Name
+	state.Schedule = t.job.Schedule
+	state.Timezone = t.job.Timezone
+	state.Tenant = t.tenant()
+	state.WasmFile = t.job.WasmFile
+	if lastRun != nil && (state.LastRun == nil || lastRun.After(*state.LastRun)) {
+		last := lastRun.UTC()
+		state.LastRun = &last
+		state.LastJobID = jobID
+	}
+	if next := r.scheduler.Entry(t.id).Next; !next.IsZero() {
+		next = next.UTC()
+		state.NextRun = &next
+	}
+}
+
+// serveCronStatus implements GET /_sys/cron.
+func (r *Gojinn) serveCronStatus(rw http.ResponseWriter, _ *http.Request) error {
+	states := []CronState{}
+	if r.cronState != nil {
+		keys, err := r.cronState.Keys()
+		if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		for _, key := range keys {
+			entry, err := r.cronState.Get(key)
+			if err != nil {
+				continue
+			}
+			var state CronState
+			if json.Unmarshal(entry.Value(), &state) == nil {
+				states = append(states, state)
+			}
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(states)
+}
@@ -0,0 +1,331 @@
+package gojinn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDLQListLimit = 100
+	maxDLQListLimit     = 1000
+)
+
+var errRequeueRejected = errors.New("requeue rejected")
+
+func dlqStreamName(tenantID string) string {
+	return fmt.Sprintf("DLQ_%s", strings.ToUpper(tenantID))
+}
+
+func dlqSubject(tenantID string) string {
+	return fmt.Sprintf("gojinn.dlq.%s", tenantID)
+}
+
+// DeadLetter is a job that will not be retried, kept with everything needed
+// to inspect and requeue it. Its JSON is a superset of CrashSnapshot, so a
+// downloaded entry can be fed to `gojinn replay`.
+type DeadLetter struct {
+	Seq           uint64              `json:"seq,omitempty"`
+	JobID         string              `json:"job_id"`
+	Tenant        string              `json:"tenant"`
+	Function      string              `json:"function"`
+	FunctionKey   string              `json:"function_key"`
+	WasmFile      string              `json:"wasm_file"`
+	Subject       string              `json:"subject"`
+	Headers       map[string][]string `json:"headers,omitempty"`
+	Input         json.RawMessage     `json:"input,omitempty"`
+	Error         string              `json:"error"`
+	FuelExhausted bool                `json:"fuel_exhausted,omitempty"`
+	Attempts      []JobAttempt        `json:"attempts,omitempty"`
+	Timestamp     time.Time           `json:"timestamp"`
+}
+
+// deadLetter moves the job carried by m to the DLQ stream of its tenant with
+// its request, headers and attempt history.
+func (r *Gojinn) deadLetter(m *nats.Msg, tenantID string, fn *functionSpec, rec *JobRecord, fuelExhausted bool) error {
+	headers := make(map[string][]string, len(m.Header))
+	for k, v := range m.Header {
+		// The submitter of a sync job has given up on its reply by now.
+		if k == headerReplyTo || strings.HasPrefix(k, "Nats-") {
+			continue
+		}
+		headers[k] = v
+	}
+
+	entry := DeadLetter{
+		JobID:         rec.ID,
+		Tenant:        tenantID,
+		Function:      fn.Name,
+		FunctionKey:   fn.Key,
+		WasmFile:      fn.WasmFile,
+		Subject:       m.Subject,
+		Headers:       headers,
+		Input:         json.RawMessage(m.Data),
+		Error:         rec.Error,
+		FuelExhausted: fuelExhausted,
+		Attempts:      rec.History,
+		Timestamp:     time.Now().UTC(),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(dlqSubject(tenantID))
+	msg.Data = data
+	msg.Header.Set(headerJobID, rec.ID)
+	if _, err := r.js.PublishMsg(msg); err != nil {
+		return err
+	}
+
+	if r.metrics != nil {
+		r.metrics.deadLettered.WithLabelValues(fn.Name).Inc()
+	}
+	r.logger.Warn("Job moved to dead-letter queue", zap.String("tenant", tenantID), zap.String("job_id", rec.ID), zap.String("function", fn.Name))
+	return nil
+}
+
+// buryJob settles a job that will not be retried: it is recorded as dead and
+// moved to the DLQ, or written to a crash dump on this node when the DLQ is
+// unavailable, and then acked.
+func (r *Gojinn) buryJob(m *nats.Msg, tenantID, jobID string, fn *functionSpec, stdout, stderr, errMsg string, fuelExhausted bool) {
+	rec := r.finishJob(m, tenantID, jobID, JobDead, stdout, stderr, errMsg)
+
+	if err := r.deadLetter(m, tenantID, fn, rec, fuelExhausted); err != nil {
+		r.logger.Error("Failed to dead-letter job, writing crash dump instead", zap.String("tenant", tenantID), zap.String("job_id", jobID), zap.Error(err))
+
+		snapshot := CrashSnapshot{
+			Timestamp:     time.Now(),
+			Error:         errMsg,
+			Input:         json.RawMessage(m.Data),
+			Env:           fn.Env,
+			WasmFile:      fn.WasmFile,
+			FuelExhausted: fuelExhausted,
+		}
+		dumpBytes, _ := json.MarshalIndent(snapshot, "", "  ")
+		filename := fmt.Sprintf("crash_tenant_%s_%s_job%s.json", tenantID, time.Now().Format("20060102-150405"), jobID)
+		r.saveCrashDump(filename, dumpBytes)
+	}
+	_ = m.Ack()
+}
+
+func (r *Gojinn) getDeadLetter(tenantID string, seq uint64) (*DeadLetter, error) {
+	raw, err := r.js.GetMsg(dlqStreamName(tenantID), seq)
+	if err != nil {
+		return nil, err
+	}
+	var entry DeadLetter
+	if err := json.Unmarshal(raw.Data, &entry); err != nil {
+		return nil, err
+	}
+	entry.Seq = raw.Sequence
+	return &entry, nil
+}
+
+// listDeadLetters returns up to limit entries of the DLQ of tenantID, oldest
+// first, without their payloads.
+func (r *Gojinn) listDeadLetters(tenantID string, limit int) ([]*DeadLetter, error) {
+	entries := []*DeadLetter{}
+
+	info, err := r.js.StreamInfo(dlqStreamName(tenantID))
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq && len(entries) < limit && info.State.Msgs > 0; seq++ {
+		entry, err := r.getDeadLetter(tenantID, seq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry.Headers = nil
+		entry.Input = nil
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// requeueDeadLetter puts the job held in entry seq of the DLQ of tenantID back
+// on its original stream under its original job ID, or on the async stream to
+// run module instead when one is given, and removes it from the DLQ.
+func (r *Gojinn) requeueDeadLetter(tenantID string, seq uint64, module string) (*DeadLetter, error) {
+	entry, err := r.getDeadLetter(tenantID, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := nats.NewMsg(entry.Subject)
+	msg.Data = entry.Input
+	for k, v := range entry.Headers {
+		msg.Header[k] = v
+	}
+	msg.Header.Set(headerJobID, entry.JobID)
+
+	if module != "" && module != entry.WasmFile {
+		fn := r.lookupFunction(entry.FunctionKey)
+		if fn == nil {
+			fn = r.defaultFunction()
+		}
+		perms := r.tenantFunction(tenantID, fn).Perms
+		if strings.Contains(module, "..") || !isAllowed(module, perms.Enqueue) {
+			return nil, fmt.Errorf("%w: module %q is not covered by the enqueue permission", errRequeueRejected, module)
+		}
+		msg.Subject = asyncSubject(tenantID)
+		msg.Header.Set(headerAsyncModule, module)
+	}
+
+	if err := r.ensureJobWorkers(tenantID, msg.Header, entry.FunctionKey); err != nil {
+		return nil, fmt.Errorf("%w: %v", errRequeueRejected, err)
+	}
+
+	r.updateJob(tenantID, entry.JobID, func(j *JobRecord) {
+		j.State = JobQueued
+		j.Error = ""
+	})
+	if _, err := r.js.PublishMsg(msg, nats.MsgId(fmt.Sprintf("%s.dlq.%d", entry.JobID, seq))); err != nil {
+		return nil, fmt.Errorf("failed to requeue job: %w", err)
+	}
+	if err := r.js.DeleteMsg(dlqStreamName(tenantID), seq); err != nil {
+		r.logger.Warn("Requeued job left in dead-letter queue", zap.String("tenant", tenantID), zap.Uint64("seq", seq), zap.Error(err))
+	}
+
+	r.logger.Info("Dead-lettered job requeued", zap.String("tenant", tenantID), zap.String("job_id", entry.JobID), zap.String("module", module))
+	return entry, nil
+}
+
+// serveDeadLetters implements the DLQ API of the calling tenant:
+//
+//	GET    /_sys/dlq[?limit=100]        list entries, oldest first
+//	DELETE /_sys/dlq                    purge every entry
+//	GET    /_sys/dlq/{seq}              inspect one entry
+//	DELETE /_sys/dlq/{seq}              drop one entry
+//	POST   /_sys/dlq/{seq}/requeue      run the job again, optionally with
+//	                                    {"module": "<wasm file>"}
+func (r *Gojinn) serveDeadLetters(rw http.ResponseWriter, req *http.Request) error {
+	tenantID, err := r.extractTenantAndHandleMiddleware(rw, req)
+	if err != nil {
+		return nil
+	}
+	if r.js == nil {
+		http.Error(rw, "JetStream not ready", http.StatusServiceUnavailable)
+		return nil
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(req.URL.Path, "/_sys/dlq"), "/")
+	if rest == "" {
+		switch req.Method {
+		case http.MethodGet:
+			limit := defaultDLQListLimit
+			if raw := req.URL.Query().Get("limit"); raw != "" {
+				limit, err = strconv.Atoi(raw)
+				if err != nil || limit <= 0 {
+					http.Error(rw, "Invalid 'limit' parameter", http.StatusBadRequest)
+					return nil
+				}
+				if limit > maxDLQListLimit {
+					limit = maxDLQListLimit
+				}
+			}
+			entries, err := r.listDeadLetters(tenantID, limit)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return nil
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(rw).Encode(map[string]interface{}{"tenant": tenantID, "entries": entries})
+
+		case http.MethodDelete:
+			if err := r.js.PurgeStream(dlqStreamName(tenantID)); err != nil && !errors.Is(err, nats.ErrStreamNotFound) {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return nil
+			}
+			r.logger.Info("Dead-letter queue purged", zap.String("tenant", tenantID))
+			rw.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+
+	seqPart, action, _ := strings.Cut(rest, "/")
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil || seq == 0 {
+		http.Error(rw, "Invalid dead-letter sequence", http.StatusBadRequest)
+		return nil
+	}
+
+	switch {
+	case action == "" && req.Method == http.MethodGet:
+		entry, err := r.getDeadLetter(tenantID, seq)
+		if err != nil {
+			http.Error(rw, "Dead letter not found", http.StatusNotFound)
+			return nil
+		}
+		if _, ok := entry.Headers[headerCallbackSecret]; ok {
+			entry.Headers[headerCallbackSecret] = []string{"[redacted]"}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(rw).Encode(entry)
+
+	case action == "" && req.Method == http.MethodDelete:
+		err := r.js.DeleteMsg(dlqStreamName(tenantID), seq)
+		if errors.Is(err, nats.ErrMsgNotFound) || errors.Is(err, nats.ErrStreamNotFound) {
+			http.Error(rw, "Dead letter not found", http.StatusNotFound)
+			return nil
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		rw.WriteHeader(http.StatusNoContent)
+		return nil
+
+	case action == "requeue" && req.Method == http.MethodPost:
+		var body struct {
+			Module string `json:"module"`
+		}
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				http.Error(rw, "Invalid JSON payload", http.StatusBadRequest)
+				return nil
+			}
+		}
+
+		entry, err := r.requeueDeadLetter(tenantID, seq, body.Module)
+		switch {
+		case errors.Is(err, nats.ErrMsgNotFound), errors.Is(err, nats.ErrStreamNotFound):
+			http.Error(rw, "Dead letter not found", http.StatusNotFound)
+			return nil
+		case errors.Is(err, errRequeueRejected):
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return nil
+		case err != nil:
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("X-Gojinn-Job-ID", entry.JobID)
+		rw.WriteHeader(http.StatusAccepted)
+		return json.NewEncoder(rw).Encode(map[string]interface{}{
+			"status": "queued",
+			"job_id": entry.JobID,
+			"tenant": tenantID,
+		})
+	}
+
+	http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	return nil
+}
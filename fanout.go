@@ -0,0 +1,145 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"go.uber.org/zap"
+)
+
+// maxMapInvocations bounds the fan-out of a single map call.
+const maxMapInvocations = 1000
+
+// MapResult is the outcome of one sub-invocation of a map call. A
+// sub-invocation that had not finished when the call returned reports the
+// state it was in and keeps running.
+type MapResult struct {
+	JobID  string `json:"job_id"`
+	State  string `json:"state"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// mapJobs runs wasmFile once per payload on the async stream of the calling
+// tenant, where every async worker of the cluster can pick them up, and waits
+// until k of them are terminal (all of them when k is 0) or ctx ends. Results
+// are in payload order. The caller's enqueue permission must cover the module.
+// A job calling it gives back its sandbox slot while it waits. An async job
+// keeps its worker, so it may only call it while the pool has another one.
+func (r *Gojinn) mapJobs(ctx context.Context, wasmFile string, payloads []string, k int) (results []MapResult, err error) {
+	if r.js == nil {
+		return nil, fmt.Errorf("JetStream not ready")
+	}
+	if strings.Contains(wasmFile, "..") {
+		return nil, fmt.Errorf("module path %q must not contain '..'", wasmFile)
+	}
+	if !isAllowed(wasmFile, r.permissionsFor(ctx).Enqueue) {
+		return nil, fmt.Errorf("enqueue of %q is not permitted", wasmFile)
+	}
+	if len(payloads) == 0 || len(payloads) > maxMapInvocations {
+		return nil, fmt.Errorf("map expects between 1 and %d payloads, got %d", maxMapInvocations, len(payloads))
+	}
+	if k <= 0 || k > len(payloads) {
+		k = len(payloads)
+	}
+
+	tenantID, parentJob := tenantOf(ctx), ""
+	inv := invocationFrom(ctx)
+	if inv != nil {
+		parentJob = inv.JobID
+	}
+
+	if _, err := r.EnsureTenantResources(tenantID); err != nil {
+		return nil, fmt.Errorf("failed to provision tenant: %w", err)
+	}
+	if inv != nil && inv.AsyncWorker != nil {
+		unblock, err := r.holdAsyncWorker(tenantID, inv.AsyncWorker)
+		if err != nil {
+			return nil, err
+		}
+		defer unblock()
+	}
+	kv, err := r.js.KeyValue(jobsBucket(tenantID))
+	if err != nil {
+		return nil, fmt.Errorf("job store unavailable: %w", err)
+	}
+
+	// The sub-invocations share a job ID prefix, so one watcher follows them
+	// all. It starts before the first publish so no completion is missed.
+	batch := nuid.Next()
+	watcher, err := kv.Watch(batch+".*", nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	results = make([]MapResult, len(payloads))
+	for i, payload := range payloads {
+		jobID := fmt.Sprintf("%s.%d", batch, i)
+		results[i] = MapResult{JobID: jobID, State: JobQueued}
+
+		headers := map[string][]string{"X-Source": {"map"}, "X-Map-Index": {strconv.Itoa(i)}}
+		if parentJob != "" {
+			headers["X-Parent-Job"] = []string{parentJob}
+		}
+		jobReq := JobRequest{
+			Method:  "MAP",
+			URI:     "internal://map/" + jobID,
+			Headers: headers,
+			Body:    payload,
+		}
+		if err := r.submitAsyncJob(ctx, tenantID, jobID, wasmFile, jobReq, nil, time.Time{}); err != nil {
+			return nil, fmt.Errorf("failed to submit map invocation %d: %w", i, err)
+		}
+	}
+	r.logger.Info("Map Submitted", zap.String("tenant", tenantID), zap.String("file", wasmFile), zap.String("batch", batch), zap.Int("invocations", len(payloads)), zap.Int("wait_for", k))
+
+	if inv != nil && inv.Yield != nil {
+		resume := inv.Yield()
+		defer func() {
+			// Past its timeout the job gets no slot back and fails.
+			if rerr := resume(); rerr != nil {
+				results, err = nil, fmt.Errorf("no sandbox slot to resume in: %w", rerr)
+			}
+		}()
+	}
+
+	done := 0
+	for done < k {
+		select {
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return results, nil
+			}
+			if entry == nil {
+				continue
+			}
+			i, err := strconv.Atoi(strings.TrimPrefix(entry.Key(), batch+"."))
+			if err != nil || i < 0 || i >= len(results) || results[i].terminal() {
+				continue
+			}
+			var rec JobRecord
+			if err := json.Unmarshal(entry.Value(), &rec); err != nil {
+				continue
+			}
+			results[i].State = rec.State
+			if rec.Terminal() {
+				results[i].Output, results[i].Error = jobOutcome(&rec)
+				done++
+			}
+		case <-ctx.Done():
+			return results, nil
+		}
+	}
+	return results, nil
+}
+
+func (m MapResult) terminal() bool {
+	return m.State == JobSucceeded || m.State == JobDead || m.State == JobCancelled
+}
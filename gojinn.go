@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -36,11 +37,22 @@ type Permissions struct {
 	KVWrite []string `json:"kv_write,omitempty"`
 	S3Read  []string `json:"s3_read,omitempty"`
 	S3Write []string `json:"s3_write,omitempty"`
+	Enqueue []string `json:"enqueue,omitempty"`
 }
+
+// ConsensusPolicy configures the keys of the tenant STATE buckets that start
+// with Namespace, which get a bucket of their own with Replicas replicas
+// (cluster_replicas when 0). Mode cp reads them from the stream leader;
+// StaleReads, which mode ap allows, lets any replica answer. History is how
+// many revisions of each key host_kv_history returns, and TTL how long a key
+// written without its own TTL lives.
 type ConsensusPolicy struct {
-	Namespace  string `json:"namespace"`
-	Mode       string `json:"mode"`
-	StaleReads bool   `json:"stale_reads"`
+	Namespace  string         `json:"namespace"`
+	Mode       string         `json:"mode"`
+	StaleReads bool           `json:"stale_reads"`
+	Replicas   int            `json:"replicas,omitempty"`
+	History    int            `json:"history,omitempty"`
+	TTL        caddy.Duration `json:"ttl,omitempty"`
 }
 
 type Gojinn struct {
@@ -51,6 +63,10 @@ type Gojinn struct {
 	MemoryLimit string            `json:"memory_limit,omitempty"`
 	PoolSize    int               `json:"pool_size,omitempty"`
 	DebugSecret string            `json:"debug_secret,omitempty"`
+	Mode        string            `json:"mode,omitempty"`
+
+	JobRetention caddy.Duration `json:"job_retention,omitempty"`
+	DedupeWindow caddy.Duration `json:"dedupe_window,omitempty"`
 
 	RecordCrashes bool   `json:"record_crashes,omitempty"`
 	CrashPath     string `json:"crash_path,omitempty"`
@@ -69,7 +85,11 @@ type Gojinn struct {
 	NatsUserSeed     string   `json:"nats_user_seed,omitempty"`
 	TrustedNatsUsers []string `json:"trusted_nats_users,omitempty"`
 
-	Perms Permissions `json:"permissions,omitempty"`
+	Perms Permissions  `json:"permissions,omitempty"`
+	Retry *RetryPolicy `json:"retry,omitempty"`
+
+	Routes     []Route `json:"routes,omitempty"`
+	routeTable atomic.Pointer[routeTable]
 
 	ExposeAsTool bool              `json:"expose_as_tool,omitempty"`
 	ToolMeta     FunctionDiscovery `json:"tool_meta,omitempty"`
@@ -83,7 +103,13 @@ type Gojinn struct {
 	DBSyncURL   string `json:"db_sync_url,omitempty"`
 	DBSyncToken string `json:"db_sync_token,omitempty"`
 
-	kv nats.KeyValue
+	stateBuckets sync.Map
+	KVHistory    int            `json:"kv_history,omitempty"`
+	KVTTL        caddy.Duration `json:"kv_ttl,omitempty"`
+	kvSweepStop  chan struct{}
+
+	KVTriggers []KVTrigger `json:"kv_triggers,omitempty"`
+	kvTriggers []*kvTrigger
 
 	db      *sql.DB
 	logger  *zap.Logger
@@ -98,6 +124,9 @@ type Gojinn struct {
 	CronJobs  []CronJob `json:"cron_jobs,omitempty"`
 	scheduler *cron.Cron
 
+	Workflows    []Workflow `json:"workflows,omitempty"`
+	workflowStop chan struct{}
+
 	MQTTBroker   string    `json:"mqtt_broker,omitempty"`
 	MQTTClientID string    `json:"mqtt_client_id,omitempty"`
 	MQTTUsername string    `json:"mqtt_username,omitempty"`
@@ -112,6 +141,7 @@ type Gojinn struct {
 	aiCache    sync.Map
 
 	APIKeys      []string `json:"api_keys,omitempty"`
+	AdminKey     string   `json:"admin_key,omitempty"`
 	AllowedHosts []string `json:"allowed_hosts,omitempty"`
 	CorsOrigins  []string `json:"cors_origins,omitempty"`
 
@@ -120,9 +150,32 @@ type Gojinn struct {
 	limiters   map[string]*rate.Limiter
 	limitersMu sync.Mutex
 
-	tenantSubs map[string][]*nats.Subscription
+	tenantSubs map[string]map[string]*workerPool
 	subsMu     sync.Mutex
 
+	PoolMin      int `json:"pool_min,omitempty"`
+	PoolMax      int `json:"pool_max,omitempty"`
+	MaxSandboxes int `json:"max_sandboxes,omitempty"`
+	sandboxSlots chan struct{}
+	scalerStop   chan struct{}
+
+	TenantIdleTimeout caddy.Duration `json:"tenant_idle_timeout,omitempty"`
+	MaxHotTenants     int            `json:"max_hot_tenants,omitempty"`
+	MaxTenants        int            `json:"max_tenants,omitempty"`
+	tenantLastSeen    map[string]time.Time
+	reaperStop        chan struct{}
+	provisionMu       sync.Mutex
+	// provisioned caches the STATE bucket of every tenant whose streams and
+	// buckets this node has checked, until the reaper forgets it.
+	provisioned sync.Map
+
+	cronState nats.KeyValue
+
+	tenantRegistry  nats.KeyValue
+	tenantWatcher   nats.KeyWatcher
+	tenantConfigs   map[string]*TenantConfig
+	tenantConfigsMu sync.RWMutex
+
 	ClusterName  string   `json:"cluster_name,omitempty"`
 	ClusterPort  int      `json:"cluster_port,omitempty"`
 	ClusterPeers []string `json:"cluster_peers,omitempty"`
@@ -147,7 +200,9 @@ func (*Gojinn) CaddyModule() caddy.ModuleInfo {
 
 func (r *Gojinn) Provision(ctx caddy.Context) error {
 	r.logger = ctx.Logger()
-	r.tenantSubs = make(map[string][]*nats.Subscription)
+	r.tenantSubs = make(map[string]map[string]*workerPool)
+	r.tenantLastSeen = make(map[string]time.Time)
+	r.tenantConfigs = make(map[string]*TenantConfig)
 
 	shutdown, err := setupTelemetry("gojinn-" + r.ClusterName)
 	if err != nil {
@@ -179,69 +234,20 @@ func (r *Gojinn) Provision(ctx caddy.Context) error {
 	if r.ClusterReplicas <= 0 {
 		r.ClusterReplicas = 1
 	}
+	if err := r.checkConsensus(); err != nil {
+		return err
+	}
 
 	if err := r.startEmbeddedNATS(); err != nil {
 		return err
 	}
 
-	if len(r.CronJobs) > 0 {
-		r.scheduler = cron.New(cron.WithSeconds())
-		for _, job := range r.CronJobs {
-			j := job
-			if _, err := r.loadWasmSecurely(j.WasmFile); err != nil {
-				return fmt.Errorf("cron job security check failed for %s: %w", j.WasmFile, err)
-			}
-			_, err := r.scheduler.AddFunc(j.Schedule, func() {
-				r.logger.Warn("Cron jobs execution disabled pending Multi-Tenant rewrite", zap.String("wasm", j.WasmFile))
-			})
-			if err != nil {
-				return fmt.Errorf("failed to schedule cron job: %v", err)
-			}
-			r.logger.Info("Cron job scheduled", zap.String("schedule", j.Schedule), zap.String("wasm", j.WasmFile))
-		}
-		r.scheduler.Start()
+	if err := r.setupCallbacks(); err != nil {
+		return err
 	}
 
-	if r.MQTTBroker != "" {
-		for _, sub := range r.MQTTSubs {
-			if _, err := r.loadWasmSecurely(sub.WasmFile); err != nil {
-				return fmt.Errorf("mqtt handler security check failed for %s: %w", sub.WasmFile, err)
-			}
-		}
-
-		opts := mqtt.NewClientOptions()
-		opts.AddBroker(r.MQTTBroker)
-		if r.MQTTClientID != "" {
-			opts.SetClientID(r.MQTTClientID)
-		}
-		if r.MQTTUsername != "" {
-			opts.SetUsername(r.MQTTUsername)
-		}
-		if r.MQTTPassword != "" {
-			opts.SetPassword(r.MQTTPassword)
-		}
-
-		opts.OnConnect = func(c mqtt.Client) {
-			r.logger.Info("MQTT Connected", zap.String("broker", r.MQTTBroker))
-			for _, sub := range r.MQTTSubs {
-				s := sub
-				token := c.Subscribe(s.Topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-					r.logger.Warn("MQTT execution disabled pending Multi-Tenant rewrite", zap.String("topic", s.Topic))
-				})
-				if token.Wait() && token.Error() != nil {
-					r.logger.Error("MQTT Subscribe Error", zap.Error(token.Error()))
-				} else {
-					r.logger.Info("MQTT Subscribed", zap.String("topic", s.Topic))
-				}
-			}
-		}
-		opts.OnConnectionLost = func(c mqtt.Client, err error) {
-			r.logger.Warn("MQTT Connection Lost", zap.Error(err))
-		}
-		r.mqttClient = mqtt.NewClient(opts)
-		if token := r.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-			r.logger.Error("MQTT Initial Connect Failed", zap.Error(token.Error()))
-		}
+	if err := r.setupTenantRegistry(); err != nil {
+		return err
 	}
 
 	if r.PoolSize <= 0 {
@@ -250,45 +256,114 @@ func (r *Gojinn) Provision(ctx caddy.Context) error {
 	if r.Timeout == 0 {
 		r.Timeout = caddy.Duration(60 * time.Second)
 	}
+	if r.JobRetention <= 0 {
+		r.JobRetention = caddy.Duration(DefaultJobRetention)
+	}
+	if r.DedupeWindow <= 0 {
+		r.DedupeWindow = caddy.Duration(DefaultDedupeWindow)
+	}
+	if r.TenantIdleTimeout <= 0 {
+		r.TenantIdleTimeout = caddy.Duration(DefaultTenantIdleTimeout)
+	}
+
+	if err := r.buildRouter(); err != nil {
+		return err
+	}
+
+	if err := r.setupScheduler(); err != nil {
+		return err
+	}
+
+	if err := r.setupCron(); err != nil {
+		return err
+	}
+
+	if err := r.setupWorkflows(); err != nil {
+		return err
+	}
+
+	r.setupAutoscaler()
+	r.setupReaper()
+	r.setupKVSweeper()
+
+	if err := r.setupKVTriggers(); err != nil {
+		return err
+	}
+
+	if err := r.setupMQTT(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// EnsureTenantWorkers provisions the worker pools of every function served by
+// this block for the given tenant, applying its configuration overrides.
 func (r *Gojinn) EnsureTenantWorkers(tenantID string) error {
+	table := r.routeTable.Load()
+	if table == nil {
+		return fmt.Errorf("function routes not provisioned")
+	}
+	for _, fn := range table.functions {
+		if err := r.ensureFunctionWorkers(tenantID, r.tenantFunction(tenantID, fn)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Gojinn) ensureFunctionWorkers(tenantID string, fn *functionSpec) error {
 	r.subsMu.Lock()
 	defer r.subsMu.Unlock()
 
-	if _, exists := r.tenantSubs[tenantID]; exists {
+	r.admitTenant(tenantID)
+	if _, exists := r.tenantSubs[tenantID][fn.Key]; exists {
 		return nil
 	}
 
-	r.logger.Info("Provisioning Dynamic WASM Workers for Tenant...", zap.String("tenant", tenantID), zap.Int("workers", r.PoolSize))
+	_, initial, _ := fn.poolBounds()
+	r.logger.Info("Provisioning Dynamic WASM Workers for Tenant...", zap.String("tenant", tenantID), zap.String("function", fn.Name), zap.Int("workers", initial))
 
-	wasmBytes, err := r.loadWasmSecurely(r.Path)
+	wasmBytes, err := r.loadWasmSecurely(fn.WasmFile)
 	if err != nil {
 		return fmt.Errorf("failed to load wasm for tenant: %w", err)
 	}
 
-	topic := fmt.Sprintf("gojinn.tenant.%s.exec.>", tenantID)
 	streamName := fmt.Sprintf("WORKER_%s", strings.ToUpper(tenantID))
 
-	var subs []*nats.Subscription
+	// Workers used to share a single catch-all consumer per tenant. Work-queue
+	// streams reject overlapping consumers, so retire it before binding the
+	// per-function ones; its pending messages stay in the stream.
+	_ = r.js.DeleteConsumer(streamName, fmt.Sprintf("WORKERS_%s", tenantID))
 
-	for i := 0; i < r.PoolSize; i++ {
-		sub, err := r.startTenantWorker(tenantID, streamName, i, topic, wasmBytes)
-		if err != nil {
-			r.logger.Error("Failed to start tenant worker subscriber", zap.String("tenant", tenantID), zap.Error(err))
-			continue
-		}
-		subs = append(subs, sub)
-	}
+	r.reconcileConsumer(streamName, fn.QueueGroup(tenantID), fn.Retry.maxDeliver())
 
-	r.tenantSubs[tenantID] = subs
-	r.logger.Info("Tenant Workers Provisioned Successfully!", zap.String("tenant", tenantID), zap.Int("count", len(subs)))
+	pool := newWorkerPool(tenantID, fn.Key, fn.Name, streamName, fn.QueueGroup(tenantID), fn)
+	pool.start = func(id int) (*nats.Subscription, error) {
+		return r.startTenantWorker(tenantID, streamName, id, fn, wasmBytes, pool)
+	}
+	pool.grow(initial, r.logger)
+	r.addWorkerPool(pool)
+	r.logger.Info("Tenant Workers Provisioned Successfully!", zap.String("tenant", tenantID), zap.String("function", fn.Name), zap.Int("count", pool.size()))
 	return nil
 }
 
 func (r *Gojinn) Cleanup() error {
+	if r.tenantWatcher != nil {
+		_ = r.tenantWatcher.Stop()
+	}
+	if r.workflowStop != nil {
+		close(r.workflowStop)
+	}
+	if r.scalerStop != nil {
+		close(r.scalerStop)
+	}
+	if r.reaperStop != nil {
+		close(r.reaperStop)
+	}
+	if r.kvSweepStop != nil {
+		close(r.kvSweepStop)
+	}
 	if r.natsConn != nil {
 		if err := r.natsConn.Drain(); err != nil {
 			r.logger.Warn("NATS Drain error", zap.Error(err))
@@ -312,19 +387,28 @@ func (r *Gojinn) Cleanup() error {
 	return nil
 }
 
+// getLimiter returns the rate limiter of a tenant, or nil when it is not
+// rate limited.
 func (r *Gojinn) getLimiter(key string) *rate.Limiter {
+	limit, burst := r.RateLimit, r.RateBurst
+	if cfg := r.tenantConfig(key); cfg != nil && cfg.RateLimit > 0 {
+		limit, burst = cfg.RateLimit, cfg.RateBurst
+	}
+	if limit <= 0 {
+		return nil
+	}
+
 	r.limitersMu.Lock()
 	defer r.limitersMu.Unlock()
 	limiter, exists := r.limiters[key]
 	if !exists {
-		burst := r.RateBurst
 		if burst == 0 {
-			burst = int(r.RateLimit)
+			burst = int(limit)
 		}
 		if burst == 0 {
 			burst = 1
 		}
-		limiter = rate.NewLimiter(rate.Limit(r.RateLimit), burst)
+		limiter = rate.NewLimiter(rate.Limit(limit), burst)
 		r.limiters[key] = limiter
 	}
 	return limiter
@@ -5,11 +5,16 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func compileTestWasm(t *testing.T, sourceCode, outName string) string {
@@ -42,6 +47,7 @@ func TestProvision_FullLifecycle(t *testing.T) {
 		Timeout:     caddy.Duration(5 * time.Second),
 		PoolSize:    2,
 		NatsPort:    4223,
+		DataDir:     t.TempDir(),
 	}
 
 	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
@@ -55,8 +61,12 @@ func TestProvision_FullLifecycle(t *testing.T) {
 	assert.NotNil(t, r.natsConn, "NATS Connection should be active")
 	assert.Equal(t, "CONNECTED", r.natsConn.Status().String())
 
+	_, err = r.EnsureTenantResources("lifecycle")
+	assert.NoError(t, err)
+	assert.NoError(t, r.EnsureTenantWorkers("lifecycle"))
+
 	r.subsMu.Lock()
-	numSubs := len(r.subs)
+	numSubs := workerCount(r, "lifecycle")
 	r.subsMu.Unlock()
 	assert.Equal(t, 2, numSubs, "Should have exactly 2 NATS subscriptions (workers)")
 
@@ -72,14 +82,19 @@ func TestProvision_DefaultPoolSize(t *testing.T) {
 		Path:     wasmPath,
 		PoolSize: 0,
 		NatsPort: 4224,
+		DataDir:  t.TempDir(),
 	}
 
 	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
 	err := r.Provision(ctx)
 	assert.NoError(t, err)
 
+	_, err = r.EnsureTenantResources("autoscaling")
+	assert.NoError(t, err)
+	assert.NoError(t, r.EnsureTenantWorkers("autoscaling"))
+
 	r.subsMu.Lock()
-	numSubs := len(r.subs)
+	numSubs := workerCount(r, "autoscaling")
 	r.subsMu.Unlock()
 	assert.Equal(t, 2, numSubs, "Default pool size should be 2")
 
@@ -88,14 +103,21 @@ func TestProvision_DefaultPoolSize(t *testing.T) {
 
 func TestProvision_FileNotFound(t *testing.T) {
 	r := &Gojinn{
-		Path: "./arquivo_fantasma.wasm",
+		Path:     "./arquivo_fantasma.wasm",
+		NatsPort: 4226,
+		DataDir:  t.TempDir(),
 	}
 
 	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
 
 	err := r.Provision(ctx)
+	assert.NoError(t, err)
+
+	err = r.EnsureTenantWorkers("ghost")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to read wasm file")
+
+	_ = r.Cleanup()
 }
 
 func TestProvision_GracefulInvalidConfig(t *testing.T) {
@@ -107,6 +129,7 @@ func TestProvision_GracefulInvalidConfig(t *testing.T) {
 		MemoryLimit: "BATATA",
 		PoolSize:    1,
 		NatsPort:    4225,
+		DataDir:     t.TempDir(),
 	}
 
 	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
@@ -114,10 +137,225 @@ func TestProvision_GracefulInvalidConfig(t *testing.T) {
 	err := r.Provision(ctx)
 	assert.NoError(t, err)
 
+	_, err = r.EnsureTenantResources("graceful")
+	assert.NoError(t, err)
+	assert.NoError(t, r.EnsureTenantWorkers("graceful"))
+
 	r.subsMu.Lock()
-	numSubs := len(r.subs)
+	numSubs := workerCount(r, "graceful")
 	r.subsMu.Unlock()
 	assert.Equal(t, 1, numSubs)
 
 	_ = r.Cleanup()
 }
+
+func TestAutoscale_GrowsWithBacklogAndShrinksWhenIdle(t *testing.T) {
+	code := `package main; func main() {}`
+	wasmPath := compileTestWasm(t, code, "scaling.wasm")
+
+	r := &Gojinn{
+		Path:         wasmPath,
+		PoolSize:     1,
+		PoolMin:      1,
+		PoolMax:      4,
+		MaxSandboxes: 3,
+		NatsPort:     4246,
+		DataDir:      t.TempDir(),
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	_, err := r.EnsureTenantResources("scaling")
+	require.NoError(t, err)
+	require.NoError(t, r.EnsureTenantWorkers("scaling"))
+
+	r.subsMu.Lock()
+	pool := r.tenantSubs["scaling"][r.defaultFunction().Key]
+	r.subsMu.Unlock()
+	require.NotNil(t, pool)
+	assert.Equal(t, 1, pool.size())
+
+	r.resizePool(pool, 10, 1)
+	assert.Equal(t, 2, pool.size())
+
+	// The third worker reaches max_sandboxes, below pool_max.
+	r.resizePool(pool, 10, 2)
+	assert.Equal(t, 3, pool.size())
+	r.resizePool(pool, 10, 3)
+	assert.Equal(t, 3, pool.size())
+	assert.Equal(t, 2.0, testutil.ToFloat64(r.metrics.poolScaling.WithLabelValues("scaling", pool.name, "up")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(r.metrics.poolWorkers.WithLabelValues("scaling", pool.name)))
+
+	// A busy pool keeps its workers; an idle one gives them back one by one.
+	r.resizePool(pool, 0, 0)
+	assert.Equal(t, 3, pool.size())
+	for i := 0; i < 5; i++ {
+		pool.lastBusy = time.Now().Add(-2 * scaleDownDelay)
+		r.resizePool(pool, 0, 0)
+	}
+	assert.Equal(t, 1, pool.size())
+	assert.Equal(t, 2.0, testutil.ToFloat64(r.metrics.poolScaling.WithLabelValues("scaling", pool.name, "down")))
+
+	// Workers blocked in host_map are never drained, and the pool keeps one
+	// more to run the jobs they wait on.
+	r.resizePool(pool, 10, 1)
+	r.resizePool(pool, 10, 2)
+	require.Equal(t, 3, pool.size())
+	first, newest := pool.subs[0], pool.subs[2]
+	pool.blocked = map[*nats.Subscription]bool{pool.subs[1]: true, newest: true}
+	pool.lastBusy = time.Now().Add(-2 * scaleDownDelay)
+	r.resizePool(pool, 0, 0)
+	assert.Equal(t, 3, pool.size())
+
+	delete(pool.blocked, pool.subs[1])
+	r.resizePool(pool, 0, 0)
+	assert.Equal(t, []*nats.Subscription{first, newest}, pool.subs)
+	r.resizePool(pool, 0, 0)
+	assert.Equal(t, 2, pool.size())
+}
+
+func TestAcquireSandbox_GivesUpWhenContextEnds(t *testing.T) {
+	r := &Gojinn{sandboxSlots: make(chan struct{}, 1)}
+	release, err := r.acquireSandbox(context.Background(), nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = r.acquireSandbox(ctx, nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	release()
+	release, err = r.acquireSandbox(context.Background(), nil)
+	require.NoError(t, err)
+	release()
+}
+
+func TestTenants_EvictedWhenIdleOrColdAndCapped(t *testing.T) {
+	code := `package main; func main() {}`
+	wasmPath := compileTestWasm(t, code, "reaper.wasm")
+
+	r := &Gojinn{
+		Path:          wasmPath,
+		PoolSize:      1,
+		MaxHotTenants: 2,
+		MaxTenants:    3,
+		NatsPort:      4247,
+		DataDir:       t.TempDir(),
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	for _, tenantID := range []string{"alpha", "beta", "gamma"} {
+		_, err := r.EnsureTenantResources(tenantID)
+		require.NoError(t, err)
+		require.NoError(t, r.EnsureTenantWorkers(tenantID))
+	}
+
+	// gamma took the place of alpha, the least recently active tenant.
+	r.subsMu.Lock()
+	assert.Len(t, r.tenantSubs, 2)
+	assert.Equal(t, 0, workerCount(r, "alpha"))
+	assert.Equal(t, 1, workerCount(r, "gamma"))
+	r.subsMu.Unlock()
+
+	r.reapIdleTenants(time.Now())
+	r.subsMu.Lock()
+	assert.Len(t, r.tenantSubs, 2)
+	r.subsMu.Unlock()
+
+	r.reapIdleTenants(time.Now().Add(2 * DefaultTenantIdleTimeout))
+	r.subsMu.Lock()
+	assert.Empty(t, r.tenantSubs)
+	assert.Empty(t, r.tenantLastSeen)
+	r.subsMu.Unlock()
+
+	// Evicted tenants come back on demand, but no fourth tenant is created.
+	require.NoError(t, r.EnsureTenantWorkers("alpha"))
+	_, err := r.EnsureTenantResources("delta")
+	assert.ErrorIs(t, err, ErrTenantLimit)
+
+	// A registry entry only sets limits; an API key declares the tenant.
+	r.tenantConfigsMu.Lock()
+	r.tenantConfigs["delta"] = &TenantConfig{}
+	r.tenantConfigsMu.Unlock()
+	_, err = r.EnsureTenantResources("delta")
+	assert.ErrorIs(t, err, ErrTenantLimit)
+
+	r.APIKeys = []string{"delta"}
+	_, err = r.EnsureTenantResources("delta")
+	assert.NoError(t, err)
+
+	// A provisioned tenant is served from memory until it is reaped.
+	require.NoError(t, r.js.DeleteStream(asyncStreamName("delta")))
+	_, err = r.EnsureTenantResources("delta")
+	require.NoError(t, err)
+	_, err = r.js.StreamInfo(asyncStreamName("delta"))
+	assert.ErrorIs(t, err, nats.ErrStreamNotFound)
+
+	r.reapIdleTenants(time.Now())
+	_, err = r.EnsureTenantResources("delta")
+	require.NoError(t, err)
+	_, err = r.js.StreamInfo(asyncStreamName("delta"))
+	assert.NoError(t, err)
+}
+
+func workerCount(r *Gojinn, tenantID string) int {
+	n := 0
+	for _, pool := range r.tenantSubs[tenantID] {
+		n += pool.size()
+	}
+	return n
+}
+
+func TestCreateWazeroRuntime_SharedCompilationCache(t *testing.T) {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		t.Skip("compilation cache requires the wazero compiler")
+	}
+
+	first, err := os.ReadFile(compileTestWasm(t, `package main; func main() {}`, "first.wasm"))
+	require.NoError(t, err)
+	second, err := os.ReadFile(compileTestWasm(t, `package main; func main() { println("v2") }`, "second.wasm"))
+	require.NoError(t, err)
+
+	r := &Gojinn{DataDir: t.TempDir(), logger: zap.NewNop()}
+	cacheDir := filepath.Join(r.DataDir, "wazero_cache")
+
+	cached := func() int {
+		entries, _ := filepath.Glob(filepath.Join(cacheDir, "*", "*"))
+		return len(entries)
+	}
+
+	for i := 0; i < 3; i++ {
+		pair, err := r.createWazeroRuntime(first, "", 0)
+		require.NoError(t, err)
+		require.NoError(t, pair.Runtime.Close(context.Background()))
+	}
+	assert.Equal(t, 1, cached(), "recompiling identical bytes should reuse the cache entry")
+
+	pair, err := r.createWazeroRuntime(second, "", 0)
+	require.NoError(t, err)
+	require.NoError(t, pair.Runtime.Close(context.Background()))
+	assert.Equal(t, 2, cached(), "changed module bytes should produce a new cache entry")
+}
+
+func TestRunSyncJob_FuelLimit(t *testing.T) {
+	hello := compileTestWasm(t, `package main; import "fmt"; func main() { fmt.Print("done") }`, "hello.wasm")
+	spin := compileTestWasm(t, `package main; func main() { for i := 0; ; i++ { if i < 0 { println(i) } } }`, "spin.wasm")
+
+	r := &Gojinn{DataDir: t.TempDir(), logger: zap.NewNop(), FuelLimit: 100_000_000}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out, err := r.runSyncJob(ctx, hello, "")
+	require.NoError(t, err)
+	assert.Equal(t, "done", out)
+
+	r.FuelLimit = 50_000_000
+	_, err = r.runSyncJob(ctx, spin, "")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrFuelExhausted)
+	assert.NoError(t, ctx.Err(), "the loop must be stopped by fuel, not by the deadline")
+}
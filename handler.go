@@ -2,12 +2,15 @@ package gojinn
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,8 +26,33 @@ type CrashSnapshot struct {
 	Input     json.RawMessage   `json:"input"`
 	Env       map[string]string `json:"env"`
 	WasmFile  string            `json:"wasm_file"`
+
+	FuelExhausted bool `json:"fuel_exhausted,omitempty"`
+}
+
+// JobRequest is the JSON document a function reads from stdin.
+type JobRequest struct {
+	Method  string              `json:"method"`
+	URI     string              `json:"uri"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+	Params  map[string]string   `json:"params,omitempty"`
+	MQTT    *MQTTMessage        `json:"mqtt,omitempty"`
+	KV      *KVChange           `json:"kv,omitempty"`
+}
+
+type FunctionResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
 }
 
+const (
+	headerReplyTo   = "Gojinn-Reply-To"
+	headerJobStatus = "Gojinn-Job-Status"
+	headerJobError  = "Gojinn-Job-Error"
+)
+
 var bufferPool = sync.Pool{
 	New: func() interface{} { return new(bytes.Buffer) },
 }
@@ -42,6 +70,26 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 	}
 
 	if strings.HasPrefix(req.URL.Path, "/_sys/") {
+		if (req.Method == "GET" || req.Method == "DELETE") && strings.HasPrefix(req.URL.Path, "/_sys/jobs/") {
+			return r.serveJobStatus(rw, req)
+		}
+
+		if req.URL.Path == "/_sys/dlq" || strings.HasPrefix(req.URL.Path, "/_sys/dlq/") {
+			return r.serveDeadLetters(rw, req)
+		}
+
+		if req.URL.Path == "/_sys/workflows" || strings.HasPrefix(req.URL.Path, "/_sys/workflows/") {
+			return r.serveWorkflows(rw, req)
+		}
+
+		if req.Method == "GET" && req.URL.Path == "/_sys/cron" {
+			return r.serveCronStatus(rw, req)
+		}
+
+		if req.URL.Path == "/_sys/tenants" || strings.HasPrefix(req.URL.Path, "/_sys/tenants/") {
+			return r.serveTenantAdmin(rw, req)
+		}
+
 		if req.URL.Path == "/_sys/status" {
 			status := map[string]interface{}{
 				"node_id":      "local-node",
@@ -53,6 +101,14 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 				"topic":        "gojinn.tenant.*.exec.>",
 			}
 
+			if table := r.routeTable.Load(); table != nil {
+				functions := make([]string, 0, len(table.functions))
+				for _, fn := range table.functions {
+					functions = append(functions, fn.Name)
+				}
+				status["functions"] = functions
+			}
+
 			if r.natsConn != nil {
 				status["nats_status"] = r.natsConn.Status().String()
 			}
@@ -161,24 +217,51 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 		return err
 	}
 
+	fn, params, status := r.matchFunction(req)
+	if fn == nil {
+		return caddyhttp.Error(status, fmt.Errorf("no function route matches %s %s", req.Method, req.URL.Path))
+	}
+	fn = r.tenantFunction(tenantID, fn)
+
 	if r.metrics != nil {
-		r.metrics.active.WithLabelValues(r.Path).Inc()
-		defer r.metrics.active.WithLabelValues(r.Path).Dec()
+		r.metrics.active.WithLabelValues(fn.Name).Inc()
+		defer r.metrics.active.WithLabelValues(fn.Name).Dec()
+	}
+
+	callbackURL := req.Header.Get("X-Gojinn-Callback-URL")
+	if callbackURL != "" {
+		if err := r.validateCallbackURL(callbackURL); err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+	}
+
+	idemKey := idempotencyKey(req)
+	if idemKey != "" {
+		if err := validateIdempotencyKey(idemKey); err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+	}
+
+	var runAt time.Time
+	if raw := req.Header.Get("X-Gojinn-Run-At"); raw != "" {
+		if fn.Mode == ModeSync {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("X-Gojinn-Run-At is only supported by async functions"))
+		}
+		runAt, err = parseRunAt(raw, time.Now())
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
 	}
 
 	bodyBytes, _ := io.ReadAll(req.Body)
 	req.Body.Close()
 
-	reqPayload := struct {
-		Method  string              `json:"method"`
-		URI     string              `json:"uri"`
-		Headers map[string][]string `json:"headers"`
-		Body    string              `json:"body"`
-	}{
+	reqPayload := JobRequest{
 		Method:  req.Method,
 		URI:     req.RequestURI,
-		Headers: req.Header,
+		Headers: stripCallbackSecret(req.Header),
 		Body:    string(bodyBytes),
+		Params:  params,
 	}
 	inputJSON, _ := json.Marshal(reqPayload)
 
@@ -186,30 +269,73 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 		return caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("JetStream not ready"))
 	}
 	_, err = r.EnsureTenantResources(tenantID)
+	if errors.Is(err, ErrTenantLimit) {
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
 	if err != nil {
 		r.logger.Error("Failed to provision tenant resources", zap.Error(err))
 		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("infrastructure failure: %v", err))
 	}
 
-	_ = r.EnsureTenantWorkers(tenantID)
+	if err := r.ensureFunctionWorkers(tenantID, fn); err != nil {
+		r.logger.Error("Failed to start function workers", zap.String("function", fn.Name), zap.Error(err))
+	}
+
+	msg := nats.NewMsg(fn.Subject(tenantID))
+	msg.Data = inputJSON
+	if callbackURL != "" {
+		msg.Header.Set(headerCallbackURL, callbackURL)
+		if secret := req.Header.Get("X-Gojinn-Callback-Secret"); secret != "" {
+			msg.Header.Set(headerCallbackSecret, secret)
+		}
+	}
+
+	if !runAt.IsZero() {
+		return r.serveScheduledJob(rw, req, tenantID, msg, fn, runAt, idemKey)
+	}
 
-	topic := r.getFunctionTopic(tenantID)
+	var replySub *nats.Subscription
+	if fn.Mode == ModeSync {
+		inbox := r.natsConn.NewRespInbox()
+		replySub, err = r.natsConn.SubscribeSync(inbox)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("failed to open reply inbox: %v", err))
+		}
+		defer func() { _ = replySub.Unsubscribe() }()
+		msg.Header.Set(headerReplyTo, inbox)
+	}
 
-	pubAck, err := r.js.Publish(topic, inputJSON, nats.MsgId(fmt.Sprintf("%d", time.Now().UnixNano())))
+	// A client retry carrying the same Idempotency-Key is deduplicated by
+	// the tenant stream, which acks it with the sequence of the original.
+	msgID := fmt.Sprintf("%d", time.Now().UnixNano())
+	if idemKey != "" {
+		msgID = idempotencyMsgID(fn, idemKey)
+	}
+	pubAck, err := r.js.PublishMsg(msg, nats.MsgId(msgID))
 
 	if err != nil {
 		r.logger.Error("Failed to Persist Job (JetStream)", zap.Error(err))
 		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("persistence failed: %v", err))
 	}
 
+	jobID := strconv.FormatUint(pubAck.Sequence, 10)
+	if pubAck.Duplicate {
+		return r.serveDuplicateJob(rw, req, tenantID, jobID, fn)
+	}
+	r.recordJobQueued(tenantID, jobID)
+
+	if replySub != nil {
+		return r.awaitSyncResult(rw, req, replySub, tenantID, jobID, fn.Timeout)
+	}
+
 	rw.Header().Set("Content-Type", "application/json")
-	rw.Header().Set("X-Gojinn-Job-ID", fmt.Sprintf("%d", pubAck.Sequence))
+	rw.Header().Set("X-Gojinn-Job-ID", jobID)
 	rw.Header().Set("X-Gojinn-Tenant", tenantID)
 	rw.WriteHeader(http.StatusAccepted)
 
 	resp := map[string]interface{}{
 		"status": "queued",
-		"job_id": pubAck.Sequence,
+		"job_id": jobID,
 		"stream": pubAck.Stream,
 		"tenant": tenantID,
 		"msg":    "Job persisted to isolated tenant queue.",
@@ -218,6 +344,87 @@ func (r *Gojinn) ServeHTTP(rw http.ResponseWriter, req *http.Request, next caddy
 	return json.NewEncoder(rw).Encode(resp)
 }
 
+// awaitSyncResult blocks until the worker publishes the job outcome on the
+// reply inbox (or timeout elapses) and translates it into the HTTP response.
+// Stream messages published before the outcome are relayed to the client as
+// they arrive.
+func (r *Gojinn) awaitSyncResult(rw http.ResponseWriter, req *http.Request, sub *nats.Subscription, tenantID, jobID string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	rw.Header().Set("X-Gojinn-Job-ID", jobID)
+	rw.Header().Set("X-Gojinn-Tenant", tenantID)
+
+	streaming := false
+	var reply *nats.Msg
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			r.logger.Warn("Sync job did not complete in time", zap.String("tenant", tenantID), zap.String("job_id", jobID), zap.Error(err))
+			if streaming {
+				return nil
+			}
+			return caddyhttp.Error(http.StatusGatewayTimeout, fmt.Errorf("job %s did not complete within %s", jobID, timeout))
+		}
+
+		switch msg.Header.Get(headerStream) {
+		case streamOpen:
+			writeStreamHead(rw, msg.Data)
+			streaming = true
+			continue
+		case streamChunk:
+			if !streaming {
+				writeStreamHead(rw, nil)
+				streaming = true
+			}
+			if _, err := rw.Write(msg.Data); err != nil {
+				return err
+			}
+			if f, ok := rw.(http.Flusher); ok {
+				f.Flush()
+			}
+			continue
+		}
+		reply = msg
+		break
+	}
+
+	if streaming {
+		if reply.Header.Get(headerJobStatus) != JobSucceeded {
+			r.logger.Warn("Streamed job failed after response started", zap.String("tenant", tenantID), zap.String("job_id", jobID), zap.String("error", reply.Header.Get(headerJobError)))
+		}
+		return nil
+	}
+
+	if reply.Header.Get(headerJobStatus) != JobSucceeded {
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("function failed: %s", reply.Header.Get(headerJobError)))
+	}
+
+	return writeFunctionResponse(rw, reply.Data)
+}
+
+// writeFunctionResponse decodes the function's stdout according to the
+// Response contract (status, headers, body) and writes it to the client.
+func writeFunctionResponse(rw http.ResponseWriter, stdout []byte) error {
+	var resp FunctionResponse
+	if err := json.Unmarshal(bytes.TrimSpace(stdout), &resp); err != nil {
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("invalid function response: %v", err))
+	}
+
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	for k, values := range resp.Headers {
+		for _, v := range values {
+			rw.Header().Add(k, v)
+		}
+	}
+	rw.WriteHeader(resp.Status)
+
+	_, err := io.WriteString(rw, resp.Body)
+	return err
+}
+
 func (r *Gojinn) extractTenantAndHandleMiddleware(rw http.ResponseWriter, req *http.Request) (string, error) {
 	origin := req.Header.Get("Origin")
 	if len(r.CorsOrigins) > 0 && origin != "" {
@@ -274,8 +481,7 @@ func (r *Gojinn) extractTenantAndHandleMiddleware(rw http.ResponseWriter, req *h
 		tenantID = strings.ReplaceAll(tenantID, "[", "")
 		tenantID = strings.ReplaceAll(tenantID, "]", "")
 	}
-	if r.RateLimit > 0 {
-		limiter := r.getLimiter(tenantID)
+	if limiter := r.getLimiter(tenantID); limiter != nil {
 		if !limiter.Allow() {
 			rw.WriteHeader(http.StatusTooManyRequests)
 			return "", fmt.Errorf("rate limit exceeded")
@@ -0,0 +1,2197 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const echoFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+func main() {
+	var req struct {
+		Method string ` + "`json:\"method\"`" + `
+		Body   string ` + "`json:\"body\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"status":  201,
+		"headers": map[string][]string{"X-Echo-Method": {req.Method}},
+		"body":    "echo:" + req.Body,
+	})
+}
+`
+
+func TestServeHTTP_SyncMode(t *testing.T) {
+	wasmPath := compileTestWasm(t, echoFunction, "echo.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4230,
+		DataDir:  t.TempDir(),
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("ping"))
+	req.RemoteAddr = "192.0.2.10:5555"
+	rec := httptest.NewRecorder()
+
+	err := r.ServeHTTP(rec, req, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "POST", rec.Header().Get("X-Echo-Method"))
+	assert.Equal(t, "192_0_2_10", rec.Header().Get("X-Gojinn-Tenant"))
+	assert.NotEmpty(t, rec.Header().Get("X-Gojinn-Job-ID"))
+	assert.Equal(t, "echo:ping", rec.Body.String())
+}
+
+func TestWriteFunctionResponse_InvalidContract(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	err := writeFunctionResponse(rec, []byte("debug output that is not json"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid function response")
+}
+
+func TestServeHTTP_JobStatusLongPoll(t *testing.T) {
+	wasmPath := compileTestWasm(t, echoFunction, "echo.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4231,
+		DataDir:  t.TempDir(),
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("later"))
+	req.RemoteAddr = "192.0.2.11:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	jobID := rec.Header().Get("X-Gojinn-Job-ID")
+	require.NotEmpty(t, jobID)
+
+	statusReq := httptest.NewRequest(http.MethodGet, "/_sys/jobs/"+jobID+"?wait=20s", nil)
+	statusReq.RemoteAddr = "192.0.2.11:5556"
+	statusRec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(statusRec, statusReq, nil))
+	require.Equal(t, http.StatusOK, statusRec.Code)
+
+	var job JobRecord
+	require.NoError(t, json.Unmarshal(statusRec.Body.Bytes(), &job))
+	assert.Equal(t, JobSucceeded, job.State)
+	assert.Equal(t, 1, job.Attempts)
+	assert.Contains(t, job.Stdout, "echo:later")
+
+	otherReq := httptest.NewRequest(http.MethodGet, "/_sys/jobs/"+jobID, nil)
+	otherReq.RemoteAddr = "198.51.100.7:5556"
+	otherRec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(otherRec, otherReq, nil))
+	assert.Equal(t, http.StatusNotFound, otherRec.Code, "jobs must not leak across tenants")
+}
+
+func TestServeHTTP_CompletionCallback(t *testing.T) {
+	wasmPath := compileTestWasm(t, echoFunction, "echo.wasm")
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- req
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hook.Close()
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4232,
+		DataDir:  t.TempDir(),
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("hook"))
+	req.RemoteAddr = "192.0.2.12:5555"
+	req.Header.Set("X-Gojinn-Callback-URL", hook.URL)
+	req.Header.Set("X-Gojinn-Callback-Secret", "s3cr3t")
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	select {
+	case hookReq := <-received:
+		body := <-bodies
+		assert.Equal(t, "sha256="+signPayload("s3cr3t", body), hookReq.Header.Get("X-Gojinn-Signature"))
+
+		var job JobRecord
+		require.NoError(t, json.Unmarshal(body, &job))
+		assert.Equal(t, rec.Header().Get("X-Gojinn-Job-ID"), job.ID)
+		assert.Equal(t, JobSucceeded, job.State)
+	case <-time.After(20 * time.Second):
+		t.Fatal("callback was not delivered")
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	r := &Gojinn{AllowedHosts: []string{"hooks.example.com"}}
+
+	assert.NoError(t, r.validateCallbackURL("https://hooks.example.com/done"))
+	assert.NoError(t, r.validateCallbackURL("https://eu.hooks.example.com/done"))
+	assert.Error(t, r.validateCallbackURL("https://evil.com/?hooks.example.com"))
+	assert.Error(t, r.validateCallbackURL("ftp://hooks.example.com/done"))
+}
+
+const streamingFunction = `package main
+
+import "unsafe"
+
+//go:wasmimport gojinn host_stream_open
+func hostStreamOpen(status, hPtr, hLen uint32) uint32
+
+//go:wasmimport gojinn host_stream_write
+func hostStreamWrite(dPtr, dLen uint32) uint32
+
+//go:wasmimport gojinn host_stream_flush
+func hostStreamFlush() uint32
+
+func ptr(s string) (uint32, uint32) {
+	return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s))
+}
+
+func main() {
+	hPtr, hLen := ptr(` + "`" + `{"Content-Type":["text/event-stream"]}` + "`" + `)
+	hostStreamOpen(200, hPtr, hLen)
+	for _, event := range []string{"data: one\n\n", "data: two\n\n"} {
+		dPtr, dLen := ptr(event)
+		hostStreamWrite(dPtr, dLen)
+		hostStreamFlush()
+	}
+}
+`
+
+func TestServeHTTP_StreamingResponse(t *testing.T) {
+	wasmPath := compileTestWasm(t, streamingFunction, "stream.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4233,
+		DataDir:  t.TempDir(),
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.RemoteAddr = "192.0.2.13:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, "data: one\n\ndata: two\n\n", rec.Body.String())
+}
+
+const streamingTrapFunction = `package main
+
+import "unsafe"
+
+//go:wasmimport gojinn host_stream_write
+func hostStreamWrite(dPtr, dLen uint32) uint32
+
+//go:wasmimport gojinn host_stream_flush
+func hostStreamFlush() uint32
+
+func main() {
+	event := "data: one\n\n"
+	hostStreamWrite(uint32(uintptr(unsafe.Pointer(unsafe.StringData(event)))), uint32(len(event)))
+	hostStreamFlush()
+	panic("lost the upstream")
+}
+`
+
+func TestServeHTTP_StreamingFailureIsNotRetried(t *testing.T) {
+	wasmPath := compileTestWasm(t, streamingTrapFunction, "streamtrap.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4255,
+		DataDir:  t.TempDir(),
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.RemoteAddr = "192.0.2.16:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+
+	// Traps are retried by default, but not once the response has started.
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "data: one\n\n", rec.Body.String())
+
+	job, err := r.GetJob(context.Background(), "192_0_2_16", rec.Header().Get("X-Gojinn-Job-ID"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, JobDead, job.State)
+	assert.Equal(t, 1, job.Attempts)
+}
+
+const paramsFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+func main() {
+	var req struct {
+		Params map[string]string ` + "`json:\"params\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"headers": map[string][]string{"X-Route": {os.Getenv("ROUTE")}},
+		"body":    req.Params["id"],
+	})
+}
+`
+
+func TestServeHTTP_RouteTable(t *testing.T) {
+	wasmPath := compileTestWasm(t, paramsFunction, "params.wasm")
+
+	r := &Gojinn{
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4234,
+		DataDir:  t.TempDir(),
+		Routes: []Route{
+			{Method: "GET", Pattern: "/users/{id}", WasmFile: wasmPath, Env: map[string]string{"ROUTE": "users"}},
+			{Method: "POST", Pattern: "/orders/{id}", WasmFile: wasmPath, Env: map[string]string{"ROUTE": "orders"}},
+		},
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	serve := func(method, path string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.0.2.14:5555"
+		rec := httptest.NewRecorder()
+		return rec, r.ServeHTTP(rec, req, nil)
+	}
+
+	rec, err := serve(http.MethodGet, "/users/42")
+	require.NoError(t, err)
+	assert.Equal(t, "users", rec.Header().Get("X-Route"))
+	assert.Equal(t, "42", rec.Body.String())
+
+	rec, err = serve(http.MethodPost, "/orders/7")
+	require.NoError(t, err)
+	assert.Equal(t, "orders", rec.Header().Get("X-Route"))
+	assert.Equal(t, "7", rec.Body.String())
+
+	_, err = serve(http.MethodDelete, "/users/42")
+	var herr caddyhttp.HandlerError
+	require.ErrorAs(t, err, &herr)
+	assert.Equal(t, http.StatusMethodNotAllowed, herr.StatusCode)
+
+	_, err = serve(http.MethodGet, "/missing")
+	require.ErrorAs(t, err, &herr)
+	assert.Equal(t, http.StatusNotFound, herr.StatusCode)
+
+	assert.Equal(t, 2, workerCount(r, "192_0_2_14"))
+}
+
+func TestServeHTTP_TenantOverrides(t *testing.T) {
+	wasmPath := compileTestWasm(t, paramsFunction, "tenant.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4235,
+		DataDir:  t.TempDir(),
+		Env:      map[string]string{"ROUTE": "default"},
+		AdminKey: "operator-secret",
+	}
+
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	anonymous := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec
+	}
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(headerAdminKey, "operator-secret")
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec
+	}
+	call := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.15:5555"
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec
+	}
+
+	assert.Equal(t, "default", call().Header().Get("X-Route"))
+	assert.Equal(t, 1, workerCount(r, "192_0_2_15"))
+
+	// The registry API is closed to callers without the admin key.
+	assert.Equal(t, http.StatusUnauthorized, anonymous(http.MethodGet, "/_sys/tenants", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, anonymous(http.MethodPut, "/_sys/tenants/192_0_2_15", `{"pool_max": 64}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, anonymous(http.MethodDelete, "/_sys/tenants/192_0_2_15", "").Code)
+
+	assert.Equal(t, http.StatusBadRequest, admin(http.MethodPut, "/_sys/tenants/192_0_2_15", `{"pool_size": -1}`).Code)
+	assert.Equal(t, http.StatusBadRequest, admin(http.MethodPut, "/_sys/tenants/192_0_2_15", `{"replicas": 3}`).Code)
+
+	rec := admin(http.MethodPut, "/_sys/tenants/192_0_2_15", `{"pool_size": 3, "env": {"ROUTE": "gold"}, "rate_limit": 100}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Eventually(t, func() bool { return r.tenantConfig("192_0_2_15") != nil }, 5*time.Second, 20*time.Millisecond)
+
+	assert.Equal(t, "gold", call().Header().Get("X-Route"))
+	r.subsMu.Lock()
+	assert.Equal(t, 3, workerCount(r, "192_0_2_15"))
+	r.subsMu.Unlock()
+	assert.NotNil(t, r.getLimiter("192_0_2_15"))
+
+	rec = admin(http.MethodGet, "/_sys/tenants/192_0_2_15", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"pool_size":3`)
+
+	assert.Equal(t, http.StatusNoContent, admin(http.MethodDelete, "/_sys/tenants/192_0_2_15", "").Code)
+	require.Eventually(t, func() bool { return r.tenantConfig("192_0_2_15") == nil }, 5*time.Second, 20*time.Millisecond)
+
+	assert.Equal(t, "default", call().Header().Get("X-Route"))
+	assert.Nil(t, r.getLimiter("192_0_2_15"))
+	assert.Equal(t, http.StatusNotFound, admin(http.MethodGet, "/_sys/tenants/192_0_2_15", "").Code)
+
+	// Tenants named by their API key are listed by fingerprint.
+	r.APIKeys = []string{"sk_live_secret"}
+	require.Equal(t, http.StatusOK, admin(http.MethodPut, "/_sys/tenants/sk_live_secret", `{"pool_size": 2}`).Code)
+	require.Eventually(t, func() bool { return r.tenantConfig("sk_live_secret") != nil }, 5*time.Second, 20*time.Millisecond)
+	rec = admin(http.MethodGet, "/_sys/tenants", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "sk_live_secret")
+	assert.Contains(t, rec.Body.String(), r.tenantLabel("sk_live_secret"))
+}
+
+func TestCron_FiresOncePerClusterTick(t *testing.T) {
+	wasmPath := compileTestWasm(t, echoFunction, "cron.wasm")
+	dataDir := t.TempDir()
+
+	nodes := make([]*Gojinn, 2)
+	for i := range nodes {
+		nodes[i] = &Gojinn{
+			Path:     wasmPath,
+			Timeout:  caddy.Duration(30 * time.Second),
+			PoolSize: 1,
+			NatsPort: 4236,
+			DataDir:  dataDir,
+			CronJobs: []CronJob{{Schedule: "* * * * * *", WasmFile: wasmPath, Tenant: "crontest", Jitter: caddy.Duration(200 * time.Millisecond)}},
+		}
+		ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+		require.NoError(t, nodes[i].Provision(ctx))
+	}
+	defer func() {
+		for _, n := range nodes {
+			_ = n.Cleanup()
+		}
+	}()
+
+	time.Sleep(3500 * time.Millisecond)
+	for _, n := range nodes {
+		<-n.scheduler.Stop().Done()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	kv, err := nodes[0].js.KeyValue(jobsBucket("crontest"))
+	require.NoError(t, err)
+
+	var records []*JobRecord
+	require.Eventually(t, func() bool {
+		keys, _ := kv.Keys()
+		records = records[:0]
+		for _, k := range keys {
+			rec, err := nodes[0].GetJob(context.Background(), "crontest", k, 0)
+			if err != nil || !rec.Terminal() {
+				return false
+			}
+			records = append(records, rec)
+		}
+		return len(keys) > 0
+	}, 15*time.Second, 100*time.Millisecond)
+
+	seen := map[string]bool{}
+	for _, rec := range records {
+		var out FunctionResponse
+		require.NoError(t, json.Unmarshal([]byte(rec.Stdout), &out))
+		var event struct {
+			ScheduledAt time.Time `json:"scheduled_at"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(out.Body, "echo:")), &event))
+		key := event.ScheduledAt.String()
+		assert.False(t, seen[key], "tick %s ran more than once", key)
+		seen[key] = true
+	}
+	assert.GreaterOrEqual(t, len(seen), 2)
+
+	req := httptest.NewRequest(http.MethodGet, "/_sys/cron", nil)
+	rec := httptest.NewRecorder()
+	require.NoError(t, nodes[1].ServeHTTP(rec, req, nil))
+
+	var states []CronState
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&states))
+	require.Len(t, states, 1)
+	assert.Equal(t, "crontest", states[0].Tenant)
+	assert.NotNil(t, states[0].LastRun)
+	assert.NotEmpty(t, states[0].LastJobID)
+	assert.NotNil(t, states[0].NextRun)
+}
+
+const mqttFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+func main() {
+	var req struct {
+		Method string          ` + "`json:\"method\"`" + `
+		Body   string          ` + "`json:\"body\"`" + `
+		MQTT   json.RawMessage ` + "`json:\"mqtt\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"status":  200,
+		"headers": map[string][]string{"X-Mqtt-Body": {req.Body}},
+		"body":    string(req.MQTT),
+	})
+}
+`
+
+func TestMQTT_MessagesBecomeTenantJobs(t *testing.T) {
+	wasmPath := compileTestWasm(t, mqttFunction, "mqtt.wasm")
+
+	broker, err := server.NewServer(&server.Options{
+		ServerName: "mqtt-broker",
+		Port:       -1,
+		NoSigs:     true,
+		JetStream:  true,
+		StoreDir:   t.TempDir(),
+		MQTT:       server.MQTTOpts{Host: "127.0.0.1", Port: 4238},
+	})
+	require.NoError(t, err)
+	go broker.Start()
+	require.True(t, broker.ReadyForConnections(10*time.Second))
+	defer broker.Shutdown()
+
+	r := &Gojinn{
+		Path:       wasmPath,
+		Timeout:    caddy.Duration(30 * time.Second),
+		PoolSize:   1,
+		NatsPort:   4237,
+		DataDir:    t.TempDir(),
+		MQTTBroker: "tcp://127.0.0.1:4238",
+		MQTTSubs: []MQTTSub{
+			{Topic: "devices/+/telemetry", WasmFile: wasmPath, QoS: 1, TenantSegment: 2},
+		},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+	require.Eventually(t, r.mqttClient.IsConnected, 10*time.Second, 50*time.Millisecond)
+
+	opts := mqtt.NewClientOptions().AddBroker("tcp://127.0.0.1:4238").SetClientID("publisher")
+	pub := mqtt.NewClient(opts)
+	token := pub.Connect()
+	require.True(t, token.WaitTimeout(10*time.Second))
+	require.NoError(t, token.Error())
+	defer pub.Disconnect(100)
+
+	messages := map[string][]byte{
+		"acme":   []byte(`{"temp":21.5}`),
+		"globex": {0xff, 0x00, 0xfe},
+	}
+	for tenant, payload := range messages {
+		token := pub.Publish("devices/"+tenant+"/telemetry", 1, false, payload)
+		require.True(t, token.WaitTimeout(10*time.Second))
+		require.NoError(t, token.Error())
+	}
+
+	for tenant, payload := range messages {
+		var rec *JobRecord
+		require.Eventually(t, func() bool {
+			kv, err := r.js.KeyValue(jobsBucket(tenant))
+			if err != nil {
+				return false
+			}
+			keys, _ := kv.Keys()
+			if len(keys) != 1 {
+				return false
+			}
+			rec, err = r.GetJob(context.Background(), tenant, keys[0], 0)
+			return err == nil && rec.Terminal()
+		}, 15*time.Second, 100*time.Millisecond, tenant)
+		require.Equal(t, JobSucceeded, rec.State, rec.Stderr)
+
+		var out FunctionResponse
+		require.NoError(t, json.Unmarshal([]byte(rec.Stdout), &out))
+		var msg MQTTMessage
+		require.NoError(t, json.Unmarshal([]byte(out.Body), &msg))
+
+		assert.Equal(t, "devices/"+tenant+"/telemetry", msg.Topic)
+		assert.Equal(t, byte(1), msg.QoS)
+		assert.False(t, msg.Retained)
+		if tenant == "acme" {
+			assert.Equal(t, string(payload), msg.Payload)
+			assert.Empty(t, msg.PayloadEncoding)
+		} else {
+			assert.Equal(t, base64.StdEncoding.EncodeToString(payload), msg.Payload)
+			assert.Equal(t, "base64", msg.PayloadEncoding)
+		}
+		assert.Equal(t, []string{msg.Payload}, out.Headers["X-Mqtt-Body"])
+	}
+}
+
+func TestMQTT_RetriesFailedEnqueue(t *testing.T) {
+	wasmPath := compileTestWasm(t, mqttFunction, "mqtt.wasm")
+
+	broker, err := server.NewServer(&server.Options{
+		ServerName: "mqtt-broker",
+		Port:       -1,
+		NoSigs:     true,
+		JetStream:  true,
+		StoreDir:   t.TempDir(),
+		MQTT:       server.MQTTOpts{Host: "127.0.0.1", Port: 4259},
+	})
+	require.NoError(t, err)
+	go broker.Start()
+	require.True(t, broker.ReadyForConnections(10*time.Second))
+	defer broker.Shutdown()
+
+	// The only tenant slot is taken, so the first attempts are refused.
+	r := &Gojinn{
+		Path:       wasmPath,
+		Timeout:    caddy.Duration(30 * time.Second),
+		PoolSize:   1,
+		NatsPort:   4258,
+		DataDir:    t.TempDir(),
+		MaxTenants: 1,
+		MQTTBroker: "tcp://127.0.0.1:4259",
+		MQTTSubs: []MQTTSub{
+			{Topic: "devices/+/telemetry", WasmFile: wasmPath, QoS: 1, TenantSegment: 2},
+		},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+	require.Eventually(t, r.mqttClient.IsConnected, 10*time.Second, 50*time.Millisecond)
+	_, err = r.EnsureTenantResources("blocker")
+	require.NoError(t, err)
+
+	pub := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://127.0.0.1:4259").SetClientID("publisher"))
+	token := pub.Connect()
+	require.True(t, token.WaitTimeout(10*time.Second))
+	require.NoError(t, token.Error())
+	defer pub.Disconnect(100)
+
+	token = pub.Publish("devices/acme/telemetry", 1, false, `{"temp":21.5}`)
+	require.True(t, token.WaitTimeout(10*time.Second))
+	require.NoError(t, token.Error())
+
+	time.Sleep(600 * time.Millisecond)
+	_, err = r.js.KeyValue(jobsBucket("acme"))
+	require.ErrorIs(t, err, nats.ErrBucketNotFound, "the tenant must have been refused so far")
+	require.NoError(t, r.js.DeleteStream("WORKER_BLOCKER"))
+
+	require.Eventually(t, func() bool {
+		kv, err := r.js.KeyValue(jobsBucket("acme"))
+		if err != nil {
+			return false
+		}
+		keys, _ := kv.Keys()
+		if len(keys) != 1 {
+			return false
+		}
+		rec, err := r.GetJob(context.Background(), "acme", keys[0], 0)
+		return err == nil && rec.State == JobSucceeded
+	}, 15*time.Second, 100*time.Millisecond)
+}
+
+const enqueueFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_enqueue_job
+func hostEnqueueJob(fPtr, fLen, pPtr, pLen, outPtr, outMax uint32) uint32
+
+func enqueue(file, payload string) (string, bool) {
+	out := make([]byte, 64)
+	n := hostEnqueueJob(
+		uint32(uintptr(unsafe.Pointer(unsafe.StringData(file)))), uint32(len(file)),
+		uint32(uintptr(unsafe.Pointer(unsafe.StringData(payload)))), uint32(len(payload)),
+		uint32(uintptr(unsafe.Pointer(&out[0]))), uint32(len(out)))
+	if n == 0xFFFFFFFF {
+		return "", false
+	}
+	return string(out[:n]), true
+}
+
+func main() {
+	id, _ := enqueue(os.Getenv("CHILD"), "background work")
+	_, denied := enqueue("/etc/evil.wasm", "nope")
+
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"status":  202,
+		"headers": map[string][]string{"X-Denied-Accepted": {map[bool]string{true: "yes", false: "no"}[denied]}},
+		"body":    id,
+	})
+}
+`
+
+func TestHostEnqueueJob_RunsOnTenantAsyncStream(t *testing.T) {
+	parent := compileTestWasm(t, enqueueFunction, "parent.wasm")
+	child := compileTestWasm(t, echoFunction, "child.wasm")
+
+	r := &Gojinn{
+		Path:     parent,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4239,
+		DataDir:  t.TempDir(),
+		Env:      map[string]string{"CHILD": child},
+		Perms:    Permissions{Enqueue: []string{child}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "192.0.2.16:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "no", rec.Header().Get("X-Denied-Accepted"))
+
+	jobID := rec.Body.String()
+	require.NotEmpty(t, jobID)
+
+	var job *JobRecord
+	require.Eventually(t, func() bool {
+		var err error
+		job, err = r.GetJob(context.Background(), "192_0_2_16", jobID, 0)
+		return err == nil && job.Terminal()
+	}, 15*time.Second, 100*time.Millisecond)
+	require.Equal(t, JobSucceeded, job.State, job.Error)
+
+	var out FunctionResponse
+	require.NoError(t, json.Unmarshal([]byte(job.Stdout), &out))
+	assert.Equal(t, "echo:background work", out.Body)
+	assert.Equal(t, []string{"ASYNC"}, out.Headers["X-Echo-Method"])
+
+	info, err := r.js.StreamInfo(asyncStreamName("192_0_2_16"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), info.State.LastSeq)
+}
+
+func TestServeHTTP_ScheduledJobs(t *testing.T) {
+	wasmPath := compileTestWasm(t, echoFunction, "echo.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4240,
+		DataDir:  t.TempDir(),
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	schedule := func(body, runAt string) string {
+		req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.17:5555"
+		req.Header.Set("X-Gojinn-Run-At", runAt)
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		return rec.Header().Get("X-Gojinn-Job-ID")
+	}
+
+	dueID := schedule("soon", "2s")
+	cancelledID := schedule("never", time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	job, err := r.GetJob(context.Background(), "192_0_2_17", dueID, 0)
+	require.NoError(t, err)
+	assert.Equal(t, JobScheduled, job.State)
+	require.NotNil(t, job.RunAt)
+
+	cancelReq := httptest.NewRequest(http.MethodDelete, "/_sys/jobs/"+cancelledID, nil)
+	cancelReq.RemoteAddr = "192.0.2.17:5556"
+	cancelRec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(cancelRec, cancelReq, nil))
+	assert.Equal(t, http.StatusNoContent, cancelRec.Code)
+
+	job, err = r.GetJob(context.Background(), "192_0_2_17", dueID, 20*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, JobSucceeded, job.State, job.Error)
+	assert.Contains(t, job.Stdout, "echo:soon")
+	assert.False(t, job.UpdatedAt.Before(*job.RunAt), "job must not run before run_at")
+
+	job, err = r.GetJob(context.Background(), "192_0_2_17", cancelledID, 0)
+	require.NoError(t, err)
+	assert.Equal(t, JobCancelled, job.State)
+
+	againReq := httptest.NewRequest(http.MethodDelete, "/_sys/jobs/"+dueID, nil)
+	againReq.RemoteAddr = "192.0.2.17:5557"
+	againRec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(againRec, againReq, nil))
+	assert.Equal(t, http.StatusConflict, againRec.Code, "released jobs cannot be cancelled")
+}
+
+func TestParseRunAt(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	at, err := parseRunAt("90s", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(90*time.Second), at)
+
+	at, err = parseRunAt("2026-01-03T00:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), at)
+
+	_, err = parseRunAt("-5m", now)
+	assert.Error(t, err)
+	_, err = parseRunAt("tomorrow", now)
+	assert.Error(t, err)
+}
+
+func TestDeadLetterQueue_InspectRequeuePurge(t *testing.T) {
+	doomed := compileTestWasm(t, echoFunction, "doomed.wasm")
+	echo := compileTestWasm(t, echoFunction, "echo.wasm")
+
+	r := &Gojinn{
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4241,
+		DataDir:  t.TempDir(),
+		Perms:    Permissions{Enqueue: []string{echo}},
+		Routes: []Route{
+			// The Go runtime alone burns far more fuel than this.
+			{Method: "POST", Pattern: "/doomed", WasmFile: doomed, FuelLimit: 1000},
+			{Method: "POST", Pattern: "/echo", WasmFile: echo},
+		},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	const tenant = "192_0_2_18"
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.18:5555"
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec
+	}
+
+	submit := func(body string) string {
+		rec := serve(http.MethodPost, "/doomed", body)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		jobID := rec.Header().Get("X-Gojinn-Job-ID")
+		job, err := r.GetJob(context.Background(), tenant, jobID, 20*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, JobDead, job.State)
+		return jobID
+	}
+	firstID := submit("first")
+	submit("second")
+
+	var list struct {
+		Entries []DeadLetter `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(serve(http.MethodGet, "/_sys/dlq", "").Body.Bytes(), &list))
+	require.Len(t, list.Entries, 2)
+	assert.Equal(t, firstID, list.Entries[0].JobID)
+	assert.True(t, list.Entries[0].FuelExhausted)
+	assert.Nil(t, list.Entries[0].Input, "listing must not carry payloads")
+
+	seq := strconv.FormatUint(list.Entries[0].Seq, 10)
+	var entry DeadLetter
+	require.NoError(t, json.Unmarshal(serve(http.MethodGet, "/_sys/dlq/"+seq, "").Body.Bytes(), &entry))
+	assert.Contains(t, string(entry.Input), `"body":"first"`)
+	require.Len(t, entry.Attempts, 1)
+	assert.Contains(t, entry.Attempts[0].Error, "fuel")
+
+	rec := serve(http.MethodPost, "/_sys/dlq/"+seq+"/requeue", `{"module": "/etc/evil.wasm"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = serve(http.MethodPost, "/_sys/dlq/"+seq+"/requeue", `{"module": "`+echo+`"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	job, err := r.GetJob(context.Background(), tenant, firstID, 20*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, JobSucceeded, job.State, job.Error)
+	assert.Contains(t, job.Stdout, "echo:first")
+
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/_sys/dlq/"+seq, "").Code)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/_sys/dlq", "").Code)
+
+	require.NoError(t, json.Unmarshal(serve(http.MethodGet, "/_sys/dlq", "").Body.Bytes(), &list))
+	assert.Empty(t, list.Entries)
+}
+
+func TestDeadLetterQueue_RequeueTriggerJob(t *testing.T) {
+	failing := compileTestWasm(t, failingFunction, "failing.wasm")
+	const tenant = "192_0_2_57"
+
+	r := &Gojinn{
+		Path:       failing,
+		Mode:       ModeSync,
+		Timeout:    caddy.Duration(30 * time.Second),
+		PoolSize:   1,
+		NatsPort:   4257,
+		DataDir:    t.TempDir(),
+		Retry:      &RetryPolicy{Max: 1},
+		KVTriggers: []KVTrigger{{Keys: "orders.>", WasmFile: failing}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.0.2.57:5555"
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec
+	}
+	deadLetters := func() []DeadLetter {
+		var list struct {
+			Entries []DeadLetter `json:"entries"`
+		}
+		require.NoError(t, json.Unmarshal(serve(http.MethodGet, "/_sys/dlq").Body.Bytes(), &list))
+		return list.Entries
+	}
+
+	kv, err := r.EnsureTenantResources(tenant)
+	require.NoError(t, err)
+	require.NoError(t, r.watchKVChanges(tenant))
+	_, err = kv.PutString("orders.1", "a")
+	require.NoError(t, err)
+
+	var entries []DeadLetter
+	require.Eventually(t, func() bool { entries = deadLetters(); return len(entries) == 1 }, 15*time.Second, 100*time.Millisecond)
+	jobID := entries[0].JobID
+
+	// The trigger's function is not routed, yet its jobs go back to its
+	// workers and fail there again.
+	rec := serve(http.MethodPost, "/_sys/dlq/"+strconv.FormatUint(entries[0].Seq, 10)+"/requeue")
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	require.Eventually(t, func() bool {
+		entries = deadLetters()
+		return len(entries) == 1 && entries[0].JobID == jobID
+	}, 15*time.Second, 100*time.Millisecond)
+}
+
+const failingFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+func main() {
+	var req struct {
+		Body string ` + "`json:\"body\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+	if req.Body == "invalid" {
+		os.Exit(65)
+	}
+	os.Exit(1)
+}
+`
+
+func TestRetryPolicy_DrivesAttemptsAndClassification(t *testing.T) {
+	wasmPath := compileTestWasm(t, failingFunction, "failing.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4242,
+		DataDir:  t.TempDir(),
+		Retry:    &RetryPolicy{Max: 3, Backoff: BackoffConstant, Initial: caddy.Duration(100 * time.Millisecond)},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	run := func(body string) *JobRecord {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.19:5555"
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		require.Equal(t, http.StatusAccepted, rec.Code)
+
+		job, err := r.GetJob(context.Background(), "192_0_2_19", rec.Header().Get("X-Gojinn-Job-ID"), 20*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, JobDead, job.State)
+		return job
+	}
+
+	job := run("invalid")
+	assert.Equal(t, 1, job.Attempts, "non-retryable failures must not be retried")
+
+	job = run("crash")
+	assert.Equal(t, 3, job.Attempts)
+	assert.Len(t, job.History, 3)
+
+	info, err := r.js.ConsumerInfo("WORKER_192_0_2_19", r.defaultFunction().QueueGroup("192_0_2_19"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, info.Config.MaxDeliver)
+}
+
+func TestServeHTTP_IdempotencyKey(t *testing.T) {
+	wasmPath := compileTestWasm(t, echoFunction, "echo.wasm")
+
+	r := &Gojinn{
+		Timeout:      caddy.Duration(30 * time.Second),
+		PoolSize:     1,
+		NatsPort:     4243,
+		DataDir:      t.TempDir(),
+		DedupeWindow: caddy.Duration(10 * time.Minute),
+		Routes: []Route{
+			{Method: "POST", Pattern: "/async", WasmFile: wasmPath},
+			{Method: "POST", Pattern: "/sync", WasmFile: wasmPath, Mode: ModeSync},
+		},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	const tenant = "192_0_2_20"
+	submit := func(path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.20:5555"
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		return rec
+	}
+
+	first := submit("/async", "order-1", "once")
+	require.Equal(t, http.StatusAccepted, first.Code)
+	jobID := first.Header().Get("X-Gojinn-Job-ID")
+
+	job, err := r.GetJob(context.Background(), tenant, jobID, 20*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, JobSucceeded, job.State)
+
+	replay := submit("/async", "order-1", "once")
+	assert.Equal(t, http.StatusOK, replay.Code)
+	assert.Equal(t, jobID, replay.Header().Get("X-Gojinn-Job-ID"))
+	assert.Equal(t, "true", replay.Header().Get("X-Gojinn-Idempotent-Replay"))
+	assert.Contains(t, replay.Body.String(), "echo:once")
+
+	// The same key on another function is a different submission.
+	sync := submit("/sync", "order-1", "sync")
+	require.Equal(t, http.StatusCreated, sync.Code)
+	assert.NotEqual(t, jobID, sync.Header().Get("X-Gojinn-Job-ID"))
+
+	syncReplay := submit("/sync", "order-1", "sync")
+	assert.Equal(t, http.StatusCreated, syncReplay.Code)
+	assert.Equal(t, "echo:sync", syncReplay.Body.String())
+	assert.Equal(t, sync.Header().Get("X-Gojinn-Job-ID"), syncReplay.Header().Get("X-Gojinn-Job-ID"))
+
+	info, err := r.js.StreamInfo("WORKER_" + tenant)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), info.State.LastSeq, "duplicates must not reach the stream")
+	assert.Equal(t, 10*time.Minute, info.Config.Duplicates)
+
+	bad := httptest.NewRequest(http.MethodPost, "/async", nil)
+	bad.RemoteAddr = "192.0.2.20:5555"
+	bad.Header.Set("Idempotency-Key", "has space")
+	err = r.ServeHTTP(httptest.NewRecorder(), bad, nil)
+	var herr caddyhttp.HandlerError
+	require.ErrorAs(t, err, &herr)
+	assert.Equal(t, http.StatusBadRequest, herr.StatusCode)
+}
+
+const workflowStepFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+func main() {
+	var req struct {
+		Method  string              ` + "`json:\"method\"`" + `
+		Headers map[string][]string ` + "`json:\"headers\"`" + `
+		Body    string              ` + "`json:\"body\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+	step := req.Headers["X-Workflow-Step"][0]
+
+	out := step + "(" + req.Body + ")"
+	if req.Method == "COMPENSATE" {
+		out = "undo:" + step
+	} else if strings.Contains(req.Body, "fail:"+step) {
+		os.Exit(65)
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"status": 200, "body": out})
+}
+`
+
+func TestWorkflow_ChainsStepsAndCompensates(t *testing.T) {
+	wasmPath := compileTestWasm(t, workflowStepFunction, "step.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 2,
+		NatsPort: 4244,
+		DataDir:  t.TempDir(),
+		Workflows: []Workflow{{
+			Name: "order",
+			Stages: [][]WorkflowStep{
+				{{Name: "reserve", WasmFile: wasmPath, Compensate: wasmPath}},
+				{{Name: "charge", WasmFile: wasmPath, Compensate: wasmPath}, {Name: "notify", WasmFile: wasmPath}},
+				{{Name: "finish", WasmFile: wasmPath}},
+			},
+		}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	const tenant = "192_0_2_21"
+	start := func(input string) string {
+		req := httptest.NewRequest(http.MethodPost, "/_sys/workflows/order", strings.NewReader(input))
+		req.RemoteAddr = "192.0.2.21:5555"
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+		return rec.Header().Get("X-Gojinn-Workflow-ID")
+	}
+	wait := func(runID string) *WorkflowRun {
+		var run *WorkflowRun
+		require.Eventually(t, func() bool {
+			var err error
+			run, err = r.GetWorkflowRun(tenant, runID)
+			return err == nil && run.State != WorkflowRunning && run.State != WorkflowCompensating
+		}, 30*time.Second, 100*time.Millisecond)
+		return run
+	}
+
+	run := wait(start("go"))
+	assert.Equal(t, WorkflowSucceeded, run.State, run.Error)
+	assert.Equal(t, `finish({"charge":"charge(reserve(go))","notify":"notify(reserve(go))"})`, run.Output)
+
+	run = wait(start("fail:notify"))
+	assert.Equal(t, WorkflowCompensated, run.State)
+	assert.Contains(t, run.Error, "step notify failed")
+	assert.Equal(t, StepCompensated, run.step("reserve").State)
+	assert.Equal(t, StepCompensated, run.step("charge").State)
+	assert.Equal(t, StepFailed, run.step("notify").State)
+	assert.Equal(t, StepWaiting, run.step("finish").State)
+
+	// Compensations run latest first.
+	charge, err := r.GetJob(context.Background(), tenant, run.step("charge").CompensationJobID, 0)
+	require.NoError(t, err)
+	reserve, err := r.GetJob(context.Background(), tenant, run.step("reserve").CompensationJobID, 0)
+	require.NoError(t, err)
+	assert.Contains(t, reserve.Stdout, "undo:reserve")
+	assert.False(t, reserve.CreatedAt.Before(charge.UpdatedAt))
+
+	// A run whose first jobs were lost with the node that started it is
+	// picked up by the resume sweep.
+	kv, err := r.EnsureTenantResources(tenant)
+	require.NoError(t, err)
+	orphan := newWorkflowRun(r.lookupWorkflow("order"), "orphan", tenant, "again")
+	orphan.startStage(0, "again")
+	orphan.UpdatedAt = time.Now().Add(-time.Hour)
+	data, _ := json.Marshal(orphan)
+	_, err = kv.Create(workflowKey("orphan"), data)
+	require.NoError(t, err)
+
+	r.resumeWorkflows()
+	run = wait("orphan")
+	assert.Equal(t, WorkflowSucceeded, run.State, run.Error)
+
+	// Functions cannot rewrite run state, whatever their KV permissions.
+	assert.False(t, kvAllowed(workflowKey("orphan"), []string{"*"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/_sys/workflows/order/orphan", nil)
+	req.RemoteAddr = "192.0.2.21:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state":"succeeded"`)
+
+	other := httptest.NewRequest(http.MethodGet, "/_sys/workflows/order/orphan", nil)
+	other.RemoteAddr = "198.51.100.8:5555"
+	rec = httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, other, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+const mapFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_map
+func hostMap(fPtr, fLen, pPtr, pLen, k, outPtr, outMax uint32) uint32
+
+//go:wasmimport gojinn host_map_result
+func hostMapResult(outPtr, outMax uint32) uint32
+
+func mapJobs(file string, payloads []string, k int) []map[string]string {
+	data, _ := json.Marshal(payloads)
+	out := make([]byte, 16)
+	n := hostMap(
+		uint32(uintptr(unsafe.Pointer(unsafe.StringData(file)))), uint32(len(file)),
+		uint32(uintptr(unsafe.Pointer(&data[0]))), uint32(len(data)), uint32(k),
+		uint32(uintptr(unsafe.Pointer(&out[0]))), uint32(len(out)))
+	if n == 0xFFFFFFFF {
+		return nil
+	}
+	if int(n) > len(out) {
+		out = make([]byte, n)
+		hostMapResult(uint32(uintptr(unsafe.Pointer(&out[0]))), n)
+	}
+	var results []map[string]string
+	_ = json.Unmarshal(out[:n], &results)
+	return results
+}
+
+func main() {
+	all := mapJobs(os.Getenv("CHILD"), []string{"a", "b", "c", "d", "e"}, 0)
+	first := mapJobs(os.Getenv("CHILD"), []string{"x", "y", "z"}, 1)
+	denied := mapJobs("/etc/evil.wasm", []string{"nope"}, 0)
+
+	finished := 0
+	for _, r := range first {
+		if r["state"] == "succeeded" {
+			finished++
+		}
+	}
+	body, _ := json.Marshal(all)
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+		"status": 200,
+		"headers": map[string][]string{
+			"X-First-Finished": {strconv.Itoa(finished)},
+			"X-First-Count":    {strconv.Itoa(len(first))},
+			"X-Denied":         {strconv.FormatBool(denied == nil)},
+		},
+		"body": string(body),
+	})
+}
+`
+
+func TestHostMap_FansOutAndCollects(t *testing.T) {
+	parent := compileTestWasm(t, mapFunction, "mapper.wasm")
+	child := compileTestWasm(t, echoFunction, "child.wasm")
+
+	r := &Gojinn{
+		Path:     parent,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 3,
+		NatsPort: 4245,
+		DataDir:  t.TempDir(),
+		Env:      map[string]string{"CHILD": child},
+		Perms:    Permissions{Enqueue: []string{child}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "192.0.2.22:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var results []MapResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &results))
+	require.Len(t, results, 5)
+	for i, payload := range []string{"a", "b", "c", "d", "e"} {
+		assert.Equal(t, JobSucceeded, results[i].State)
+		assert.Equal(t, "echo:"+payload, results[i].Output)
+	}
+
+	assert.Equal(t, "3", rec.Header().Get("X-First-Count"))
+	finished, _ := strconv.Atoi(rec.Header().Get("X-First-Finished"))
+	assert.GreaterOrEqual(t, finished, 1)
+	assert.Equal(t, "true", rec.Header().Get("X-Denied"))
+
+	job, err := r.GetJob(context.Background(), "192_0_2_22", results[0].JobID, 0)
+	require.NoError(t, err)
+	assert.Equal(t, JobSucceeded, job.State)
+}
+
+func TestHostMap_SingleWorkerAndSandbox(t *testing.T) {
+	parent := compileTestWasm(t, mapFunction, "mapper.wasm")
+	child := compileTestWasm(t, echoFunction, "child.wasm")
+
+	// The mapper holds the only sandbox slot while it waits.
+	r := &Gojinn{
+		Path:         parent,
+		Mode:         ModeSync,
+		Timeout:      caddy.Duration(15 * time.Second),
+		PoolSize:     1,
+		MaxSandboxes: 1,
+		NatsPort:     4256,
+		DataDir:      t.TempDir(),
+		Env:          map[string]string{"CHILD": child},
+		Perms:        Permissions{Enqueue: []string{child}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "192.0.2.56:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var results []MapResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &results))
+	require.Len(t, results, 5)
+	for _, res := range results {
+		assert.Equal(t, JobSucceeded, res.State)
+	}
+
+	// Run as an async job, the mapper holds the only async worker: its map
+	// calls fail at once instead of waiting on jobs that cannot start.
+	require.NoError(t, r.submitAsyncJob(context.Background(), "192_0_2_56", "mapper", parent, JobRequest{Method: "ASYNC"}, nil, time.Time{}))
+	job, err := r.GetJob(context.Background(), "192_0_2_56", "mapper", 10*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, JobSucceeded, job.State, job.Error)
+	assert.Contains(t, job.Stdout, `"body":"null"`)
+}
+
+const kvFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_kv_set
+func hostKVSet(kPtr, kLen, vPtr, vLen uint32)
+
+//go:wasmimport gojinn host_kv_get
+func hostKVGet(kPtr, kLen, outPtr, outMax uint32) uint32
+
+//go:wasmimport gojinn host_mutex_lock
+func hostMutexLock(kPtr, kLen, ttl uint32) uint32
+
+func ptr(s string) (uint32, uint32) {
+	return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s))
+}
+
+func get(key string) string {
+	out := make([]byte, 256)
+	kp, kl := ptr(key)
+	n := hostKVGet(kp, kl, uint32(uintptr(unsafe.Pointer(&out[0]))), uint32(len(out)))
+	if n == 0xFFFFFFFF {
+		return "<missing>"
+	}
+	return string(out[:n])
+}
+
+func main() {
+	var req struct {
+		Body string ` + "`json:\"body\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+
+	result := ""
+	switch {
+	case strings.HasPrefix(req.Body, "set:"):
+		kp, kl := ptr("shared.k")
+		vp, vl := ptr(strings.TrimPrefix(req.Body, "set:"))
+		hostKVSet(kp, kl, vp, vl)
+		result = get("shared.k")
+	case req.Body == "get":
+		result = get("shared.k")
+	case req.Body == "lock":
+		kp, kl := ptr("shared.lock")
+		result = map[uint32]string{0: "busy", 1: "locked"}[hostMutexLock(kp, kl, 30)]
+	case req.Body == "forbidden":
+		kp, kl := ptr("private.k")
+		vp, vl := ptr("leak")
+		hostKVSet(kp, kl, vp, vl)
+		result = get("private.k")
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"status": 200, "body": result})
+}
+`
+
+func TestHostKV_IsolatedPerTenant(t *testing.T) {
+	wasmPath := compileTestWasm(t, kvFunction, "kv.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4248,
+		DataDir:  t.TempDir(),
+		Perms:    Permissions{KVRead: []string{"shared."}, KVWrite: []string{"shared."}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	call := func(ip, body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = ip + ":5555"
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return rec.Body.String()
+	}
+
+	assert.Equal(t, "alpha", call("192.0.2.30", "set:alpha"))
+	assert.Equal(t, "<missing>", call("192.0.2.31", "get"))
+	assert.Equal(t, "beta", call("192.0.2.31", "set:beta"))
+	assert.Equal(t, "alpha", call("192.0.2.30", "get"))
+
+	assert.Equal(t, "locked", call("192.0.2.30", "lock"))
+	assert.Equal(t, "busy", call("192.0.2.30", "lock"))
+	assert.Equal(t, "locked", call("192.0.2.31", "lock"))
+
+	assert.Equal(t, "<missing>", call("192.0.2.30", "forbidden"))
+
+	kv, err := r.js.KeyValue(stateBucket("192_0_2_30"))
+	require.NoError(t, err)
+	entry, err := kv.Get("shared.k")
+	require.NoError(t, err)
+	assert.Equal(t, "alpha", string(entry.Value()))
+	_, err = kv.Get("private.k")
+	assert.ErrorIs(t, err, nats.ErrKeyNotFound)
+}
+
+const kvAPIFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_kv_set
+func hostKVSet(kPtr, kLen, vPtr, vLen uint32)
+
+//go:wasmimport gojinn host_kv_get_rev
+func hostKVGetRev(kPtr, kLen, outPtr, outMax, revPtr uint32) uint32
+
+//go:wasmimport gojinn host_kv_cas
+func hostKVCas(kPtr, kLen, vPtr, vLen uint32, expected uint64) uint64
+
+//go:wasmimport gojinn host_kv_delete
+func hostKVDelete(kPtr, kLen uint32) uint32
+
+//go:wasmimport gojinn host_kv_keys
+func hostKVKeys(pPtr, pLen, cPtr, cLen, limit, outPtr, outMax uint32) uint32
+
+//go:wasmimport gojinn host_kv_history
+func hostKVHistory(kPtr, kLen, outPtr, outMax uint32) uint32
+
+func ptr(s string) (uint32, uint32) {
+	return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s))
+}
+
+func cas(key, val string, expected uint64) uint64 {
+	kp, kl := ptr(key)
+	vp, vl := ptr(val)
+	return hostKVCas(kp, kl, vp, vl, expected)
+}
+
+func getRev(key string) (string, uint64) {
+	out := make([]byte, 256)
+	var rev uint64
+	kp, kl := ptr(key)
+	n := hostKVGetRev(kp, kl, uint32(uintptr(unsafe.Pointer(&out[0]))), uint32(len(out)), uint32(uintptr(unsafe.Pointer(&rev))))
+	if n == 0xFFFFFFFF {
+		return "<missing>", 0
+	}
+	return string(out[:n]), rev
+}
+
+func call(n uint32, out []byte) json.RawMessage {
+	if n == 0xFFFFFFFF {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(out[:n])
+}
+
+func keys(prefix, cursor string, limit uint32) json.RawMessage {
+	out := make([]byte, 1024)
+	pp, pl := ptr(prefix)
+	cp, cl := ptr(cursor)
+	return call(hostKVKeys(pp, pl, cp, cl, limit, uint32(uintptr(unsafe.Pointer(&out[0]))), uint32(len(out))), out)
+}
+
+func history(key string) json.RawMessage {
+	out := make([]byte, 4096)
+	kp, kl := ptr(key)
+	return call(hostKVHistory(kp, kl, uint32(uintptr(unsafe.Pointer(&out[0]))), uint32(len(out))), out)
+}
+
+func main() {
+	res := map[string]interface{}{}
+
+	rev1 := cas("shared.counter", "1", 0)
+	res["create"] = rev1 != 0
+	res["create_again"] = cas("shared.counter", "x", 0)
+	val, rev := getRev("shared.counter")
+	res["read"] = val
+	res["read_rev_matches"] = rev == rev1
+	res["update"] = cas("shared.counter", "2", rev1) != 0
+	res["stale_update"] = cas("shared.counter", "3", rev1)
+	res["denied_cas"] = cas("private.x", "1", 0)
+
+	for _, k := range []string{"shared.a", "shared.b", "shared.c"} {
+		kp, kl := ptr(k)
+		vp, vl := ptr("v")
+		hostKVSet(kp, kl, vp, vl)
+	}
+	res["page1"] = keys("shared.", "", 2)
+	res["page2"] = keys("shared.", "shared.b", 2)
+
+	kp, kl := ptr("shared.a")
+	res["delete"] = hostKVDelete(kp, kl)
+	res["deleted_read"], _ = getRev("shared.a")
+
+	res["counter_history"] = history("shared.counter")
+	res["a_history"] = history("shared.a")
+
+	body, _ := json.Marshal(res)
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"status": 200, "body": string(body)})
+}
+`
+
+func TestHostKV_ExtendedAPI(t *testing.T) {
+	wasmPath := compileTestWasm(t, kvAPIFunction, "kvapi.wasm")
+
+	r := &Gojinn{
+		Path:      wasmPath,
+		Mode:      ModeSync,
+		Timeout:   caddy.Duration(30 * time.Second),
+		PoolSize:  1,
+		NatsPort:  4249,
+		DataDir:   t.TempDir(),
+		Perms:     Permissions{KVRead: []string{"shared."}, KVWrite: []string{"shared."}},
+		Consensus: []ConsensusPolicy{{Namespace: "shared.counter", History: 5}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "192.0.2.40:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var res struct {
+		Create         bool             `json:"create"`
+		CreateAgain    uint64           `json:"create_again"`
+		Read           string           `json:"read"`
+		ReadRevMatches bool             `json:"read_rev_matches"`
+		Update         bool             `json:"update"`
+		StaleUpdate    uint64           `json:"stale_update"`
+		DeniedCAS      uint64           `json:"denied_cas"`
+		Page1          *KVPage          `json:"page1"`
+		Page2          *KVPage          `json:"page2"`
+		Delete         int              `json:"delete"`
+		DeletedRead    string           `json:"deleted_read"`
+		CounterHistory []KVHistoryEntry `json:"counter_history"`
+		AHistory       []KVHistoryEntry `json:"a_history"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+	assert.True(t, res.Create)
+	assert.Zero(t, res.CreateAgain)
+	assert.Equal(t, "1", res.Read)
+	assert.True(t, res.ReadRevMatches)
+	assert.True(t, res.Update)
+	assert.Zero(t, res.StaleUpdate)
+	assert.Zero(t, res.DeniedCAS)
+
+	assert.Equal(t, &KVPage{Keys: []string{"shared.a", "shared.b"}, Next: "shared.b"}, res.Page1)
+	assert.Equal(t, &KVPage{Keys: []string{"shared.c", "shared.counter"}}, res.Page2)
+
+	assert.Equal(t, 1, res.Delete)
+	assert.Equal(t, "<missing>", res.DeletedRead)
+
+	require.Len(t, res.CounterHistory, 2)
+	assert.Equal(t, "1", res.CounterHistory[0].Value)
+	assert.Equal(t, "2", res.CounterHistory[1].Value)
+	require.Len(t, res.AHistory, 1, "namespaces without a history setting show only the latest revision")
+	assert.Equal(t, "delete", res.AHistory[0].Operation)
+}
+
+const kvTTLFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_kv_set
+func hostKVSet(kPtr, kLen, vPtr, vLen uint32)
+
+//go:wasmimport gojinn host_kv_set_ttl
+func hostKVSetTTL(kPtr, kLen, vPtr, vLen uint32, ttlMs int64) uint32
+
+//go:wasmimport gojinn host_kv_get
+func hostKVGet(kPtr, kLen, outPtr, outMax uint32) uint32
+
+//go:wasmimport gojinn host_kv_cas
+func hostKVCas(kPtr, kLen, vPtr, vLen uint32, expected uint64) uint64
+
+func ptr(s string) (uint32, uint32) {
+	return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s))
+}
+
+func main() {
+	var req struct {
+		Body string ` + "`json:\"body\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+
+	args := strings.Split(req.Body, ":")
+	kp, kl := ptr(args[1])
+	result := "ok"
+	switch args[0] {
+	case "set":
+		vp, vl := ptr(args[2])
+		hostKVSet(kp, kl, vp, vl)
+	case "ttl":
+		ms, _ := strconv.ParseInt(args[2], 10, 64)
+		vp, vl := ptr(args[3])
+		if hostKVSetTTL(kp, kl, vp, vl, ms) != 1 {
+			result = "rejected"
+		}
+	case "create":
+		vp, vl := ptr(args[2])
+		if hostKVCas(kp, kl, vp, vl, 0) == 0 {
+			result = "conflict"
+		}
+	case "get":
+		out := make([]byte, 256)
+		n := hostKVGet(kp, kl, uint32(uintptr(unsafe.Pointer(&out[0]))), uint32(len(out)))
+		result = "<missing>"
+		if n != 0xFFFFFFFF {
+			result = string(out[:n])
+		}
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"status": 200, "body": result})
+}
+`
+
+func TestHostKV_TTLAndExpirySweep(t *testing.T) {
+	wasmPath := compileTestWasm(t, kvTTLFunction, "kvttl.wasm")
+
+	r := &Gojinn{
+		Path:      wasmPath,
+		Mode:      ModeSync,
+		Timeout:   caddy.Duration(30 * time.Second),
+		PoolSize:  1,
+		NatsPort:  4250,
+		DataDir:   t.TempDir(),
+		Perms:     Permissions{KVRead: []string{"*"}, KVWrite: []string{"*"}},
+		Consensus: []ConsensusPolicy{{Namespace: "sess.", TTL: caddy.Duration(200 * time.Millisecond)}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	call := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.50:5555"
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return rec.Body.String()
+	}
+
+	call("set:sess.a:alice")
+	call("ttl:otp:200:1234")
+	call("ttl:keep:200:x")
+	call("set:keep:y")
+	assert.Equal(t, "alice", call("get:sess.a"))
+	assert.Equal(t, "1234", call("get:otp"))
+	assert.Equal(t, "rejected", call("ttl:_gojinn.ttl.keep:0:0"))
+
+	time.Sleep(300 * time.Millisecond)
+
+	// Expired keys are gone for readers before the sweep runs.
+	assert.Equal(t, "<missing>", call("get:sess.a"))
+	assert.Equal(t, "<missing>", call("get:otp"))
+	assert.Equal(t, "y", call("get:keep"))
+	assert.Equal(t, "ok", call("create:otp:5678"))
+
+	// Listing leaves them out too.
+	page, err := r.kvKeys(withInvocation(context.Background(), &invocation{TenantID: "192_0_2_50"}), "", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"keep", "otp"}, page.Keys)
+
+	// Only sess.a is still at its expiring revision.
+	assert.Equal(t, 1, r.sweepKV(time.Now()))
+	assert.Equal(t, 0, r.sweepKV(time.Now()))
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.kvExpired.WithLabelValues("sess.")))
+
+	sess, err := r.js.KeyValue(namespaceBucket("192_0_2_50", "sess."))
+	require.NoError(t, err)
+	_, err = sess.Get("sess.a")
+	assert.ErrorIs(t, err, nats.ErrKeyNotFound)
+	kv, err := r.js.KeyValue(stateBucket("192_0_2_50"))
+	require.NoError(t, err)
+	entry, err := kv.Get("otp")
+	require.NoError(t, err)
+	assert.Equal(t, "5678", string(entry.Value()))
+	_, err = kv.Get(kvExpiryPrefix + "keep")
+	assert.ErrorIs(t, err, nats.ErrKeyNotFound)
+
+	// Keys of tenants this node no longer serves expire as well.
+	call("ttl:code:100:42")
+	r.subsMu.Lock()
+	r.evictTenant("192_0_2_50", "test")
+	r.subsMu.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, r.sweepKV(time.Now()))
+	_, err = kv.Get("code")
+	assert.ErrorIs(t, err, nats.ErrKeyNotFound)
+
+	// One node compacts per round: the lease keeps the others out until it
+	// runs out before the next round.
+	now := time.Now()
+	assert.True(t, r.compactKV(now))
+	assert.False(t, r.compactKV(now.Add(time.Minute)))
+	assert.True(t, r.compactKV(now.Add(kvCompactInterval)))
+}
+
+const kvChangeHandler = `package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_kv_set
+func hostKVSet(kPtr, kLen, vPtr, vLen uint32)
+
+func ptr(s string) (uint32, uint32) {
+	return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s))
+}
+
+func main() {
+	var req struct {
+		Method string ` + "`json:\"method\"`" + `
+		KV     struct {
+			Key       string ` + "`json:\"key\"`" + `
+			Operation string ` + "`json:\"operation\"`" + `
+			Revision  uint64 ` + "`json:\"revision\"`" + `
+			Value     string ` + "`json:\"value\"`" + `
+		} ` + "`json:\"kv\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+
+	kp, kl := ptr(fmt.Sprintf("seen.%s.%d", req.KV.Key, req.KV.Revision))
+	vp, vl := ptr(req.Method + ":" + req.KV.Operation + ":" + req.KV.Value)
+	hostKVSet(kp, kl, vp, vl)
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"status": 200, "body": "ok"})
+}
+`
+
+func TestKVTriggers_RunOnChangesAndResumeAfterRestart(t *testing.T) {
+	writerPath := compileTestWasm(t, kvTTLFunction, "writer.wasm")
+	handlerPath := compileTestWasm(t, kvChangeHandler, "onchange.wasm")
+	dataDir := t.TempDir()
+	const tenantID = "192_0_2_51"
+
+	provision := func() *Gojinn {
+		r := &Gojinn{
+			Path:       writerPath,
+			Mode:       ModeSync,
+			Timeout:    caddy.Duration(30 * time.Second),
+			PoolSize:   1,
+			NatsPort:   4251,
+			DataDir:    dataDir,
+			Perms:      Permissions{KVRead: []string{"*"}, KVWrite: []string{"*"}},
+			KVTriggers: []KVTrigger{{Keys: "orders.>", WasmFile: handlerPath}},
+		}
+		ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+		require.NoError(t, r.Provision(ctx))
+		return r
+	}
+	seen := func(r *Gojinn) map[string]string {
+		kv, err := r.js.KeyValue(stateBucket(tenantID))
+		require.NoError(t, err)
+		out := map[string]string{}
+		keys, _ := kv.Keys()
+		for _, k := range keys {
+			if strings.HasPrefix(k, "seen.") {
+				if e, err := kv.Get(k); err == nil {
+					out[k] = string(e.Value())
+				}
+			}
+		}
+		return out
+	}
+
+	r := provision()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("set:orders.1:a"))
+	req.RemoteAddr = "192.0.2.51:5555"
+	rec := httptest.NewRecorder()
+	require.NoError(t, r.ServeHTTP(rec, req, nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	kv, err := r.js.KeyValue(stateBucket(tenantID))
+	require.NoError(t, err)
+	_, err = kv.PutString("customers.1", "ignored")
+	require.NoError(t, err)
+	require.NoError(t, kv.Delete("orders.1"))
+
+	require.Eventually(t, func() bool { return len(seen(r)) == 2 }, 15*time.Second, 100*time.Millisecond)
+	changes := []string{}
+	for _, v := range seen(r) {
+		changes = append(changes, v)
+	}
+	assert.ElementsMatch(t, []string{"KV:put:a", "KV:delete:"}, changes)
+
+	// With no node following the bucket, a change waits on the consumer
+	// until a node starting up resumes it.
+	r.subsMu.Lock()
+	r.evictTenant(tenantID, "test")
+	r.subsMu.Unlock()
+	_, err = kv.PutString("orders.2", "b")
+	require.NoError(t, err)
+
+	r2 := provision()
+	defer func() { _ = r2.Cleanup() }()
+	defer func() { _ = r.Cleanup() }()
+	require.Eventually(t, func() bool {
+		for k, v := range seen(r2) {
+			if strings.HasPrefix(k, "seen.orders.2.") && v == "KV:put:b" {
+				return true
+			}
+		}
+		return false
+	}, 15*time.Second, 100*time.Millisecond)
+	assert.Len(t, seen(r2), 3)
+}
+
+func TestKVTriggers_CatchAllIgnoresHostKeys(t *testing.T) {
+	handlerPath := compileTestWasm(t, echoFunction, "catchall.wasm")
+	const tenantID = "192_0_2_52"
+
+	r := &Gojinn{
+		Path:       handlerPath,
+		Mode:       ModeSync,
+		Timeout:    caddy.Duration(30 * time.Second),
+		PoolSize:   1,
+		NatsPort:   4254,
+		DataDir:    t.TempDir(),
+		KVTriggers: []KVTrigger{{Keys: ">", WasmFile: handlerPath}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	_, err := r.tenantKV(withInvocation(context.Background(), &invocation{TenantID: tenantID}), "orders.1")
+	require.NoError(t, err)
+	kv, err := r.js.KeyValue(stateBucket(tenantID))
+	require.NoError(t, err)
+	_, err = kv.PutString("orders.1", "a")
+	require.NoError(t, err)
+
+	jobs := func() int {
+		store, err := r.js.KeyValue(jobsBucket(tenantID))
+		require.NoError(t, err)
+		keys, _ := store.Keys()
+		return len(keys)
+	}
+	audited := func() bool {
+		keys, _ := kv.Keys()
+		for _, k := range keys {
+			if strings.HasPrefix(k, kvAuditPrefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The job writes its audit record, which must not start another job.
+	require.Eventually(t, audited, 15*time.Second, 100*time.Millisecond)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, 1, jobs())
+}
+
+const mutexFunction = `package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_kv_set
+func hostKVSet(kPtr, kLen, vPtr, vLen uint32)
+
+//go:wasmimport gojinn host_kv_get
+func hostKVGet(kPtr, kLen, outPtr, outMax uint32) uint32
+
+//go:wasmimport gojinn host_mutex_lock
+func hostMutexLock(kPtr, kLen, ttl uint32) uint32
+
+//go:wasmimport gojinn host_mutex_unlock
+func hostMutexUnlock(kPtr, kLen uint32) uint32
+
+//go:wasmimport gojinn host_mutex_acquire
+func hostMutexAcquire(kPtr, kLen uint32, ttlMs, waitMs int64) uint64
+
+//go:wasmimport gojinn host_mutex_renew
+func hostMutexRenew(kPtr, kLen uint32, token uint64, ttlMs int64) uint32
+
+//go:wasmimport gojinn host_mutex_release
+func hostMutexRelease(kPtr, kLen uint32, token uint64) uint32
+
+func ptr(s string) (uint32, uint32) {
+	return uint32(uintptr(unsafe.Pointer(unsafe.StringData(s)))), uint32(len(s))
+}
+
+func num(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+func acquire(ttl, wait string) string {
+	kp, kl := ptr("shared.lock")
+	token := hostMutexAcquire(kp, kl, num(ttl), num(wait))
+	if token == 0 {
+		return "busy"
+	}
+	return strconv.FormatUint(token, 10)
+}
+
+func main() {
+	var req struct {
+		Body string ` + "`json:\"body\"`" + `
+	}
+	_ = json.NewDecoder(os.Stdin).Decode(&req)
+
+	args := strings.Split(req.Body, ":")
+	kp, kl := ptr("shared.lock")
+	result := ""
+	switch args[0] {
+	case "count":
+		result = acquire("5000", "20000")
+		if result == "busy" {
+			break
+		}
+		ck, cl := ptr("shared.counter")
+		out := make([]byte, 32)
+		n := hostKVGet(ck, cl, uint32(uintptr(unsafe.Pointer(&out[0]))), uint32(len(out)))
+		count := int64(0)
+		if n != 0xFFFFFFFF {
+			count = num(string(out[:n]))
+		}
+		for i := 0; i < 200000; i++ {
+			_ = strconv.Itoa(i)
+		}
+		vp, vl := ptr(strconv.FormatInt(count+1, 10))
+		hostKVSet(ck, cl, vp, vl)
+		if hostMutexRelease(kp, kl, uint64(num(result))) != 1 {
+			result = "lost"
+		}
+	case "acquire":
+		result = acquire(args[1], args[2])
+	case "renew":
+		result = strconv.Itoa(int(hostMutexRenew(kp, kl, uint64(num(args[1])), num(args[2]))))
+	case "release":
+		result = strconv.Itoa(int(hostMutexRelease(kp, kl, uint64(num(args[1])))))
+	case "lock":
+		result = strconv.Itoa(int(hostMutexLock(kp, kl, uint32(num(args[1])))))
+	case "unlock":
+		result = strconv.Itoa(int(hostMutexUnlock(kp, kl)))
+	case "lock-unlock":
+		result = strconv.Itoa(int(hostMutexLock(kp, kl, 30))) + strconv.Itoa(int(hostMutexUnlock(kp, kl)))
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"status": 200, "body": result})
+}
+`
+
+func TestHostMutex_LeasesFencingAndContention(t *testing.T) {
+	wasmPath := compileTestWasm(t, mutexFunction, "mutex.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 4,
+		NatsPort: 4252,
+		DataDir:  t.TempDir(),
+		Perms:    Permissions{KVRead: []string{"shared."}, KVWrite: []string{"shared."}},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	call := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.52:5555"
+		rec := httptest.NewRecorder()
+		if err := r.ServeHTTP(rec, req, nil); err != nil || rec.Code != http.StatusOK {
+			return fmt.Sprintf("error: %v %d %s", err, rec.Code, rec.Body.String())
+		}
+		var res FunctionResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &res)
+		if res.Body == "" {
+			return rec.Body.String()
+		}
+		return res.Body
+	}
+	token := func(s string) uint64 {
+		n, err := strconv.ParseUint(s, 10, 64)
+		require.NoError(t, err, s)
+		return n
+	}
+
+	// Workers incrementing a counter under the lock never lose an update,
+	// and every acquisition gets a distinct token.
+	const workers = 8
+	tokens := make([]string, workers)
+	var wg sync.WaitGroup
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i] = call("count")
+		}(i)
+	}
+	wg.Wait()
+	seen := map[uint64]bool{}
+	for _, s := range tokens {
+		seen[token(s)] = true
+	}
+	assert.Len(t, seen, workers)
+
+	kv, err := r.js.KeyValue(stateBucket("192_0_2_52"))
+	require.NoError(t, err)
+	entry, err := kv.Get("shared.counter")
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(workers), string(entry.Value()))
+
+	// A holder that never releases loses the lock when its lease ends.
+	first := token(call("acquire:300:0"))
+	assert.Equal(t, "busy", call("acquire:1000:0"))
+	second := token(call("acquire:1000:5000"))
+	assert.Greater(t, second, first)
+
+	// Only the current token renews or releases the lock.
+	assert.Equal(t, "0", call(fmt.Sprintf("renew:%d:1000", first)))
+	assert.Equal(t, "0", call(fmt.Sprintf("release:%d", first)))
+	assert.Equal(t, "1", call(fmt.Sprintf("renew:%d:60000", second)))
+	time.Sleep(1200 * time.Millisecond)
+	assert.Equal(t, "busy", call("acquire:1000:0"))
+	assert.Equal(t, "1", call(fmt.Sprintf("release:%d", second)))
+	assert.Equal(t, "0", call(fmt.Sprintf("release:%d", second)))
+
+	// Unlock only releases a lock taken in the same invocation, and the TTL
+	// of host_mutex_lock is honoured.
+	assert.Equal(t, "11", call("lock-unlock"))
+	assert.Equal(t, "1", call("lock:1"))
+	assert.Equal(t, "0", call("unlock"))
+	assert.Equal(t, "0", call("lock:1"))
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, "1", call("lock:1"))
+
+	// Guests cannot reach the lease records through the KV functions.
+	assert.False(t, kvAllowed(mutexPrefix+"shared.lock", []string{"*"}))
+}
+
+func TestConsensus_NamespacesRouteToTheirOwnBuckets(t *testing.T) {
+	wasmPath := compileTestWasm(t, kvTTLFunction, "kvconsensus.wasm")
+
+	r := &Gojinn{
+		Path:     wasmPath,
+		Mode:     ModeSync,
+		Timeout:  caddy.Duration(30 * time.Second),
+		PoolSize: 1,
+		NatsPort: 4253,
+		DataDir:  t.TempDir(),
+		Perms:    Permissions{KVRead: []string{"*"}, KVWrite: []string{"*"}},
+		Consensus: []ConsensusPolicy{
+			{Namespace: "pay.", Mode: ConsensusCP},
+			{Namespace: "sess.", Mode: ConsensusAP, StaleReads: true},
+		},
+	}
+	ctx, _ := caddy.NewContext(caddy.Context{Context: context.Background()})
+	require.NoError(t, r.Provision(ctx))
+	defer func() { _ = r.Cleanup() }()
+
+	call := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.70:5555"
+		rec := httptest.NewRecorder()
+		require.NoError(t, r.ServeHTTP(rec, req, nil))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		return rec.Body.String()
+	}
+
+	call("set:pay.tx1:100")
+	call("set:sess.u1:alice")
+	call("set:plain:x")
+	call("ttl:sess.tmp:100:y")
+	assert.Equal(t, "100", call("get:pay.tx1"))
+	assert.Equal(t, "alice", call("get:sess.u1"))
+	assert.Equal(t, "x", call("get:plain"))
+
+	tenant := "192_0_2_70"
+	keysOf := func(bucket string) []string {
+		kv, err := r.js.KeyValue(bucket)
+		require.NoError(t, err)
+		keys, err := kv.Keys()
+		require.NoError(t, err)
+		var guest []string
+		for _, k := range keys {
+			if !strings.HasPrefix(k, kvReservedPrefix) {
+				guest = append(guest, k)
+			}
+		}
+		return guest
+	}
+	def := keysOf(stateBucket(tenant))
+	assert.Contains(t, def, "plain")
+	assert.NotContains(t, def, "pay.tx1")
+	assert.NotContains(t, def, "sess.u1")
+	assert.Equal(t, []string{"pay.tx1"}, keysOf(namespaceBucket(tenant, "pay.")))
+	assert.ElementsMatch(t, []string{"sess.u1", "sess.tmp"}, keysOf(namespaceBucket(tenant, "sess.")))
+
+	// CP buckets are only read through the stream leader.
+	cp, err := r.js.StreamInfo("KV_" + namespaceBucket(tenant, "pay."))
+	require.NoError(t, err)
+	assert.False(t, cp.Config.AllowDirect)
+	assert.Equal(t, 1, cp.Config.Replicas)
+	ap, err := r.js.StreamInfo("KV_" + namespaceBucket(tenant, "sess."))
+	require.NoError(t, err)
+	assert.True(t, ap.Config.AllowDirect)
+
+	// Listing merges the buckets.
+	inv := withInvocation(context.Background(), &invocation{TenantID: tenant})
+	page, err := r.kvKeys(inv, "p", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pay.tx1", "plain"}, page.Keys)
+	page, err = r.kvKeys(inv, "sess.", "", 1)
+	require.NoError(t, err)
+	assert.Equal(t, KVPage{Keys: []string{"sess.tmp"}, Next: "sess.tmp"}, page)
+	assert.Equal(t, "sess.>", keyFilter("sess.t"))
+	assert.Equal(t, ">", keyFilter("p"))
+	assert.Equal(t, ">", keyFilter("a..b"))
+
+	// Locks and expiry records follow the namespace of their key.
+	token, err := r.lockMutex(inv, "pay.lock", time.Minute, 0)
+	require.NoError(t, err)
+	payKV, err := r.js.KeyValue(namespaceBucket(tenant, "pay."))
+	require.NoError(t, err)
+	_, err = payKV.Get(mutexPrefix + "pay.lock")
+	assert.NoError(t, err)
+	require.NoError(t, r.unlockMutex(inv, "pay.lock", token))
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, r.sweepKV(time.Now()))
+	assert.Equal(t, []string{"sess.u1"}, keysOf(namespaceBucket(tenant, "sess.")))
+}
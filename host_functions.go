@@ -2,11 +2,14 @@ package gojinn
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/nats-io/nats.go"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"go.uber.org/zap"
@@ -102,24 +105,14 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 			key := string(kBytes)
 
-			if !isAllowed(key, r.Perms.KVWrite) {
-				r.logger.Warn("Security Violation: Module tried to write unauthorized KV key", zap.String("key", key))
-				return
-			}
-
 			vBytes, ok := mod.Memory().Read(valPtr, valLen)
 			if !ok {
 				return
 			}
-			val := string(vBytes)
-
-			if r.kv == nil {
-				r.logger.Error("KV Store not ready yet")
-				return
-			}
 
-			_, err := r.kv.PutString(key, val)
-			if err != nil {
+			if _, err := r.kvPut(ctx, key, vBytes, 0); errors.Is(err, errKVDenied) {
+				r.logger.Warn("Security Violation: Module tried to write unauthorized KV key", zap.String("key", key))
+			} else if err != nil {
 				r.logger.Error("KV Put Failed", zap.String("key", key), zap.Error(err))
 			}
 		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{}).
@@ -131,31 +124,59 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			//nolint:gosec
 			keyLen := uint32(stack[1])
 			//nolint:gosec
-			outPtr := uint32(stack[2])
+			valPtr := uint32(stack[2])
 			//nolint:gosec
-			outMaxLen := uint32(stack[3])
+			valLen := uint32(stack[3])
+			//nolint:gosec
+			ttl := time.Duration(int64(stack[4])) * time.Millisecond
+
+			stack[0] = 0
 
 			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
 			if !ok {
-				stack[0] = 0
 				return
 			}
 			key := string(kBytes)
 
-			if !isAllowed(key, r.Perms.KVRead) {
-				r.logger.Warn("Security Violation: Module tried to read unauthorized KV key", zap.String("key", key))
-				stack[0] = 0xFFFFFFFFFFFFFFFF
+			vBytes, ok := mod.Memory().Read(valPtr, valLen)
+			if !ok {
+				return
+			}
+
+			if _, err := r.kvPut(ctx, key, vBytes, ttl); errors.Is(err, errKVDenied) {
+				r.logger.Warn("Security Violation: Module tried to write unauthorized KV key", zap.String("key", key))
+				return
+			} else if err != nil {
+				r.logger.Error("KV Put Failed", zap.String("key", key), zap.Error(err))
 				return
 			}
+			stack[0] = 1
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI64}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_kv_set_ttl").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			keyPtr := uint32(stack[0])
+			//nolint:gosec
+			keyLen := uint32(stack[1])
+			//nolint:gosec
+			outPtr := uint32(stack[2])
+			//nolint:gosec
+			outMaxLen := uint32(stack[3])
 
-			if r.kv == nil {
-				stack[0] = 0xFFFFFFFFFFFFFFFF
+			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				stack[0] = 0
 				return
 			}
+			key := string(kBytes)
 
-			entry, err := r.kv.Get(key)
+			entry, err := r.kvGet(ctx, key)
 			if err != nil {
-				stack[0] = 0xFFFFFFFFFFFFFFFF
+				if errors.Is(err, errKVDenied) {
+					r.logger.Warn("Security Violation: Module tried to read unauthorized KV key", zap.String("key", key))
+				}
+				stack[0] = 0xFFFFFFFF
 				return
 			}
 
@@ -173,7 +194,7 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 
 			stack[0] = uint64(bytesToWrite)
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}).
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
 		Export("host_kv_get").
 		NewFunctionBuilder().
 		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
@@ -184,59 +205,294 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			//nolint:gosec
 			ttlSeconds := uint32(stack[2])
 
+			stack[0] = 0
+
 			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
 			if !ok {
-				stack[0] = 0
 				return
 			}
-			lockKey := "mutex_" + string(kBytes)
+			name := string(kBytes)
+			token, err := r.lockMutex(ctx, name, time.Duration(ttlSeconds)*time.Second, 0)
+			if err != nil {
+				r.logMutexError("Mutex Lock Failed", name, err)
+				return
+			}
+			if inv := invocationFrom(ctx); inv != nil {
+				if inv.Mutexes == nil {
+					inv.Mutexes = make(map[string]uint64)
+				}
+				inv.Mutexes[name] = token
+			}
+			stack[0] = 1
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_mutex_lock").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			keyPtr := uint32(stack[0])
+			//nolint:gosec
+			keyLen := uint32(stack[1])
 
-			if r.kv == nil {
-				r.logger.Error("KV Store not ready for mutex")
-				stack[0] = 0
+			stack[0] = 0
+
+			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return
+			}
+			// Only a lock this invocation took can be released without its
+			// token.
+			name := string(kBytes)
+			inv := invocationFrom(ctx)
+			if inv == nil {
+				return
+			}
+			token, held := inv.Mutexes[name]
+			if !held {
+				return
+			}
+			delete(inv.Mutexes, name)
+			if err := r.unlockMutex(ctx, name, token); err != nil {
+				r.logMutexError("Mutex Unlock Failed", name, err)
 				return
 			}
+			stack[0] = 1
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_mutex_unlock").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			keyPtr := uint32(stack[0])
+			//nolint:gosec
+			keyLen := uint32(stack[1])
+			//nolint:gosec
+			ttlMs := int64(stack[2])
+			//nolint:gosec
+			waitMs := int64(stack[3])
 
-			_, err := r.kv.Create(lockKey, []byte(fmt.Sprintf("%d", time.Now().UnixNano())))
+			stack[0] = 0
 
+			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return
+			}
+			token, err := r.lockMutex(ctx, string(kBytes), time.Duration(ttlMs)*time.Millisecond, time.Duration(waitMs)*time.Millisecond)
 			if err != nil {
-				stack[0] = 0
+				r.logMutexError("Mutex Acquire Failed", string(kBytes), err)
 				return
 			}
+			stack[0] = token
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI64, api.ValueTypeI64}, []api.ValueType{api.ValueTypeI64}).
+		Export("host_mutex_acquire").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			keyPtr := uint32(stack[0])
+			//nolint:gosec
+			keyLen := uint32(stack[1])
+			token := stack[2]
+			//nolint:gosec
+			ttlMs := int64(stack[3])
 
-			_ = ttlSeconds
+			stack[0] = 0
 
+			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return
+			}
+			if err := r.renewMutex(ctx, string(kBytes), token, time.Duration(ttlMs)*time.Millisecond); err != nil {
+				r.logMutexError("Mutex Renew Failed", string(kBytes), err)
+				return
+			}
 			stack[0] = 1
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
-		Export("host_mutex_lock").
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI64, api.ValueTypeI64}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_mutex_renew").
 		NewFunctionBuilder().
 		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
 			//nolint:gosec
 			keyPtr := uint32(stack[0])
 			//nolint:gosec
 			keyLen := uint32(stack[1])
+			token := stack[2]
+
+			stack[0] = 0
 
 			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
 			if !ok {
-				stack[0] = 0
 				return
 			}
-			lockKey := "mutex_" + string(kBytes)
+			if err := r.unlockMutex(ctx, string(kBytes), token); err != nil {
+				r.logMutexError("Mutex Release Failed", string(kBytes), err)
+				return
+			}
+			if inv := invocationFrom(ctx); inv != nil && inv.Mutexes[string(kBytes)] == token {
+				delete(inv.Mutexes, string(kBytes))
+			}
+			stack[0] = 1
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI64}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_mutex_release").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			keyPtr := uint32(stack[0])
+			//nolint:gosec
+			keyLen := uint32(stack[1])
 
-			if r.kv == nil {
-				stack[0] = 0
+			stack[0] = 0
+
+			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return
+			}
+			if err := r.kvDelete(ctx, string(kBytes)); err != nil {
+				r.logger.Warn("KV Delete Failed", zap.String("key", string(kBytes)), zap.Error(err))
 				return
 			}
+			stack[0] = 1
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_kv_delete").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			keyPtr := uint32(stack[0])
+			//nolint:gosec
+			keyLen := uint32(stack[1])
+			//nolint:gosec
+			outPtr := uint32(stack[2])
+			//nolint:gosec
+			outMaxLen := uint32(stack[3])
+			//nolint:gosec
+			revPtr := uint32(stack[4])
+
+			stack[0] = 0xFFFFFFFF
 
-			err := r.kv.Delete(lockKey)
+			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return
+			}
+			entry, err := r.kvGet(ctx, string(kBytes))
 			if err != nil {
-				stack[0] = 0
 				return
 			}
 
-			stack[0] = 1
-		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
-		Export("host_mutex_unlock").
+			valBytes := entry.Value()
+			//nolint:gosec
+			bytesToWrite := min(uint32(len(valBytes)), outMaxLen)
+			if !mod.Memory().Write(outPtr, valBytes[:bytesToWrite]) || !mod.Memory().WriteUint64Le(revPtr, entry.Revision()) {
+				return
+			}
+			stack[0] = uint64(bytesToWrite)
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_kv_get_rev").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			keyPtr := uint32(stack[0])
+			//nolint:gosec
+			keyLen := uint32(stack[1])
+			//nolint:gosec
+			valPtr := uint32(stack[2])
+			//nolint:gosec
+			valLen := uint32(stack[3])
+			expected := stack[4]
+
+			stack[0] = 0
+
+			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return
+			}
+			vBytes, ok := mod.Memory().Read(valPtr, valLen)
+			if !ok {
+				return
+			}
+			// A conflict is an expected outcome; only other failures are logged.
+			rev, err := r.kvCAS(ctx, string(kBytes), vBytes, expected)
+			if err != nil {
+				if !errors.Is(err, nats.ErrKeyExists) {
+					r.logger.Warn("KV CAS Failed", zap.String("key", string(kBytes)), zap.Error(err))
+				}
+				return
+			}
+			stack[0] = rev
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI64}, []api.ValueType{api.ValueTypeI64}).
+		Export("host_kv_cas").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			prefixPtr := uint32(stack[0])
+			//nolint:gosec
+			prefixLen := uint32(stack[1])
+			//nolint:gosec
+			cursorPtr := uint32(stack[2])
+			//nolint:gosec
+			cursorLen := uint32(stack[3])
+			//nolint:gosec
+			limit := int(uint32(stack[4]))
+			//nolint:gosec
+			outPtr := uint32(stack[5])
+			//nolint:gosec
+			outMaxLen := uint32(stack[6])
+
+			stack[0] = 0xFFFFFFFF
+
+			prefix, ok := mod.Memory().Read(prefixPtr, prefixLen)
+			if !ok {
+				return
+			}
+			cursor, ok := mod.Memory().Read(cursorPtr, cursorLen)
+			if !ok {
+				return
+			}
+			page, err := r.kvKeys(ctx, string(prefix), string(cursor), limit)
+			if err != nil {
+				r.logger.Warn("KV Keys Failed", zap.String("prefix", string(prefix)), zap.Error(err))
+				return
+			}
+			data, err := page.encode(int(outMaxLen))
+			if err != nil || !mod.Memory().Write(outPtr, data) {
+				return
+			}
+			stack[0] = uint64(len(data))
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_kv_keys").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			keyPtr := uint32(stack[0])
+			//nolint:gosec
+			keyLen := uint32(stack[1])
+			//nolint:gosec
+			outPtr := uint32(stack[2])
+			//nolint:gosec
+			outMaxLen := uint32(stack[3])
+
+			stack[0] = 0xFFFFFFFF
+
+			kBytes, ok := mod.Memory().Read(keyPtr, keyLen)
+			if !ok {
+				return
+			}
+			history, err := r.kvHistory(ctx, string(kBytes))
+			if errors.Is(err, nats.ErrKeyNotFound) {
+				history, err = []KVHistoryEntry{}, nil
+			}
+			if err != nil {
+				return
+			}
+
+			// The oldest revisions give way when the buffer is too small.
+			data, _ := json.Marshal(history)
+			for len(history) > 0 && uint32(len(data)) > outMaxLen { //nolint:gosec
+				history = history[1:]
+				data, _ = json.Marshal(history)
+			}
+			//nolint:gosec
+			if uint32(len(data)) > outMaxLen || !mod.Memory().Write(outPtr, data) {
+				return
+			}
+			stack[0] = uint64(len(data))
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_kv_history").
 		NewFunctionBuilder().
 		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
 			//nolint:gosec
@@ -254,7 +510,7 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 			key := string(kBytes)
 
-			if !isAllowed(r.S3Bucket, r.Perms.S3Write) {
+			if !isAllowed(r.S3Bucket, r.permissionsFor(ctx).S3Write) {
 				r.logger.Warn("Security Violation: Module tried to write to unauthorized S3 bucket", zap.String("bucket", r.S3Bucket))
 				stack[0] = 1
 				return
@@ -293,7 +549,7 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 			key := string(kBytes)
 
-			if !isAllowed(r.S3Bucket, r.Perms.S3Read) {
+			if !isAllowed(r.S3Bucket, r.permissionsFor(ctx).S3Read) {
 				r.logger.Warn("Security Violation: Module tried to read from unauthorized S3 bucket", zap.String("bucket", r.S3Bucket))
 				stack[0] = 0
 				return
@@ -345,15 +601,170 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 			payload := string(pBytes)
 
-			go func() {
-				r.runAsyncJob(context.Background(), wasmFile, payload)
-			}()
-
-			r.logger.Info("Job enqueued in background", zap.String("file", wasmFile))
+			if _, err := r.enqueueAsyncJob(ctx, wasmFile, payload, time.Time{}); err != nil {
+				r.logger.Warn("Async enqueue rejected", zap.String("file", wasmFile), zap.Error(err))
+				stack[0] = 1
+				return
+			}
 			stack[0] = 0
 		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
 		Export("host_enqueue").
 		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			filePtr := uint32(stack[0])
+			//nolint:gosec
+			fileLen := uint32(stack[1])
+			//nolint:gosec
+			payloadPtr := uint32(stack[2])
+			//nolint:gosec
+			payloadLen := uint32(stack[3])
+			//nolint:gosec
+			outPtr := uint32(stack[4])
+			//nolint:gosec
+			outMaxLen := uint32(stack[5])
+
+			stack[0] = 0xFFFFFFFF
+
+			fBytes, ok := mod.Memory().Read(filePtr, fileLen)
+			if !ok {
+				return
+			}
+			pBytes, ok := mod.Memory().Read(payloadPtr, payloadLen)
+			if !ok {
+				return
+			}
+
+			jobID, err := r.enqueueAsyncJob(ctx, string(fBytes), string(pBytes), time.Time{})
+			if err != nil {
+				r.logger.Warn("Async enqueue rejected", zap.String("file", string(fBytes)), zap.Error(err))
+				return
+			}
+			//nolint:gosec
+			if uint32(len(jobID)) > outMaxLen || !mod.Memory().Write(outPtr, []byte(jobID)) {
+				return
+			}
+			stack[0] = uint64(len(jobID))
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_enqueue_job").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			filePtr := uint32(stack[0])
+			//nolint:gosec
+			fileLen := uint32(stack[1])
+			//nolint:gosec
+			payloadPtr := uint32(stack[2])
+			//nolint:gosec
+			payloadLen := uint32(stack[3])
+			//nolint:gosec
+			runAt := time.UnixMilli(int64(stack[4]))
+			//nolint:gosec
+			outPtr := uint32(stack[5])
+			//nolint:gosec
+			outMaxLen := uint32(stack[6])
+
+			stack[0] = 0xFFFFFFFF
+
+			fBytes, ok := mod.Memory().Read(filePtr, fileLen)
+			if !ok {
+				return
+			}
+			pBytes, ok := mod.Memory().Read(payloadPtr, payloadLen)
+			if !ok {
+				return
+			}
+
+			jobID, err := r.enqueueAsyncJob(ctx, string(fBytes), string(pBytes), runAt)
+			if err != nil {
+				r.logger.Warn("Async schedule rejected", zap.String("file", string(fBytes)), zap.Error(err))
+				return
+			}
+			//nolint:gosec
+			if uint32(len(jobID)) > outMaxLen || !mod.Memory().Write(outPtr, []byte(jobID)) {
+				return
+			}
+			stack[0] = uint64(len(jobID))
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI64, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_schedule_job").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			filePtr := uint32(stack[0])
+			//nolint:gosec
+			fileLen := uint32(stack[1])
+			//nolint:gosec
+			payloadsPtr := uint32(stack[2])
+			//nolint:gosec
+			payloadsLen := uint32(stack[3])
+			//nolint:gosec
+			k := int(uint32(stack[4]))
+			//nolint:gosec
+			outPtr := uint32(stack[5])
+			//nolint:gosec
+			outMaxLen := uint32(stack[6])
+
+			stack[0] = 0xFFFFFFFF
+
+			fBytes, ok := mod.Memory().Read(filePtr, fileLen)
+			if !ok {
+				return
+			}
+			pBytes, ok := mod.Memory().Read(payloadsPtr, payloadsLen)
+			if !ok {
+				return
+			}
+			var payloads []string
+			if err := json.Unmarshal(pBytes, &payloads); err != nil {
+				r.logger.Warn("Map rejected: payloads must be a JSON array of strings", zap.Error(err))
+				return
+			}
+
+			results, err := r.mapJobs(ctx, string(fBytes), payloads, k)
+			if err != nil {
+				r.logger.Warn("Map rejected", zap.String("file", string(fBytes)), zap.Error(err))
+				return
+			}
+			data, _ := json.Marshal(results)
+
+			// Results that do not fit are kept for host_map_result, and the
+			// guest learns the size it needs from the return value.
+			//nolint:gosec
+			if uint32(len(data)) > outMaxLen {
+				if inv := invocationFrom(ctx); inv != nil {
+					inv.PendingMap = data
+					stack[0] = uint64(len(data))
+				}
+				return
+			}
+			if !mod.Memory().Write(outPtr, data) {
+				return
+			}
+			stack[0] = uint64(len(data))
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_map").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			outPtr := uint32(stack[0])
+			//nolint:gosec
+			outMaxLen := uint32(stack[1])
+
+			stack[0] = 0xFFFFFFFF
+
+			inv := invocationFrom(ctx)
+			//nolint:gosec
+			if inv == nil || inv.PendingMap == nil || uint32(len(inv.PendingMap)) > outMaxLen {
+				return
+			}
+			if !mod.Memory().Write(outPtr, inv.PendingMap) {
+				return
+			}
+			stack[0] = uint64(len(inv.PendingMap))
+			inv.PendingMap = nil
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_map_result").
+		NewFunctionBuilder().
 		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
 			//nolint:gosec
 			promptPtr := uint32(stack[0])
@@ -483,6 +894,86 @@ func (r *Gojinn) buildHostModule(ctx context.Context, engine wazero.Runtime) err
 			}
 		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{}).
 		Export("host_ws_write").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			status := int32(stack[0])
+			//nolint:gosec
+			headersPtr := uint32(stack[1])
+			//nolint:gosec
+			headersLen := uint32(stack[2])
+
+			inv := invocationFrom(ctx)
+			if inv == nil || inv.Stream == nil {
+				stack[0] = 1
+				return
+			}
+
+			var headers map[string][]string
+			if headersLen > 0 {
+				hBytes, ok := mod.Memory().Read(headersPtr, headersLen)
+				if !ok {
+					stack[0] = 1
+					return
+				}
+				if err := json.Unmarshal(hBytes, &headers); err != nil {
+					r.logger.Warn("Invalid stream headers", zap.Error(err))
+					stack[0] = 1
+					return
+				}
+			}
+
+			if err := inv.Stream.Open(int(status), headers); err != nil {
+				r.logger.Warn("Stream open failed", zap.Error(err))
+				stack[0] = 1
+				return
+			}
+			stack[0] = 0
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_stream_open").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			//nolint:gosec
+			dataPtr := uint32(stack[0])
+			//nolint:gosec
+			dataLen := uint32(stack[1])
+
+			inv := invocationFrom(ctx)
+			if inv == nil || inv.Stream == nil {
+				stack[0] = 1
+				return
+			}
+
+			data, ok := mod.Memory().Read(dataPtr, dataLen)
+			if !ok {
+				stack[0] = 1
+				return
+			}
+
+			if _, err := inv.Stream.Write(data); err != nil {
+				r.logger.Warn("Stream write failed", zap.Error(err))
+				stack[0] = 1
+				return
+			}
+			stack[0] = 0
+		}), []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_stream_write").
+		NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			inv := invocationFrom(ctx)
+			if inv == nil || inv.Stream == nil {
+				stack[0] = 1
+				return
+			}
+
+			if err := inv.Stream.Flush(); err != nil {
+				r.logger.Warn("Stream flush failed", zap.Error(err))
+				stack[0] = 1
+				return
+			}
+			stack[0] = 0
+		}), []api.ValueType{}, []api.ValueType{api.ValueTypeI32}).
+		Export("host_stream_flush").
 		Instantiate(ctx)
 
 	return err
@@ -0,0 +1,115 @@
+package gojinn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+
+	DefaultDedupeWindow = 2 * time.Minute
+)
+
+func validateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLen {
+		return fmt.Errorf("%s must not exceed %d bytes", headerIdempotencyKey, maxIdempotencyKeyLen)
+	}
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return fmt.Errorf("%s must be printable ASCII without spaces", headerIdempotencyKey)
+		}
+	}
+	return nil
+}
+
+// idempotencyMsgID scopes a client key to one function. The tenant scope comes
+// from the stream: JetStream deduplicates per stream, and every tenant has
+// its own.
+func idempotencyMsgID(fn *functionSpec, key string) string {
+	return fn.Key + ":" + key
+}
+
+// idempotentJobID derives the job ID of a scheduled submission from its key,
+// so a duplicate collides with the original record.
+func idempotentJobID(fn *functionSpec, key string) string {
+	return hashString(fn.Key + "|" + key)[:24]
+}
+
+// dedupeWindow is how long the tenant stream remembers message IDs, and so
+// how long an Idempotency-Key protects against duplicate submissions.
+func (g *Gojinn) dedupeWindow(tenantID string) time.Duration {
+	if cfg := g.tenantConfig(tenantID); cfg != nil && cfg.DedupeWindow > 0 {
+		return time.Duration(cfg.DedupeWindow)
+	}
+	return time.Duration(g.DedupeWindow)
+}
+
+// syncDedupeWindow adjusts the duplicate window of an existing tenant stream
+// when the configuration changed it.
+func (g *Gojinn) syncDedupeWindow(tenantID string, info *nats.StreamInfo) {
+	window := g.dedupeWindow(tenantID)
+	if info.Config.Duplicates == window {
+		return
+	}
+	cfg := info.Config
+	cfg.Duplicates = window
+	if _, err := g.js.UpdateStream(&cfg); err != nil {
+		g.logger.Warn("Failed to update dedupe window", zap.String("tenant", tenantID), zap.Error(err))
+	}
+}
+
+// serveDuplicateJob answers a submission whose Idempotency-Key matched an
+// earlier one with the original job instead of starting it again. Sync
+// functions wait for the original result; async ones report the job as it
+// stands, with its output once it is terminal.
+func (r *Gojinn) serveDuplicateJob(rw http.ResponseWriter, req *http.Request, tenantID, jobID string, fn *functionSpec) error {
+	r.logger.Info("Duplicate submission", zap.String("tenant", tenantID), zap.String("job_id", jobID), zap.String("function", fn.Name))
+
+	rw.Header().Set("X-Gojinn-Job-ID", jobID)
+	rw.Header().Set("X-Gojinn-Tenant", tenantID)
+	rw.Header().Set("X-Gojinn-Idempotent-Replay", "true")
+
+	if fn.Mode == ModeSync {
+		rec, err := r.GetJob(req.Context(), tenantID, jobID, fn.Timeout)
+		if err != nil || !rec.Terminal() {
+			return caddyhttp.Error(http.StatusGatewayTimeout, fmt.Errorf("job %s did not complete within %s", jobID, fn.Timeout))
+		}
+		if rec.State != JobSucceeded {
+			return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("function failed: %s", rec.Error))
+		}
+		return writeFunctionResponse(rw, []byte(rec.Stdout))
+	}
+
+	resp := map[string]interface{}{
+		"status": JobQueued,
+		"job_id": jobID,
+		"tenant": tenantID,
+		"msg":    "Duplicate submission: returning the original job.",
+	}
+	status := http.StatusAccepted
+	if rec, err := r.GetJob(req.Context(), tenantID, jobID, 0); err == nil {
+		resp["status"] = rec.State
+		if rec.Terminal() {
+			status = http.StatusOK
+			resp["job"] = rec
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	return json.NewEncoder(rw).Encode(resp)
+}
+
+// idempotencyKey returns the trimmed Idempotency-Key of req, if any.
+func idempotencyKey(req *http.Request) string {
+	return strings.TrimSpace(req.Header.Get(headerIdempotencyKey))
+}
@@ -0,0 +1,63 @@
+package gojinn
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+type invocationKey struct{}
+
+// invocation carries the per-execution state host functions need to act on
+// behalf of the job currently running in the sandbox.
+type invocation struct {
+	TenantID string
+	JobID    string
+	Function *functionSpec
+	Stream   *responseStream
+
+	// PendingMap holds the results of the last host_map call until the
+	// guest collects them, when they did not fit its buffer.
+	PendingMap []byte
+
+	// Mutexes holds the fencing tokens of the locks taken with
+	// host_mutex_lock, so host_mutex_unlock only releases those.
+	Mutexes map[string]uint64
+
+	// AsyncWorker is the worker running a job of the async stream, whose
+	// pool runs the sub-invocations of host_map as well. Nil for other jobs.
+	AsyncWorker *nats.Subscription
+
+	// Yield gives back the sandbox slot of a job while it waits on other
+	// jobs and returns the function taking one again, which fails once the
+	// job's context ends. Nil outside a job.
+	Yield func() (resume func() error)
+}
+
+func withInvocation(ctx context.Context, inv *invocation) context.Context {
+	return context.WithValue(ctx, invocationKey{}, inv)
+}
+
+func invocationFrom(ctx context.Context) *invocation {
+	inv, _ := ctx.Value(invocationKey{}).(*invocation)
+	return inv
+}
+
+// permissionsFor returns the host permissions of the function running under
+// ctx, falling back to the block-level ones outside a routed invocation.
+func (r *Gojinn) permissionsFor(ctx context.Context) Permissions {
+	if inv := invocationFrom(ctx); inv != nil && inv.Function != nil {
+		return inv.Function.Perms
+	}
+	return r.Perms
+}
+
+// tenantOf returns the tenant the code running under ctx acts for. Work
+// started outside a tenant request, like MCP tool calls, runs as the tenant
+// of internal triggers.
+func tenantOf(ctx context.Context) string {
+	if inv := invocationFrom(ctx); inv != nil && inv.TenantID != "" {
+		return inv.TenantID
+	}
+	return DefaultTriggerTenant
+}
@@ -4,82 +4,46 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"time"
+	"strconv"
 
 	"github.com/nats-io/nats.go"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/propagation"
-	"go.uber.org/zap"
 )
 
-func (r *Gojinn) runBackgroundJob(wasmFile string) {
-	ctx, span := otel.Tracer("gojinn-scheduler").Start(context.Background(), "cron_trigger")
-	defer span.End()
-
-	cronPayload := `{"event_type": "cron", "source": "gojinn_scheduler"}`
-
-	r.runAsyncJob(ctx, wasmFile, cronPayload)
-}
-
-func (r *Gojinn) runAsyncJob(ctx context.Context, wasmFile, payload string) {
-	tracer := otel.Tracer("gojinn-publisher")
-	ctx, span := tracer.Start(ctx, "publish_async_job")
-	defer span.End()
+// DefaultTriggerTenant owns the jobs of cron entries, MQTT subscriptions and
+// enqueues that do not come with a tenant.
+const DefaultTriggerTenant = "system"
 
+// enqueueFunctionJob queues req for fn on behalf of a non-HTTP trigger,
+// provisioning the tenant and its workers on this node first. Unless the ack
+// reports a duplicate, the job is recorded as queued under its sequence.
+func (r *Gojinn) enqueueFunctionJob(ctx context.Context, tenantID string, fn *functionSpec, req JobRequest, opts ...nats.PubOpt) (*nats.PubAck, error) {
 	if r.js == nil {
-		err := fmt.Errorf("JetStream not ready")
-		r.logger.Error("Cannot queue async job", zap.String("file", wasmFile), zap.Error(err))
-
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return
+		return nil, fmt.Errorf("JetStream not ready")
 	}
-
-	topic := fmt.Sprintf("gojinn.exec.%s", hashString(wasmFile))
-
-	jobPayload := struct {
-		Method  string              `json:"method"`
-		URI     string              `json:"uri"`
-		Headers map[string][]string `json:"headers"`
-		Body    string              `json:"body"`
-	}{
-		Method: "ASYNC",
-		URI:    "internal://async/job",
-		Headers: map[string][]string{
-			"X-Source": {"internal"},
-		},
-		Body: payload,
+	if _, err := r.EnsureTenantResources(tenantID); err != nil {
+		return nil, fmt.Errorf("failed to provision tenant: %w", err)
+	}
+	fn = r.tenantFunction(tenantID, fn)
+	if err := r.ensureFunctionWorkers(tenantID, fn); err != nil {
+		return nil, fmt.Errorf("failed to start workers: %w", err)
 	}
 
-	jobBytes, err := json.Marshal(jobPayload)
+	payload, err := json.Marshal(req)
 	if err != nil {
-		r.logger.Error("Failed to marshal async job", zap.Error(err))
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "json marshal failed")
-		return
+		return nil, err
 	}
-
-	msgID := fmt.Sprintf("job_%d", time.Now().UnixNano())
-
-	msg := nats.NewMsg(topic)
-	msg.Data = jobBytes
-
+	msg := nats.NewMsg(fn.Subject(tenantID))
+	msg.Data = payload
 	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(msg.Header))
 
-	_, err = r.js.PublishMsg(msg, nats.MsgId(msgID))
+	pubAck, err := r.js.PublishMsg(msg, opts...)
 	if err != nil {
-		r.logger.Error("Failed to persist async job",
-			zap.String("file", wasmFile),
-			zap.Error(err))
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "nats publish failed")
-		return
+		return nil, fmt.Errorf("failed to persist job: %w", err)
 	}
-
-	r.logger.Info("Async Job Persisted & Queued",
-		zap.String("file", wasmFile),
-		zap.String("msg_id", msgID),
-		zap.String("trace_id", span.SpanContext().TraceID().String()),
-	)
+	if !pubAck.Duplicate {
+		r.recordJobQueued(tenantID, strconv.FormatUint(pubAck.Sequence, 10))
+	}
+	return pubAck, nil
 }
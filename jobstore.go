@@ -0,0 +1,308 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	JobScheduled = "scheduled"
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobDead      = "dead"
+	JobCancelled = "cancelled"
+
+	DefaultJobRetention = 24 * time.Hour
+	maxJobWait          = 60 * time.Second
+	maxRecordedOutput   = 1024 * 1024
+	maxJobHistory       = 20
+)
+
+// JobAttempt is one failed attempt of a job.
+type JobAttempt struct {
+	Attempt int       `json:"attempt"`
+	Error   string    `json:"error"`
+	At      time.Time `json:"at"`
+}
+
+type JobRecord struct {
+	ID        string       `json:"id"`
+	Tenant    string       `json:"tenant"`
+	State     string       `json:"state"`
+	Attempts  int          `json:"attempts"`
+	RunAt     *time.Time   `json:"run_at,omitempty"`
+	Stdout    string       `json:"stdout,omitempty"`
+	Stderr    string       `json:"stderr,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	History   []JobAttempt `json:"history,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+func (j *JobRecord) Terminal() bool {
+	return j.State == JobSucceeded || j.State == JobDead || j.State == JobCancelled
+}
+
+// recordAttempt appends the failure of the current attempt to the history,
+// keeping only the most recent ones.
+func (j *JobRecord) recordAttempt(errMsg string) {
+	j.History = append(j.History, JobAttempt{Attempt: j.Attempts, Error: truncateOutput(errMsg), At: time.Now().UTC()})
+	if len(j.History) > maxJobHistory {
+		j.History = j.History[len(j.History)-maxJobHistory:]
+	}
+}
+
+func jobsBucket(tenantID string) string {
+	return fmt.Sprintf("JOBS_%s", strings.ToUpper(tenantID))
+}
+
+func truncateOutput(s string) string {
+	if len(s) > maxRecordedOutput {
+		return s[:maxRecordedOutput]
+	}
+	return s
+}
+
+// ensureJobStore provisions the tenant job store, or adjusts its retention
+// when the tenant configuration changed it.
+func (g *Gojinn) ensureJobStore(tenantID string) error {
+	bucket := jobsBucket(tenantID)
+	retention := time.Duration(g.JobRetention)
+	if cfg := g.tenantConfig(tenantID); cfg != nil && cfg.JobRetention > 0 {
+		retention = time.Duration(cfg.JobRetention)
+	}
+
+	if kv, err := g.js.KeyValue(bucket); err == nil {
+		status, err := kv.Status()
+		if err != nil || status.TTL() == retention {
+			return nil
+		}
+		info, err := g.js.StreamInfo("KV_" + bucket)
+		if err != nil {
+			return nil
+		}
+		cfg := info.Config
+		cfg.MaxAge = retention
+		if _, err := g.js.UpdateStream(&cfg); err != nil {
+			g.logger.Warn("Failed to update job retention", zap.String("tenant", tenantID), zap.Error(err))
+		}
+		return nil
+	}
+
+	g.logger.Info("Provisioning Tenant Job Store...", zap.String("tenant", tenantID), zap.String("bucket", bucket))
+	_, err := g.js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:      bucket,
+		Description: fmt.Sprintf("Job results for %s", tenantID),
+		Storage:     nats.FileStorage,
+		History:     1,
+		TTL:         retention,
+		Replicas:    g.ClusterReplicas,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to provision tenant job store: %w", err)
+	}
+	return nil
+}
+
+// recordJobQueued writes the initial record for a freshly published job. It
+// uses Create so it never clobbers a record a fast worker already updated.
+func (g *Gojinn) recordJobQueued(tenantID, jobID string) {
+	kv, err := g.js.KeyValue(jobsBucket(tenantID))
+	if err != nil {
+		g.logger.Warn("Job store unavailable", zap.String("tenant", tenantID), zap.Error(err))
+		return
+	}
+
+	now := time.Now().UTC()
+	rec := JobRecord{ID: jobID, Tenant: tenantID, State: JobQueued, CreatedAt: now, UpdatedAt: now}
+	data, _ := json.Marshal(rec)
+	_, _ = kv.Create(jobID, data)
+}
+
+// recordJobScheduled writes the initial record of a job deferred to runAt.
+func (g *Gojinn) recordJobScheduled(tenantID, jobID string, runAt time.Time) error {
+	kv, err := g.js.KeyValue(jobsBucket(tenantID))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	runAt = runAt.UTC()
+	rec := JobRecord{ID: jobID, Tenant: tenantID, State: JobScheduled, RunAt: &runAt, CreatedAt: now, UpdatedAt: now}
+	data, _ := json.Marshal(rec)
+	_, err = kv.Create(jobID, data)
+	return err
+}
+
+// transitionJob moves jobID from state from to the state set by mutate. It
+// reports false, without writing, when the job is in another state or was
+// changed concurrently, so only one of two racing transitions wins.
+func (g *Gojinn) transitionJob(tenantID, jobID, from string, mutate func(*JobRecord)) (bool, error) {
+	kv, err := g.js.KeyValue(jobsBucket(tenantID))
+	if err != nil {
+		return false, err
+	}
+	entry, err := kv.Get(jobID)
+	if err != nil {
+		return false, err
+	}
+	var rec JobRecord
+	if err := json.Unmarshal(entry.Value(), &rec); err != nil {
+		return false, err
+	}
+	if rec.State != from {
+		return false, nil
+	}
+
+	mutate(&rec)
+	rec.UpdatedAt = time.Now().UTC()
+	data, _ := json.Marshal(rec)
+	if _, err := kv.Update(jobID, data, entry.Revision()); err != nil {
+		if errors.Is(err, nats.ErrKeyExists) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// updateJob applies mutate to the stored record of jobID, persists it and
+// returns the updated record.
+func (g *Gojinn) updateJob(tenantID, jobID string, mutate func(*JobRecord)) *JobRecord {
+	now := time.Now().UTC()
+	rec := JobRecord{ID: jobID, Tenant: tenantID, CreatedAt: now}
+
+	kv, err := g.js.KeyValue(jobsBucket(tenantID))
+	if err != nil {
+		g.logger.Warn("Job store unavailable", zap.String("tenant", tenantID), zap.Error(err))
+		mutate(&rec)
+		return &rec
+	}
+
+	if entry, err := kv.Get(jobID); err == nil {
+		_ = json.Unmarshal(entry.Value(), &rec)
+	}
+
+	mutate(&rec)
+	rec.Stdout = truncateOutput(rec.Stdout)
+	rec.Stderr = truncateOutput(rec.Stderr)
+	rec.UpdatedAt = now
+
+	data, _ := json.Marshal(rec)
+	if _, err := kv.Put(jobID, data); err != nil {
+		g.logger.Warn("Failed to persist job record", zap.String("tenant", tenantID), zap.String("job_id", jobID), zap.Error(err))
+	}
+	return &rec
+}
+
+// GetJob returns the stored record of jobID. When wait is positive it blocks
+// until the job reaches a terminal state or wait elapses.
+func (g *Gojinn) GetJob(ctx context.Context, tenantID, jobID string, wait time.Duration) (*JobRecord, error) {
+	if g.js == nil {
+		return nil, fmt.Errorf("JetStream not ready")
+	}
+	kv, err := g.js.KeyValue(jobsBucket(tenantID))
+	if err != nil {
+		return nil, nats.ErrKeyNotFound
+	}
+
+	if wait <= 0 {
+		entry, err := kv.Get(jobID)
+		if err != nil {
+			return nil, err
+		}
+		var rec JobRecord
+		if err := json.Unmarshal(entry.Value(), &rec); err != nil {
+			return nil, err
+		}
+		return &rec, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	watcher, err := kv.Watch(jobID, nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	var last *JobRecord
+	for {
+		select {
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				if last == nil {
+					return nil, nats.ErrKeyNotFound
+				}
+				return last, nil
+			}
+			if entry == nil {
+				continue
+			}
+			var rec JobRecord
+			if err := json.Unmarshal(entry.Value(), &rec); err != nil {
+				continue
+			}
+			last = &rec
+			if rec.Terminal() {
+				return last, nil
+			}
+		case <-ctx.Done():
+			if last == nil {
+				return nil, nats.ErrKeyNotFound
+			}
+			return last, nil
+		}
+	}
+}
+
+// serveJobStatus implements GET /_sys/jobs/{id}[?wait=30s] and
+// DELETE /_sys/jobs/{id} for the calling tenant.
+func (g *Gojinn) serveJobStatus(rw http.ResponseWriter, req *http.Request) error {
+	tenantID, err := g.extractTenantAndHandleMiddleware(rw, req)
+	if err != nil {
+		return nil
+	}
+
+	jobID := strings.TrimPrefix(req.URL.Path, "/_sys/jobs/")
+	if jobID == "" || strings.Contains(jobID, "/") {
+		http.Error(rw, "Missing job id", http.StatusBadRequest)
+		return nil
+	}
+
+	if req.Method == http.MethodDelete {
+		return g.cancelJob(rw, tenantID, jobID)
+	}
+
+	var wait time.Duration
+	if raw := req.URL.Query().Get("wait"); raw != "" {
+		wait, err = time.ParseDuration(raw)
+		if err != nil {
+			http.Error(rw, "Invalid 'wait' parameter", http.StatusBadRequest)
+			return nil
+		}
+		if wait > maxJobWait {
+			wait = maxJobWait
+		}
+	}
+
+	rec, err := g.GetJob(req.Context(), tenantID, jobID, wait)
+	if err != nil {
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return nil
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(rec)
+}
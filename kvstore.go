@@ -0,0 +1,271 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// maxKVHistory is the deepest history JetStream keeps per key.
+	maxKVHistory = 64
+
+	defaultKVPageSize = 100
+	maxKVPageSize     = 1000
+)
+
+var errKVDenied = errors.New("kv access denied")
+
+// KVHistoryEntry is one revision of a key as returned by host_kv_history.
+type KVHistoryEntry struct {
+	Revision  uint64    `json:"revision"`
+	Operation string    `json:"operation"`
+	Value     string    `json:"value,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// KVPage is one page of host_kv_keys. Next is the cursor of the following
+// page, empty on the last one.
+type KVPage struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+// kvNamespace returns the consensus namespace of key, nil for the keys of
+// the default bucket.
+func (r *Gojinn) kvNamespace(key string) *ConsensusPolicy {
+	if i := r.consensusIndex(key); i >= 0 {
+		return &r.Consensus[i]
+	}
+	return nil
+}
+
+// stateHistory is the history depth of the bucket of namespace p, or of the
+// default bucket when p is nil: how many revisions of each key are kept.
+func (r *Gojinn) stateHistory(p *ConsensusPolicy) int {
+	depth := max(r.KVHistory, 1)
+	if p != nil && p.History > 0 {
+		depth = p.History
+	}
+	return min(depth, maxKVHistory)
+}
+
+// kvGet returns the current entry of key with its revision. A key past its
+// TTL is not found, even before the sweep deletes it.
+func (r *Gojinn) kvGet(ctx context.Context, key string) (nats.KeyValueEntry, error) {
+	if !kvAllowed(key, r.permissionsFor(ctx).KVRead) {
+		return nil, errKVDenied
+	}
+	kv, err := r.tenantKV(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := kv.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if kvExpired(kv, entry, time.Now()) {
+		return nil, nats.ErrKeyNotFound
+	}
+	return entry, nil
+}
+
+// kvPut writes value to key and returns its revision. The key expires after
+// ttl, or after the TTL of its namespace when ttl is 0.
+func (r *Gojinn) kvPut(ctx context.Context, key string, value []byte, ttl time.Duration) (uint64, error) {
+	if !kvAllowed(key, r.permissionsFor(ctx).KVWrite) {
+		return 0, errKVDenied
+	}
+	kv, err := r.tenantKV(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	rev, err := kv.Put(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return rev, r.setExpiry(kv, key, rev, ttl)
+}
+
+func (r *Gojinn) kvDelete(ctx context.Context, key string) error {
+	if !kvAllowed(key, r.permissionsFor(ctx).KVWrite) {
+		return errKVDenied
+	}
+	kv, err := r.tenantKV(ctx, key)
+	if err != nil {
+		return err
+	}
+	return kv.Delete(key)
+}
+
+// kvCAS writes value to key only if its current revision is expected, or if
+// it does not exist when expected is 0, and returns the new revision.
+func (r *Gojinn) kvCAS(ctx context.Context, key string, value []byte, expected uint64) (uint64, error) {
+	if !kvAllowed(key, r.permissionsFor(ctx).KVWrite) {
+		return 0, errKVDenied
+	}
+	kv, err := r.tenantKV(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	var rev uint64
+	if expected == 0 {
+		rev, err = kv.Create(key, value)
+		// An expired key that the sweep has not deleted yet counts as absent.
+		if errors.Is(err, nats.ErrKeyExists) {
+			if entry, getErr := kv.Get(key); getErr == nil && kvExpired(kv, entry, time.Now()) {
+				rev, err = kv.Update(key, value, entry.Revision())
+			}
+		}
+	} else {
+		rev, err = kv.Update(key, value, expected)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rev, r.setExpiry(kv, key, rev, 0)
+}
+
+// kvKeys lists up to limit readable keys starting with prefix, in order,
+// after cursor. Keys come from the bucket of their namespace, so a key left
+// in another bucket by an earlier configuration is not listed.
+func (r *Gojinn) kvKeys(ctx context.Context, prefix, cursor string, limit int) (KVPage, error) {
+	page := KVPage{Keys: []string{}}
+	state, err := r.tenantState(ctx)
+	if err != nil {
+		return page, err
+	}
+	if limit <= 0 {
+		limit = defaultKVPageSize
+	}
+	limit = min(limit, maxKVPageSize)
+
+	readable := r.permissionsFor(ctx).KVRead
+	now := time.Now()
+	var keys []string
+	for _, kv := range state.bucketsFor(r, prefix) {
+		live, err := liveKeys(kv, keyFilter(prefix), now)
+		if err != nil {
+			return page, err
+		}
+		for _, key := range live {
+			if strings.HasPrefix(key, prefix) && key > cursor && kvAllowed(key, readable) && state.forKey(r, key) == kv {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+		page.Next = keys[limit-1]
+	}
+	page.Keys = append(page.Keys, keys...)
+	return page, nil
+}
+
+// keyFilter is the narrowest subject filter covering the keys starting with
+// prefix: its whole tokens followed by >.
+func keyFilter(prefix string) string {
+	filter := ">"
+	if i := strings.LastIndex(prefix, "."); i >= 0 {
+		filter = prefix[:i+1] + ">"
+	}
+	if !validKeyPattern(filter) {
+		return ">"
+	}
+	return filter
+}
+
+// liveKeys returns the keys of kv matching filter, leaving out those past
+// their TTL like kvExpired does. It reads the expiry index once instead of
+// once per key.
+func liveKeys(kv nats.KeyValue, filter string, now time.Time) ([]string, error) {
+	expired := make(map[string]uint64)
+	index, err := kv.Watch(kvExpiryPrefix+filter, nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	for entry := range index.Updates() {
+		if entry == nil {
+			break
+		}
+		if deadline, rev, ok := parseExpiry(entry.Value()); ok && now.UnixMilli() >= deadline {
+			expired[strings.TrimPrefix(entry.Key(), kvExpiryPrefix)] = rev
+		}
+	}
+	_ = index.Stop()
+
+	watcher, err := kv.Watch(filter, nats.IgnoreDeletes(), nats.MetaOnly())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = watcher.Stop() }()
+	var keys []string
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		if rev, ok := expired[entry.Key()]; ok && rev == entry.Revision() {
+			continue
+		}
+		keys = append(keys, entry.Key())
+	}
+	return keys, nil
+}
+
+// encode marshals the page, dropping trailing keys until it fits in size
+// bytes. The dropped keys are left for the next page.
+func (p KVPage) encode(size int) ([]byte, error) {
+	for {
+		data, err := json.Marshal(p)
+		if err != nil || len(data) <= size {
+			return data, err
+		}
+		if len(p.Keys) == 0 {
+			return nil, fmt.Errorf("kv page does not fit in %d bytes", size)
+		}
+		p.Keys = p.Keys[:len(p.Keys)-1]
+		p.Next = ""
+		if len(p.Keys) > 0 {
+			p.Next = p.Keys[len(p.Keys)-1]
+		}
+	}
+}
+
+// kvHistory returns the visible revisions of key, oldest first.
+func (r *Gojinn) kvHistory(ctx context.Context, key string) ([]KVHistoryEntry, error) {
+	if !kvAllowed(key, r.permissionsFor(ctx).KVRead) {
+		return nil, errKVDenied
+	}
+	kv, err := r.tenantKV(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := kv.History(key)
+	if err != nil {
+		return nil, err
+	}
+	if depth := r.stateHistory(r.kvNamespace(key)); len(entries) > depth {
+		entries = entries[len(entries)-depth:]
+	}
+
+	history := make([]KVHistoryEntry, 0, len(entries))
+	for _, e := range entries {
+		op := "put"
+		switch e.Operation() {
+		case nats.KeyValueDelete:
+			op = "delete"
+		case nats.KeyValuePurge:
+			op = "purge"
+		}
+		history = append(history, KVHistoryEntry{Revision: e.Revision(), Operation: op, Value: string(e.Value()), Created: e.Created()})
+	}
+	return history, nil
+}
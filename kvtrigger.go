@@ -0,0 +1,272 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+const (
+	// kvTriggerConsumerPrefix starts the names of the durable consumers
+	// following the STATE buckets for on_kv_change triggers.
+	kvTriggerConsumerPrefix = "KVCHANGES_"
+
+	// kvTriggerRetryDelay is how long a change whose job could not be queued
+	// waits before it is delivered again.
+	kvTriggerRetryDelay = 5 * time.Second
+)
+
+// KVChange describes the change to a key that triggered a job. Binary values
+// are base64 encoded, both here and in the request body.
+type KVChange struct {
+	Key           string `json:"key"`
+	Operation     string `json:"operation"`
+	Revision      uint64 `json:"revision"`
+	Value         string `json:"value,omitempty"`
+	ValueEncoding string `json:"value_encoding,omitempty"`
+}
+
+// kvTrigger turns the changes to the keys matching one on_kv_change pattern
+// into jobs of its function, on the tenant whose bucket changed.
+type kvTrigger struct {
+	r   *Gojinn
+	cfg KVTrigger
+	fn  *functionSpec
+}
+
+func (t *kvTrigger) poolKey(bucket string) string {
+	return "kv-watch:" + t.fn.Key + ":" + bucket
+}
+
+// consumer names the durable consumer following a bucket of tenantID. The
+// tenant comes last so it can be read back from the name at startup.
+func (t *kvTrigger) consumer(tenantID string) string {
+	return kvTriggerConsumerPrefix + t.fn.Key[:12] + "_" + tenantID
+}
+
+// validKeyPattern reports whether p is a NATS subject pattern that may select
+// guest keys: dot-separated tokens, where * and > are whole tokens and >
+// only comes last.
+func validKeyPattern(p string) bool {
+	if strings.HasPrefix(p, kvReservedPrefix) {
+		return false
+	}
+	tokens := strings.Split(p, ".")
+	for i, tok := range tokens {
+		if tok == "" || strings.ContainsAny(tok, " \t\r\n") {
+			return false
+		}
+		if strings.ContainsAny(tok, "*>") && len(tok) > 1 {
+			return false
+		}
+		if tok == ">" && i != len(tokens)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Gojinn) kvTriggerFunction(t KVTrigger) *functionSpec {
+	fn := r.defaultFunction()
+	fn.Name = "kv:" + t.Keys
+	fn.Key = hashString("kv|" + t.Keys + "|" + t.WasmFile)
+	fn.WasmFile = t.WasmFile
+	fn.Mode = ModeAsync
+	return fn
+}
+
+// setupKVTriggers checks the on_kv_change modules and resumes following the
+// tenants with changes left undelivered when the cluster last stopped.
+func (r *Gojinn) setupKVTriggers() error {
+	if len(r.KVTriggers) == 0 {
+		return nil
+	}
+	for _, cfg := range r.KVTriggers {
+		if _, err := r.loadWasmSecurely(cfg.WasmFile); err != nil {
+			return fmt.Errorf("kv trigger security check failed for %s: %w", cfg.WasmFile, err)
+		}
+		r.kvTriggers = append(r.kvTriggers, &kvTrigger{r: r, cfg: cfg, fn: r.kvTriggerFunction(cfg)})
+		r.logger.Info("KV trigger registered", zap.String("keys", cfg.Keys), zap.String("wasm", cfg.WasmFile))
+	}
+
+	for _, tenantID := range r.kvBacklogTenants() {
+		if err := r.watchKVChanges(tenantID); err != nil {
+			r.logger.Warn("Failed to resume KV triggers", zap.String("tenant", tenantID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// kvBacklogTenants lists the tenants with changes waiting on the consumer of
+// a configured trigger.
+func (r *Gojinn) kvBacklogTenants() []string {
+	configured := make(map[string]bool)
+	for _, t := range r.kvTriggers {
+		configured[t.fn.Key[:12]] = true
+	}
+
+	seen := make(map[string]bool)
+	var tenants []string
+	for stream := range r.js.StreamNames() {
+		if !strings.HasPrefix(stream, "KV_STATE_") {
+			continue
+		}
+		for info := range r.js.Consumers(stream) {
+			rest, ok := strings.CutPrefix(info.Name, kvTriggerConsumerPrefix)
+			if !ok || len(rest) < 14 || !configured[rest[:12]] {
+				continue
+			}
+			tenantID := rest[13:]
+			if !seen[tenantID] && (info.NumPending > 0 || info.NumAckPending > 0) {
+				seen[tenantID] = true
+				tenants = append(tenants, tenantID)
+			}
+		}
+	}
+	return tenants
+}
+
+// watchKVChanges follows the STATE buckets of tenantID for every
+// on_kv_change trigger. Each trigger has one durable consumer per bucket,
+// shared by the nodes serving the tenant, so a change is handled once by the
+// cluster and the changes made while no node follows the bucket are kept for
+// later. Namespace buckets the tenant has not used yet are left out.
+func (r *Gojinn) watchKVChanges(tenantID string) error {
+	if len(r.kvTriggers) == 0 {
+		return nil
+	}
+	r.subsMu.Lock()
+	defer r.subsMu.Unlock()
+
+	r.admitTenant(tenantID)
+	for _, bucket := range r.stateBucketNames(tenantID) {
+		if _, err := r.js.StreamInfo("KV_" + bucket); errors.Is(err, nats.ErrStreamNotFound) {
+			continue
+		}
+		for _, t := range r.kvTriggers {
+			if _, exists := r.tenantSubs[tenantID][t.poolKey(bucket)]; exists {
+				continue
+			}
+			pool := newWorkerPool(tenantID, t.poolKey(bucket), "kv-watch:"+t.cfg.Keys, "KV_"+bucket, t.consumer(tenantID), &functionSpec{PoolSize: 1})
+			pool.start = func(int) (*nats.Subscription, error) {
+				return t.subscribe(tenantID, bucket)
+			}
+			if pool.grow(1, r.logger) == 0 {
+				return fmt.Errorf("failed to follow kv changes of %s for tenant %s", t.cfg.Keys, tenantID)
+			}
+			r.addWorkerPool(pool)
+		}
+	}
+	return nil
+}
+
+// subscribe joins this node to the consumer following a bucket of tenantID,
+// creating it on first use. The consumer is created here rather than by the
+// subscription, which would delete it when the tenant is evicted.
+func (t *kvTrigger) subscribe(tenantID, bucket string) (*nats.Subscription, error) {
+	stream, consumer := "KV_"+bucket, t.consumer(tenantID)
+	subject := "$KV." + bucket + "." + t.cfg.Keys
+
+	if _, err := t.r.js.ConsumerInfo(stream, consumer); errors.Is(err, nats.ErrConsumerNotFound) {
+		_, err = t.r.js.AddConsumer(stream, &nats.ConsumerConfig{
+			Durable:        consumer,
+			Description:    "on_kv_change " + t.cfg.Keys,
+			DeliverSubject: nats.NewInbox(),
+			DeliverGroup:   consumer,
+			DeliverPolicy:  nats.DeliverNewPolicy,
+			AckPolicy:      nats.AckExplicitPolicy,
+			MaxDeliver:     -1,
+			FilterSubject:  subject,
+		})
+		if err != nil && !errors.Is(err, nats.ErrConsumerNameAlreadyInUse) {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return t.r.js.QueueSubscribe(subject, consumer, func(m *nats.Msg) {
+		t.handle(tenantID, bucket, m)
+	}, nats.Bind(stream, consumer), nats.ManualAck())
+}
+
+// handle queues the job for one change. The message ID derived from the
+// bucket and revision keeps a redelivered change from queueing a second job.
+func (t *kvTrigger) handle(tenantID, bucket string, m *nats.Msg) {
+	r := t.r
+	meta, err := m.Metadata()
+	if err != nil {
+		r.logger.Error("Failed to get msg metadata", zap.Error(err))
+		_ = m.Nak()
+		return
+	}
+	key := strings.TrimPrefix(m.Subject, "$KV."+bucket+".")
+	if strings.HasPrefix(key, kvReservedPrefix) {
+		_ = m.Ack()
+		return
+	}
+
+	ctx, span := otel.Tracer("gojinn-kv").Start(context.Background(), "kv_trigger")
+	defer span.End()
+	span.SetAttributes(attribute.String("kv.key", key))
+
+	change := kvChange(key, m, meta.Sequence.Stream)
+	msgID := fmt.Sprintf("kv:%s:%s:%d", t.fn.Key[:12], bucket, change.Revision)
+	pubAck, err := r.enqueueFunctionJob(ctx, tenantID, t.fn, kvJobRequest(change), nats.MsgId(msgID))
+	if err != nil {
+		r.logger.Error("Failed to queue KV change job", zap.String("key", key), zap.String("tenant", tenantID), zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "enqueue failed")
+		_ = m.NakWithDelay(kvTriggerRetryDelay)
+		return
+	}
+	_ = m.Ack()
+
+	r.logger.Info("KV Change Job Persisted & Queued",
+		zap.String("key", key),
+		zap.String("operation", change.Operation),
+		zap.Uint64("revision", change.Revision),
+		zap.String("tenant", tenantID),
+		zap.String("job_id", strconv.FormatUint(pubAck.Sequence, 10)),
+		zap.String("trace_id", span.SpanContext().TraceID().String()),
+	)
+}
+
+func kvChange(key string, m *nats.Msg, revision uint64) *KVChange {
+	change := &KVChange{Key: key, Operation: "put", Revision: revision}
+	switch m.Header.Get("KV-Operation") {
+	case "DEL":
+		change.Operation = "delete"
+	case "PURGE":
+		change.Operation = "purge"
+	default:
+		if utf8.Valid(m.Data) {
+			change.Value = string(m.Data)
+		} else {
+			change.Value = base64.StdEncoding.EncodeToString(m.Data)
+			change.ValueEncoding = "base64"
+		}
+	}
+	return change
+}
+
+func kvJobRequest(c *KVChange) JobRequest {
+	return JobRequest{
+		Method:  "KV",
+		URI:     "kv://" + c.Key,
+		Headers: map[string][]string{"X-Source": {"kv"}},
+		Body:    c.Value,
+		KV:      c,
+	}
+}
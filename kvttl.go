@@ -0,0 +1,196 @@
+package gojinn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	// kvExpiryPrefix holds the expiry index of a STATE bucket: for every key
+	// with a TTL, its deadline and the revision the deadline applies to.
+	// Functions cannot read or write keys under kvReservedPrefix.
+	kvReservedPrefix = "_gojinn."
+	kvExpiryPrefix   = kvReservedPrefix + "ttl."
+
+	// kvAuditPrefix holds the signed audit records of the jobs of a tenant,
+	// kept out of reach of functions and of on_kv_change triggers.
+	kvAuditPrefix = kvReservedPrefix + "audit.job."
+
+	// kvSweepInterval is how often expired keys are deleted.
+	kvSweepInterval = 15 * time.Second
+
+	// kvCompactInterval is how often the delete markers left by expired and
+	// deleted keys are compacted away, once they are older than 30 minutes.
+	kvCompactInterval = 10 * time.Minute
+
+	// kvCompactLease is held by the node compacting the buckets, in the
+	// STATE bucket of the system tenant. It runs out before the next round
+	// so any node can take the following one.
+	kvCompactLease = mutexPrefix + "compact"
+)
+
+// kvAllowed checks a guest KV key against a permission list. Keys reserved
+// for the host are never allowed.
+func kvAllowed(key string, allowedList []string) bool {
+	return !strings.HasPrefix(key, kvReservedPrefix) && isAllowed(key, allowedList)
+}
+
+// kvTTL is the default TTL of key: the one of its consensus namespace, or
+// kv_ttl.
+func (r *Gojinn) kvTTL(key string) time.Duration {
+	if ns := r.kvNamespace(key); ns != nil && ns.TTL > 0 {
+		return time.Duration(ns.TTL)
+	}
+	return time.Duration(r.KVTTL)
+}
+
+// setExpiry records that revision rev of key expires after ttl, or after its
+// default TTL when ttl is 0. A later write makes the record stale, so a key
+// rewritten without a TTL does not expire.
+func (r *Gojinn) setExpiry(kv nats.KeyValue, key string, rev uint64, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = r.kvTTL(key)
+	}
+	if ttl <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(ttl).UnixMilli()
+	_, err := kv.PutString(kvExpiryPrefix+key, fmt.Sprintf("%d:%d", deadline, rev))
+	return err
+}
+
+func parseExpiry(value []byte) (deadline int64, rev uint64, ok bool) {
+	_, err := fmt.Sscanf(string(value), "%d:%d", &deadline, &rev)
+	return deadline, rev, err == nil
+}
+
+// kvExpired reports whether entry is a revision past its TTL.
+func kvExpired(kv nats.KeyValue, entry nats.KeyValueEntry, now time.Time) bool {
+	idx, err := kv.Get(kvExpiryPrefix + entry.Key())
+	if err != nil {
+		return false
+	}
+	deadline, rev, ok := parseExpiry(idx.Value())
+	return ok && rev == entry.Revision() && now.UnixMilli() >= deadline
+}
+
+// setupKVSweeper starts the loop deleting expired keys from the STATE buckets
+// of every tenant.
+func (r *Gojinn) setupKVSweeper() {
+	r.kvSweepStop = make(chan struct{})
+	go func() {
+		sweep := time.NewTicker(kvSweepInterval)
+		defer sweep.Stop()
+		compact := time.NewTicker(kvCompactInterval)
+		defer compact.Stop()
+		for {
+			select {
+			case now := <-sweep.C:
+				r.sweepKV(now)
+			case now := <-compact.C:
+				r.compactKV(now)
+			case <-r.kvSweepStop:
+				return
+			}
+		}
+	}()
+}
+
+// sweepKV deletes the keys past their TTL and returns how many it deleted. It
+// walks the buckets of every tenant, not only those this node serves, so keys
+// expire while their tenant is idle. Deletes are conditional on the expiring
+// revision, so a key rewritten in the meantime survives and nodes sweeping
+// the same bucket count each key once.
+func (r *Gojinn) sweepKV(now time.Time) int {
+	expired := 0
+	for _, kv := range r.stateKVs() {
+		expired += r.sweepBucket(kv, now)
+	}
+	return expired
+}
+
+// stateKVs opens every STATE bucket of the cluster, namespace buckets
+// included.
+func (r *Gojinn) stateKVs() []nats.KeyValue {
+	var buckets []nats.KeyValue
+	for name := range r.js.KeyValueStoreNames() {
+		if !strings.HasPrefix(name, "STATE_") {
+			continue
+		}
+		if kv, err := r.js.KeyValue(name); err == nil {
+			buckets = append(buckets, kv)
+		}
+	}
+	return buckets
+}
+
+func (r *Gojinn) sweepBucket(kv nats.KeyValue, now time.Time) int {
+	expired := 0
+	watcher, err := kv.Watch(kvExpiryPrefix+">", nats.IgnoreDeletes())
+	if err != nil {
+		return 0
+	}
+	var due []nats.KeyValueEntry
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		if deadline, _, ok := parseExpiry(entry.Value()); !ok || now.UnixMilli() >= deadline {
+			due = append(due, entry)
+		}
+	}
+	_ = watcher.Stop()
+
+	for _, idx := range due {
+		key := strings.TrimPrefix(idx.Key(), kvExpiryPrefix)
+		if _, rev, ok := parseExpiry(idx.Value()); ok {
+			if err := kv.Delete(key, nats.LastRevision(rev)); err == nil {
+				expired++
+				if r.metrics != nil {
+					r.metrics.kvExpired.WithLabelValues(r.kvNamespaceLabel(key)).Inc()
+				}
+			}
+		}
+		_ = kv.Purge(idx.Key(), nats.LastRevision(idx.Revision()))
+	}
+	if len(due) > 0 {
+		r.logger.Debug("KV Sweep", zap.String("bucket", kv.Bucket()), zap.Int("due", len(due)))
+	}
+	return expired
+}
+
+// compactKV drops the delete markers of the STATE buckets, with the history
+// of the keys they ended. Only the node holding the compaction lease for this
+// round does it, and it reports whether it did.
+func (r *Gojinn) compactKV(now time.Time) bool {
+	lease, err := r.EnsureTenantResources(DefaultTriggerTenant)
+	if err != nil {
+		r.logger.Warn("KV compaction skipped", zap.Error(err))
+		return false
+	}
+	if _, _, err := tryLock(lease, kvCompactLease, kvCompactInterval-kvSweepInterval, now); err != nil {
+		if !errors.Is(err, errMutexHeld) {
+			r.logger.Warn("KV compaction skipped", zap.Error(err))
+		}
+		return false
+	}
+
+	for _, kv := range r.stateKVs() {
+		if err := kv.PurgeDeletes(); err != nil {
+			r.logger.Warn("KV compaction failed", zap.String("bucket", kv.Bucket()), zap.Error(err))
+		}
+	}
+	return true
+}
+
+func (r *Gojinn) kvNamespaceLabel(key string) string {
+	if ns := r.kvNamespace(key); ns != nil {
+		return ns.Namespace
+	}
+	return "default"
+}
@@ -12,6 +12,14 @@ type gojinnMetrics struct {
 	active     *prometheus.GaugeVec
 	queueDepth *prometheus.GaugeVec
 	jobsTotal  *prometheus.CounterVec
+
+	fuelExhausted *prometheus.CounterVec
+	deadLettered  *prometheus.CounterVec
+
+	poolWorkers *prometheus.GaugeVec
+	poolScaling *prometheus.CounterVec
+
+	kvExpired *prometheus.CounterVec
 }
 
 func (r *Gojinn) setupMetrics(ctx caddy.Context) error {
@@ -79,5 +87,80 @@ func (r *Gojinn) setupMetrics(ctx caddy.Context) error {
 		r.metrics.jobsTotal = jobsTotal
 	}
 
+	fuelExhausted := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gojinn_fuel_exhausted_total",
+		Help: "Total number of invocations trapped for spending their whole fuel_limit",
+	}, []string{"function"})
+
+	if err := registry.Register(fuelExhausted); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.fuelExhausted = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return fmt.Errorf("failed to register fuelExhausted metric: %v", err)
+		}
+	} else {
+		r.metrics.fuelExhausted = fuelExhausted
+	}
+
+	deadLettered := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gojinn_dead_lettered_total",
+		Help: "Total number of jobs moved to a tenant dead-letter queue",
+	}, []string{"function"})
+
+	if err := registry.Register(deadLettered); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.deadLettered = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return fmt.Errorf("failed to register deadLettered metric: %v", err)
+		}
+	} else {
+		r.metrics.deadLettered = deadLettered
+	}
+
+	poolWorkers := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gojinn_pool_workers",
+		Help: "Number of workers currently serving a tenant function on this node",
+	}, []string{"tenant", "function"})
+
+	if err := registry.Register(poolWorkers); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.poolWorkers = are.ExistingCollector.(*prometheus.GaugeVec)
+		} else {
+			return fmt.Errorf("failed to register poolWorkers metric: %v", err)
+		}
+	} else {
+		r.metrics.poolWorkers = poolWorkers
+	}
+
+	poolScaling := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gojinn_pool_scaling_total",
+		Help: "Total number of workers added to or removed from a pool by the autoscaler",
+	}, []string{"tenant", "function", "direction"})
+
+	if err := registry.Register(poolScaling); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.poolScaling = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return fmt.Errorf("failed to register poolScaling metric: %v", err)
+		}
+	} else {
+		r.metrics.poolScaling = poolScaling
+	}
+
+	kvExpired := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gojinn_kv_expired_total",
+		Help: "Total number of tenant KV keys deleted for outliving their TTL",
+	}, []string{"namespace"})
+
+	if err := registry.Register(kvExpired); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.metrics.kvExpired = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return fmt.Errorf("failed to register kvExpired metric: %v", err)
+		}
+	} else {
+		r.metrics.kvExpired = kvExpired
+	}
+
 	return nil
 }
@@ -0,0 +1,204 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+// mqttEnqueueRetry paces the attempts at queueing the job of a message,
+// about 4 seconds in all.
+var mqttEnqueueRetry = RetryPolicy{
+	Max:     5,
+	Backoff: BackoffExponential,
+	Initial: caddy.Duration(250 * time.Millisecond),
+}
+
+// MQTTMessage describes the message that triggered a job. Binary payloads
+// are base64 encoded, both here and in the request body.
+type MQTTMessage struct {
+	Topic           string `json:"topic"`
+	Payload         string `json:"payload"`
+	PayloadEncoding string `json:"payload_encoding,omitempty"`
+	QoS             byte   `json:"qos"`
+	Retained        bool   `json:"retained"`
+	Duplicate       bool   `json:"duplicate,omitempty"`
+	MessageID       uint16 `json:"message_id,omitempty"`
+}
+
+// mqttTrigger turns the messages of one subscription into jobs.
+type mqttTrigger struct {
+	r   *Gojinn
+	sub MQTTSub
+	fn  *functionSpec
+}
+
+// tenant resolves the tenant owning a message received on topic.
+func (t *mqttTrigger) tenant(topic string) (string, error) {
+	if t.sub.TenantSegment == 0 {
+		if t.sub.Tenant != "" {
+			return t.sub.Tenant, nil
+		}
+		return DefaultTriggerTenant, nil
+	}
+
+	levels := strings.Split(topic, "/")
+	if t.sub.TenantSegment > len(levels) {
+		return "", fmt.Errorf("topic %q has no level %d", topic, t.sub.TenantSegment)
+	}
+	tenantID := levels[t.sub.TenantSegment-1]
+	if !tenantIDPattern.MatchString(tenantID) {
+		return "", fmt.Errorf("topic level %q is not a valid tenant id", tenantID)
+	}
+	return tenantID, nil
+}
+
+func (r *Gojinn) mqttFunction(sub MQTTSub) *functionSpec {
+	fn := r.defaultFunction()
+	fn.Name = "mqtt:" + sub.Topic
+	fn.Key = hashString("mqtt|" + sub.Topic + "|" + sub.WasmFile)
+	fn.WasmFile = sub.WasmFile
+	fn.Mode = ModeAsync
+	return fn
+}
+
+func (r *Gojinn) setupMQTT() error {
+	if r.MQTTBroker == "" {
+		return nil
+	}
+
+	var triggers []*mqttTrigger
+	for _, sub := range r.MQTTSubs {
+		if _, err := r.loadWasmSecurely(sub.WasmFile); err != nil {
+			return fmt.Errorf("mqtt handler security check failed for %s: %w", sub.WasmFile, err)
+		}
+		triggers = append(triggers, &mqttTrigger{r: r, sub: sub, fn: r.mqttFunction(sub)})
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(r.MQTTBroker)
+	// A persistent session keeps the subscriptions and the unacknowledged
+	// QoS 1 and 2 messages on the broker across reconnects. It needs a client
+	// ID that stays the same from one connection to the next.
+	if r.MQTTClientID != "" {
+		opts.SetClientID(r.MQTTClientID)
+		opts.SetCleanSession(false)
+		opts.SetResumeSubs(true)
+	} else {
+		r.logger.Warn("MQTT without mqtt_client_id uses a clean session: messages that fail to queue are lost")
+	}
+	if r.MQTTUsername != "" {
+		opts.SetUsername(r.MQTTUsername)
+	}
+	if r.MQTTPassword != "" {
+		opts.SetPassword(r.MQTTPassword)
+	}
+	// Messages are only acknowledged to the broker once JetStream has
+	// persisted the job, so QoS 1 and 2 deliveries survive a crash in between.
+	opts.SetAutoAckDisabled(true)
+	opts.SetOrderMatters(false)
+
+	opts.OnConnect = func(c mqtt.Client) {
+		r.logger.Info("MQTT Connected", zap.String("broker", r.MQTTBroker))
+		for _, t := range triggers {
+			token := c.Subscribe(t.sub.Topic, t.sub.QoS, t.handle)
+			if token.Wait() && token.Error() != nil {
+				r.logger.Error("MQTT Subscribe Error", zap.String("topic", t.sub.Topic), zap.Error(token.Error()))
+			} else {
+				r.logger.Info("MQTT Subscribed", zap.String("topic", t.sub.Topic), zap.Uint8("qos", t.sub.QoS))
+			}
+		}
+	}
+	opts.OnConnectionLost = func(c mqtt.Client, err error) {
+		r.logger.Warn("MQTT Connection Lost", zap.Error(err))
+	}
+	r.mqttClient = mqtt.NewClient(opts)
+	if token := r.mqttClient.Connect(); token.Wait() && token.Error() != nil {
+		r.logger.Error("MQTT Initial Connect Failed", zap.Error(token.Error()))
+	}
+	return nil
+}
+
+func (t *mqttTrigger) handle(_ mqtt.Client, msg mqtt.Message) {
+	r := t.r
+	ctx, span := otel.Tracer("gojinn-mqtt").Start(context.Background(), "mqtt_trigger")
+	defer span.End()
+	span.SetAttributes(attribute.String("mqtt.topic", msg.Topic()))
+
+	tenantID, err := t.tenant(msg.Topic())
+	if err != nil {
+		// Redelivery would resolve the same topic again, so drop the message.
+		r.logger.Warn("Dropping MQTT message", zap.String("topic", msg.Topic()), zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "tenant resolution failed")
+		msg.Ack()
+		return
+	}
+
+	// The broker only redelivers an unacknowledged message after a
+	// reconnect, so a failed enqueue is retried here. The message ID keeps a
+	// publish that succeeded without an answer from queueing a second job.
+	msgID := nats.MsgId("mqtt:" + nuid.Next())
+	var pubAck *nats.PubAck
+	for attempt := uint64(1); ; attempt++ {
+		pubAck, err = r.enqueueFunctionJob(ctx, tenantID, t.fn, mqttJobRequest(msg), msgID)
+		if err == nil || attempt >= uint64(mqttEnqueueRetry.Max) {
+			break
+		}
+		r.logger.Warn("Retrying MQTT job enqueue", zap.String("topic", msg.Topic()), zap.String("tenant", tenantID), zap.Uint64("attempt", attempt), zap.Error(err))
+		time.Sleep(mqttEnqueueRetry.delay(attempt))
+	}
+	if err != nil {
+		// Left unacknowledged, the message comes back only if the client
+		// reconnects in a persistent session.
+		r.logger.Error("Failed to queue MQTT job, message dropped", zap.String("topic", msg.Topic()), zap.String("tenant", tenantID), zap.Int("attempts", mqttEnqueueRetry.Max), zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "enqueue failed")
+		return
+	}
+	msg.Ack()
+
+	r.logger.Info("MQTT Job Persisted & Queued",
+		zap.String("topic", msg.Topic()),
+		zap.String("tenant", tenantID),
+		zap.String("job_id", strconv.FormatUint(pubAck.Sequence, 10)),
+		zap.String("trace_id", span.SpanContext().TraceID().String()),
+	)
+}
+
+func mqttJobRequest(msg mqtt.Message) JobRequest {
+	m := &MQTTMessage{
+		Topic:     msg.Topic(),
+		QoS:       msg.Qos(),
+		Retained:  msg.Retained(),
+		Duplicate: msg.Duplicate(),
+		MessageID: msg.MessageID(),
+	}
+	if utf8.Valid(msg.Payload()) {
+		m.Payload = string(msg.Payload())
+	} else {
+		m.Payload = base64.StdEncoding.EncodeToString(msg.Payload())
+		m.PayloadEncoding = "base64"
+	}
+
+	return JobRequest{
+		Method:  "MQTT",
+		URI:     "mqtt://" + msg.Topic(),
+		Headers: map[string][]string{"X-Source": {"mqtt"}},
+		Body:    m.Payload,
+		MQTT:    m,
+	}
+}
@@ -0,0 +1,203 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	// mutexPrefix holds the locks of a STATE bucket, out of reach of the
+	// KV host functions so a guest cannot overwrite a lease.
+	mutexPrefix = kvReservedPrefix + "mutex."
+
+	// DefaultMutexTTL is the lease of a lock taken without a TTL.
+	DefaultMutexTTL = 30 * time.Second
+	maxMutexTTL     = time.Hour
+)
+
+var (
+	errMutexHeld    = errors.New("mutex held by another owner")
+	errMutexNotHeld = errors.New("mutex not held with this token")
+)
+
+// mutexLease is the value of a lock key. The fencing token of a lease is the
+// revision of the write that acquired it, which grows with every write to the
+// bucket; renewals carry it over in Token.
+type mutexLease struct {
+	Token   uint64 `json:"token,omitempty"`
+	Expires int64  `json:"expires"`
+}
+
+func mutexTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultMutexTTL
+	}
+	return min(ttl, maxMutexTTL)
+}
+
+func readLease(entry nats.KeyValueEntry) (lease mutexLease, token uint64, ok bool) {
+	if err := json.Unmarshal(entry.Value(), &lease); err != nil {
+		return lease, 0, false
+	}
+	token = lease.Token
+	if token == 0 {
+		token = entry.Revision()
+	}
+	return lease, token, true
+}
+
+// mutexKV checks name against the write permission of the caller and returns
+// the tenant bucket of its namespace with the key holding the lock.
+func (r *Gojinn) mutexKV(ctx context.Context, name string) (nats.KeyValue, string, error) {
+	if !kvAllowed(name, r.permissionsFor(ctx).KVWrite) {
+		return nil, "", errKVDenied
+	}
+	kv, err := r.tenantKV(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return kv, mutexPrefix + name, nil
+}
+
+// lockMutex acquires the lock name for ttl and returns its fencing token.
+// While another owner holds an unexpired lease it waits up to wait for the
+// lock to be released or to expire, then gives up with errMutexHeld.
+func (r *Gojinn) lockMutex(ctx context.Context, name string, ttl, wait time.Duration) (uint64, error) {
+	kv, key, err := r.mutexKV(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	ttl = mutexTTL(ttl)
+
+	// Watch before the first attempt, so a release right after it is not
+	// missed.
+	var updates <-chan nats.KeyValueEntry
+	if wait > 0 {
+		watcher, err := kv.Watch(key, nats.UpdatesOnly(), nats.Context(ctx))
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = watcher.Stop() }()
+		updates = watcher.Updates()
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		token, expires, err := tryLock(kv, key, ttl, time.Now())
+		if !errors.Is(err, errMutexHeld) {
+			return token, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, errMutexHeld
+		}
+
+		timer := time.NewTimer(min(remaining, max(time.Until(expires), time.Millisecond)))
+		select {
+		case <-updates:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// tryLock takes the lock at key when it is free or its lease has run out. A
+// held lock reports when its lease ends.
+func tryLock(kv nats.KeyValue, key string, ttl time.Duration, now time.Time) (uint64, time.Time, error) {
+	data, err := json.Marshal(mutexLease{Expires: now.Add(ttl).UnixMilli()})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	entry, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		rev, err := kv.Create(key, data)
+		if errors.Is(err, nats.ErrKeyExists) {
+			return 0, now, errMutexHeld
+		}
+		return rev, time.Time{}, err
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if lease, _, ok := readLease(entry); ok && now.UnixMilli() < lease.Expires {
+		return 0, time.UnixMilli(lease.Expires), errMutexHeld
+	}
+	rev, err := kv.Update(key, data, entry.Revision())
+	if errors.Is(err, nats.ErrKeyExists) {
+		return 0, now, errMutexHeld
+	}
+	return rev, time.Time{}, err
+}
+
+// renewMutex extends the lease of the lock name held with token to ttl from
+// now. It fails once another owner has taken the lock over.
+func (r *Gojinn) renewMutex(ctx context.Context, name string, token uint64, ttl time.Duration) error {
+	kv, key, err := r.mutexKV(ctx, name)
+	if err != nil {
+		return err
+	}
+	entry, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return errMutexNotHeld
+	}
+	if err != nil {
+		return err
+	}
+	if _, held, ok := readLease(entry); !ok || held != token {
+		return errMutexNotHeld
+	}
+
+	data, err := json.Marshal(mutexLease{Token: token, Expires: time.Now().Add(mutexTTL(ttl)).UnixMilli()})
+	if err != nil {
+		return err
+	}
+	_, err = kv.Update(key, data, entry.Revision())
+	if errors.Is(err, nats.ErrKeyExists) {
+		return errMutexNotHeld
+	}
+	return err
+}
+
+// unlockMutex releases the lock name if it is still held with token.
+func (r *Gojinn) unlockMutex(ctx context.Context, name string, token uint64) error {
+	kv, key, err := r.mutexKV(ctx, name)
+	if err != nil {
+		return err
+	}
+	entry, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return errMutexNotHeld
+	}
+	if err != nil {
+		return err
+	}
+	if _, held, ok := readLease(entry); !ok || held != token {
+		return errMutexNotHeld
+	}
+	err = kv.Delete(key, nats.LastRevision(entry.Revision()))
+	if errors.Is(err, nats.ErrKeyExists) {
+		return errMutexNotHeld
+	}
+	return err
+}
+
+// logMutexError logs the failures of the mutex host functions other than
+// contention, which callers expect and handle.
+func (r *Gojinn) logMutexError(msg, name string, err error) {
+	switch {
+	case errors.Is(err, errKVDenied):
+		r.logger.Warn("Security Violation: Module tried to lock unauthorized KV key", zap.String("key", name))
+	case !errors.Is(err, errMutexHeld) && !errors.Is(err, errMutexNotHeld):
+		r.logger.Warn(msg, zap.String("key", name), zap.Error(err))
+	}
+}
@@ -0,0 +1,325 @@
+// Package metering rewrites WebAssembly modules so that every instruction they
+// execute is paid for from a fuel budget held in an exported global.
+//
+// The instrumenter splits each function body into straight-line segments that
+// end at a control instruction. Every segment is prefixed with a charge of its
+// instruction count; when the budget drops below zero the module executes
+// `unreachable`. Because the cost only depends on the control flow taken, the
+// same input always consumes the same amount of fuel.
+package metering
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ExportName is the exported mutable i64 global holding the remaining fuel.
+// A negative value after a trap means the budget was exhausted.
+const ExportName = "gojinn_fuel"
+
+var ErrUnsupported = errors.New("unsupported wasm instruction")
+
+var magic = []byte{0x00, 0x61, 0x73, 0x6D}
+
+const (
+	secCustom = 0
+	secImport = 2
+	secGlobal = 6
+	secExport = 7
+	secCode   = 10
+)
+
+// sectionOrder is the position each known section must keep in a module.
+var sectionOrder = map[byte]int{
+	1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 12: 10, 10: 11, 11: 12,
+}
+
+type section struct {
+	id   byte
+	body []byte
+}
+
+// Instrument returns a metered copy of wasm. The fuel global starts at
+// math.MaxInt64 so the module's own start section runs unmetered; hosts set
+// the per-invocation budget before calling into it.
+func Instrument(wasm []byte) ([]byte, error) {
+	if len(wasm) < 8 || !bytes.Equal(wasm[:4], magic) {
+		return nil, fmt.Errorf("not a wasm module")
+	}
+
+	sections, err := splitSections(wasm[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	var importedGlobals, definedGlobals uint32
+	for _, s := range sections {
+		switch s.id {
+		case secImport:
+			if importedGlobals, err = countImportedGlobals(s.body); err != nil {
+				return nil, err
+			}
+		case secGlobal:
+			r := &reader{b: s.body}
+			if definedGlobals, err = r.u32(); err != nil {
+				return nil, err
+			}
+		case secExport:
+			if exports(s.body, ExportName) {
+				return nil, fmt.Errorf("module already exports %q", ExportName)
+			}
+		}
+	}
+	fuel := importedGlobals + definedGlobals
+
+	out := bytes.NewBuffer(make([]byte, 0, len(wasm)+len(wasm)/2))
+	out.Write(wasm[:8])
+
+	globalDone, exportDone := false, false
+	for _, s := range sections {
+		if s.id != secCustom {
+			if !globalDone && sectionOrder[s.id] > sectionOrder[secGlobal] {
+				writeSection(out, secGlobal, appendFuelGlobal(nil))
+				globalDone = true
+			}
+			if !exportDone && sectionOrder[s.id] > sectionOrder[secExport] {
+				writeSection(out, secExport, appendFuelExport(nil, fuel))
+				exportDone = true
+			}
+		}
+
+		body := s.body
+		switch s.id {
+		case secGlobal:
+			body = appendFuelGlobal(s.body)
+			globalDone = true
+		case secExport:
+			body = appendFuelExport(s.body, fuel)
+			exportDone = true
+		case secCode:
+			if body, err = instrumentCode(s.body, fuel); err != nil {
+				return nil, err
+			}
+		}
+		writeSection(out, s.id, body)
+	}
+
+	if !globalDone {
+		writeSection(out, secGlobal, appendFuelGlobal(nil))
+	}
+	if !exportDone {
+		writeSection(out, secExport, appendFuelExport(nil, fuel))
+	}
+	return out.Bytes(), nil
+}
+
+func splitSections(b []byte) ([]section, error) {
+	r := &reader{b: b}
+	var sections []section
+	for !r.done() {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		body, err := r.bytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, section{id: id, body: body})
+	}
+	return sections, nil
+}
+
+func writeSection(out *bytes.Buffer, id byte, body []byte) {
+	out.WriteByte(id)
+	out.Write(appendU32(nil, uint32(len(body)))) //nolint:gosec
+	out.Write(body)
+}
+
+func countImportedGlobals(body []byte) (uint32, error) {
+	r := &reader{b: body}
+	count, err := r.u32()
+	if err != nil {
+		return 0, err
+	}
+
+	var globals uint32
+	for i := uint32(0); i < count; i++ {
+		for j := 0; j < 2; j++ { // module and field names
+			if err := r.name(); err != nil {
+				return 0, err
+			}
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		switch kind {
+		case 0x00: // func
+			_, err = r.u32()
+		case 0x01: // table
+			if _, err = r.byte(); err == nil {
+				err = r.limits()
+			}
+		case 0x02: // memory
+			err = r.limits()
+		case 0x03: // global
+			globals++
+			_, err = r.bytes(2)
+		default:
+			err = fmt.Errorf("%w: import kind 0x%02x", ErrUnsupported, kind)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return globals, nil
+}
+
+func exports(body []byte, name string) bool {
+	r := &reader{b: body}
+	count, err := r.u32()
+	if err != nil {
+		return false
+	}
+	for i := uint32(0); i < count; i++ {
+		n, err := r.u32()
+		if err != nil {
+			return false
+		}
+		field, err := r.bytes(int(n))
+		if err != nil {
+			return false
+		}
+		if string(field) == name {
+			return true
+		}
+		if _, err := r.bytes(1); err != nil {
+			return false
+		}
+		if _, err := r.u32(); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+func appendFuelGlobal(body []byte) []byte {
+	var count uint32
+	rest := body
+	if body != nil {
+		r := &reader{b: body}
+		count, _ = r.u32()
+		rest = body[r.pos:]
+	}
+
+	out := appendU32(nil, count+1)
+	out = append(out, rest...)
+	out = append(out, 0x7E, 0x01, 0x42) // mut i64, i64.const
+	out = appendS64(out, math.MaxInt64)
+	return append(out, 0x0B)
+}
+
+func appendFuelExport(body []byte, global uint32) []byte {
+	var count uint32
+	rest := body
+	if body != nil {
+		r := &reader{b: body}
+		count, _ = r.u32()
+		rest = body[r.pos:]
+	}
+
+	out := appendU32(nil, count+1)
+	out = append(out, rest...)
+	out = appendU32(out, uint32(len(ExportName)))
+	out = append(out, ExportName...)
+	out = append(out, 0x03)
+	return appendU32(out, global)
+}
+
+func instrumentCode(body []byte, fuel uint32) ([]byte, error) {
+	r := &reader{b: body}
+	count, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+
+	out := appendU32(make([]byte, 0, len(body)*2), count)
+	for i := uint32(0); i < count; i++ {
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		fn, err := r.bytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+
+		metered, err := instrumentFunction(fn, fuel)
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %w", i, err)
+		}
+		out = appendU32(out, uint32(len(metered))) //nolint:gosec
+		out = append(out, metered...)
+	}
+	return out, nil
+}
+
+func instrumentFunction(fn []byte, fuel uint32) ([]byte, error) {
+	r := &reader{b: fn}
+	groups, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < groups; i++ {
+		if _, err := r.u32(); err != nil {
+			return nil, err
+		}
+		if _, err := r.byte(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := append(make([]byte, 0, len(fn)*2), fn[:r.pos]...)
+
+	segment, cost := r.pos, int64(0)
+	for !r.done() {
+		control, err := r.instruction()
+		if err != nil {
+			return nil, err
+		}
+		cost++
+		if control {
+			out = appendCharge(out, fuel, cost)
+			out = append(out, fn[segment:r.pos]...)
+			segment, cost = r.pos, 0
+		}
+	}
+	if segment < len(fn) {
+		out = appendCharge(out, fuel, cost)
+		out = append(out, fn[segment:]...)
+	}
+	return out, nil
+}
+
+// appendCharge emits:
+//
+//	global.get $fuel; i64.const cost; i64.sub; global.set $fuel
+//	global.get $fuel; i64.const 0; i64.lt_s; if; unreachable; end
+func appendCharge(out []byte, fuel uint32, cost int64) []byte {
+	out = append(out, 0x23)
+	out = appendU32(out, fuel)
+	out = append(out, 0x42)
+	out = appendS64(out, cost)
+	out = append(out, 0x7D, 0x24)
+	out = appendU32(out, fuel)
+	out = append(out, 0x23)
+	out = appendU32(out, fuel)
+	return append(out, 0x42, 0x00, 0x53, 0x04, 0x40, 0x00, 0x0B)
+}
@@ -0,0 +1,294 @@
+package metering
+
+import (
+	"context"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Helpers assembling modules by hand, so each test states the exact bytes,
+// and therefore the exact instruction count, it meters.
+
+func vec(items ...[]byte) []byte {
+	out := appendU32(nil, uint32(len(items))) //nolint:gosec
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+func str(s string) []byte {
+	return append(appendU32(nil, uint32(len(s))), s...) //nolint:gosec
+}
+
+func sec(id byte, body []byte) []byte {
+	out := append([]byte{id}, appendU32(nil, uint32(len(body)))...) //nolint:gosec
+	return append(out, body...)
+}
+
+func module(sections ...[]byte) []byte {
+	out := []byte{0x00, 0x61, 0x73, 0x6D, 0x01, 0x00, 0x00, 0x00}
+	for _, s := range sections {
+		out = append(out, s...)
+	}
+	return out
+}
+
+// body encodes a function body without locals.
+func body(instrs ...byte) []byte {
+	b := append([]byte{0x00}, instrs...)
+	return append(appendU32(nil, uint32(len(b))), b...) //nolint:gosec
+}
+
+func export(name string, kind byte, idx uint32) []byte {
+	return appendU32(append(str(name), kind), idx)
+}
+
+var (
+	typeVoid = []byte{0x60, 0x00, 0x00}       // () -> ()
+	typeI32  = []byte{0x60, 0x01, 0x7F, 0x00} // (i32) -> ()
+)
+
+// runFunc exports function 0 as "run" from a module with one type and a
+// single function of the given body.
+func runFunc(typ []byte, code []byte) []byte {
+	return module(
+		sec(1, vec(typ)),
+		sec(3, vec([]byte{0x00})),
+		sec(7, vec(export("run", 0x00, 0))),
+		sec(10, vec(code)),
+	)
+}
+
+func instantiate(t *testing.T, rt wazero.Runtime, wasm []byte) api.Module {
+	t.Helper()
+	metered, err := Instrument(wasm)
+	require.NoError(t, err)
+	mod, err := rt.Instantiate(context.Background(), metered)
+	require.NoError(t, err)
+	return mod
+}
+
+// burn runs fn with budget units of fuel and returns the units it spent.
+func burn(t *testing.T, mod api.Module, budget int64, fn string, args ...uint64) (int64, error) {
+	t.Helper()
+	fuel, ok := mod.ExportedGlobal(ExportName).(api.MutableGlobal)
+	require.True(t, ok, "metered module must export a mutable %s", ExportName)
+	fuel.Set(api.EncodeI64(budget))
+	_, err := mod.ExportedFunction(fn).Call(context.Background(), args...)
+	return budget - int64(fuel.Get()), err //nolint:gosec
+}
+
+func TestInstrument_ExactFuel(t *testing.T) {
+	// i32.const 1; i32.const 2; i32.add; drop; end
+	wasm := runFunc(typeVoid, body(0x41, 0x01, 0x41, 0x02, 0x6A, 0x1A, 0x0B))
+	rt := wazero.NewRuntime(context.Background())
+	defer rt.Close(context.Background())
+	mod := instantiate(t, rt, wasm)
+
+	spent, err := burn(t, mod, 100, "run")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), spent)
+
+	// The same input always costs the same.
+	spent, err = burn(t, mod, 100, "run")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), spent)
+
+	// An exact budget is enough, one unit less is not.
+	_, err = burn(t, mod, 5, "run")
+	require.NoError(t, err)
+	spent, err = burn(t, mod, 4, "run")
+	require.Error(t, err)
+	assert.Equal(t, int64(5), spent)
+}
+
+func TestInstrument_Loop(t *testing.T) {
+	// loop
+	//   local.get 0; i32.const 1; i32.sub; local.tee 0; br_if 0
+	// end
+	// end
+	wasm := runFunc(typeI32, body(
+		0x03, 0x40,
+		0x20, 0x00, 0x41, 0x01, 0x6B, 0x22, 0x00, 0x0D, 0x00,
+		0x0B,
+		0x0B,
+	))
+	rt := wazero.NewRuntime(context.Background())
+	defer rt.Close(context.Background())
+	mod := instantiate(t, rt, wasm)
+
+	// loop, then five per iteration, then both ends.
+	for _, n := range []uint64{1, 2, 10, 1000} {
+		spent, err := burn(t, mod, math.MaxInt32, "run", n)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5*n+3), spent, "iterations: %d", n) //nolint:gosec
+	}
+
+	// A loop cannot outrun its budget.
+	_, err := burn(t, mod, 1000, "run", 1_000_000)
+	require.Error(t, err)
+}
+
+func TestInstrument_NestedBlocksAndBrTable(t *testing.T) {
+	// block
+	//   block
+	//     local.get 0; br_table [1 0] 0
+	//   end
+	//   nop; nop
+	// end
+	// end
+	wasm := runFunc(typeI32, body(
+		0x02, 0x40,
+		0x02, 0x40,
+		0x20, 0x00, 0x0E, 0x02, 0x01, 0x00, 0x00,
+		0x0B,
+		0x01, 0x01,
+		0x0B,
+		0x0B,
+	))
+	rt := wazero.NewRuntime(context.Background())
+	defer rt.Close(context.Background())
+	mod := instantiate(t, rt, wasm)
+
+	// Branching out of both blocks skips everything up to the function's end.
+	spent, err := burn(t, mod, 100, "run", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1+1+2+1), spent)
+
+	// Branching out of the inner block runs the nops and the outer end, but
+	// not the inner end it jumped over.
+	for _, arg := range []uint64{1, 7} {
+		spent, err = burn(t, mod, 100, "run", arg)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1+1+2+3+1), spent, "arg: %d", arg)
+	}
+}
+
+func TestInstrument_ExistingGlobalsAndExports(t *testing.T) {
+	// global 0: mut i32 = 42, bumped by run and exported as "counter".
+	wasm := module(
+		sec(1, vec(typeVoid)),
+		sec(3, vec([]byte{0x00})),
+		sec(6, vec([]byte{0x7F, 0x01, 0x41, 0x2A, 0x0B})),
+		sec(7, vec(export("run", 0x00, 0), export("counter", 0x03, 0))),
+		// global.get 0; i32.const 1; i32.add; global.set 0; end
+		sec(10, vec(body(0x23, 0x00, 0x41, 0x01, 0x6A, 0x24, 0x00, 0x0B))),
+	)
+	rt := wazero.NewRuntime(context.Background())
+	defer rt.Close(context.Background())
+	mod := instantiate(t, rt, wasm)
+
+	spent, err := burn(t, mod, 100, "run")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), spent)
+	assert.Equal(t, uint64(43), mod.ExportedGlobal("counter").Get())
+
+	_, err = Instrument(module(sec(7, vec(export(ExportName, 0x03, 0)))))
+	assert.ErrorContains(t, err, "already exports")
+}
+
+func TestInstrument_ImportedGlobalsShiftFuelIndex(t *testing.T) {
+	rt := wazero.NewRuntime(context.Background())
+	defer rt.Close(context.Background())
+
+	// env exports an immutable i32 global "g" = 7.
+	env := module(
+		sec(6, vec([]byte{0x7F, 0x00, 0x41, 0x07, 0x0B})),
+		sec(7, vec(export("g", 0x03, 0))),
+	)
+	_, err := rt.InstantiateWithConfig(context.Background(), env, wazero.NewModuleConfig().WithName("env"))
+	require.NoError(t, err)
+
+	// Global 0 is imported, global 1 defined here, so the fuel global is 2.
+	wasm := module(
+		sec(1, vec(typeVoid)),
+		sec(2, vec(append(append(str("env"), str("g")...), 0x03, 0x7F, 0x00))),
+		sec(3, vec([]byte{0x00})),
+		sec(6, vec([]byte{0x7F, 0x01, 0x41, 0x00, 0x0B})),
+		sec(7, vec(export("run", 0x00, 0), export("copy", 0x03, 1))),
+		// global.get 0; global.set 1; end
+		sec(10, vec(body(0x23, 0x00, 0x24, 0x01, 0x0B))),
+	)
+	metered, err := Instrument(wasm)
+	require.NoError(t, err)
+	sections, err := splitSections(metered[8:])
+	require.NoError(t, err)
+	for _, s := range sections {
+		if s.id == secExport {
+			assert.True(t, exports(s.body, ExportName))
+			assert.Equal(t, export(ExportName, 0x03, 2), s.body[len(s.body)-len(export(ExportName, 0x03, 2)):])
+		}
+	}
+
+	mod, err := rt.Instantiate(context.Background(), metered)
+	require.NoError(t, err)
+	spent, err := burn(t, mod, 100, "run")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), spent)
+	assert.Equal(t, uint64(7), mod.ExportedGlobal("copy").Get())
+}
+
+func TestInstrument_Malformed(t *testing.T) {
+	valid := runFunc(typeVoid, body(0x41, 0x01, 0x1A, 0x0B))
+
+	cases := map[string]struct {
+		wasm []byte
+		err  error
+	}{
+		"empty":            {wasm: nil},
+		"bad magic":        {wasm: []byte("\x00asd\x01\x00\x00\x00")},
+		"header only":      {wasm: valid[:7]},
+		"section overflow": {wasm: module([]byte{0x01, 0x10, 0x00}), err: io.ErrUnexpectedEOF},
+		"bad section size": {wasm: module([]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})},
+		"truncated body": {
+			wasm: module(sec(10, vec([]byte{0x10, 0x00, 0x41}))),
+			err:  io.ErrUnexpectedEOF,
+		},
+		"truncated immediate": {
+			wasm: runFunc(typeVoid, body(0x41)),
+			err:  io.ErrUnexpectedEOF,
+		},
+		"unknown opcode": {
+			wasm: runFunc(typeVoid, body(0xFF, 0x0B)),
+			err:  ErrUnsupported,
+		},
+		"unknown import kind": {
+			wasm: module(sec(2, vec(append(append(str("env"), str("x")...), 0x09)))),
+			err:  ErrUnsupported,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Instrument(tc.wasm)
+			require.Error(t, err)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+			}
+		})
+	}
+
+	// A module cut anywhere but between two sections fails cleanly.
+	boundaries := map[int]bool{8: true}
+	sections, err := splitSections(valid[8:])
+	require.NoError(t, err)
+	end := 8
+	for _, s := range sections {
+		end += 1 + len(appendU32(nil, uint32(len(s.body)))) + len(s.body) //nolint:gosec
+		boundaries[end] = true
+	}
+	for n := 8; n < len(valid); n++ {
+		if boundaries[n] {
+			continue
+		}
+		var err error
+		require.NotPanics(t, func() { _, err = Instrument(valid[:n]) }, "truncated at %d", n)
+		assert.Error(t, err, "truncated at %d", n)
+	}
+}
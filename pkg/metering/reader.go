@@ -0,0 +1,267 @@
+package metering
+
+import (
+	"fmt"
+	"io"
+)
+
+type reader struct {
+	b   []byte
+	pos int
+}
+
+func (r *reader) done() bool {
+	return r.pos >= len(r.b)
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.done() {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := r.b[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) u32() (uint32, error) {
+	var v uint32
+	for shift := 0; shift < 35; shift += 7 {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint32(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid LEB128 at offset %d", r.pos)
+}
+
+// leb skips a LEB128 number of any width and signedness.
+func (r *reader) leb() error {
+	for i := 0; i < 10; i++ {
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if b&0x80 == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid LEB128 at offset %d", r.pos)
+}
+
+func (r *reader) name() error {
+	n, err := r.u32()
+	if err != nil {
+		return err
+	}
+	_, err = r.bytes(int(n))
+	return err
+}
+
+func (r *reader) limits() error {
+	flags, err := r.byte()
+	if err != nil {
+		return err
+	}
+	if err := r.leb(); err != nil {
+		return err
+	}
+	if flags&0x01 != 0 {
+		return r.leb()
+	}
+	return nil
+}
+
+func (r *reader) memarg() error {
+	align, err := r.u32()
+	if err != nil {
+		return err
+	}
+	if align&0x40 != 0 { // multi-memory index
+		if err := r.leb(); err != nil {
+			return err
+		}
+	}
+	return r.leb()
+}
+
+func (r *reader) blockType() error {
+	b, err := r.byte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 0x40, 0x7F, 0x7E, 0x7D, 0x7C, 0x7B, 0x70, 0x6F:
+		return nil
+	}
+	r.pos--
+	return r.leb()
+}
+
+// instruction skips one instruction and reports whether it ends a metered
+// segment, i.e. whether it enters, leaves or branches out of a block.
+func (r *reader) instruction() (bool, error) {
+	op, err := r.byte()
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case op == 0x00, op == 0x05, op == 0x0B, op == 0x0F: // unreachable, else, end, return
+		return true, nil
+	case op == 0x02, op == 0x03, op == 0x04: // block, loop, if
+		return true, r.blockType()
+	case op == 0x0C, op == 0x0D: // br, br_if
+		return true, r.leb()
+	case op == 0x0E: // br_table
+		n, err := r.u32()
+		if err != nil {
+			return false, err
+		}
+		for i := uint32(0); i <= n; i++ {
+			if err := r.leb(); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case op == 0x12: // return_call
+		return true, r.leb()
+	case op == 0x13: // return_call_indirect
+		if err := r.leb(); err != nil {
+			return false, err
+		}
+		return true, r.leb()
+	case op == 0x01, op == 0x1A, op == 0x1B, op == 0xD1: // nop, drop, select, ref.is_null
+		return false, nil
+	case op == 0x10, op == 0xD2: // call, ref.func
+		return false, r.leb()
+	case op == 0x11: // call_indirect
+		if err := r.leb(); err != nil {
+			return false, err
+		}
+		return false, r.leb()
+	case op == 0x1C: // select t*
+		n, err := r.u32()
+		if err != nil {
+			return false, err
+		}
+		_, err = r.bytes(int(n))
+		return false, err
+	case op >= 0x20 && op <= 0x26: // local.*, global.*, table.get/set
+		return false, r.leb()
+	case op >= 0x28 && op <= 0x3E: // loads and stores
+		return false, r.memarg()
+	case op == 0x3F, op == 0x40, op == 0x41, op == 0x42: // memory.size/grow, i32/i64.const
+		return false, r.leb()
+	case op == 0x43:
+		_, err := r.bytes(4)
+		return false, err
+	case op == 0x44:
+		_, err := r.bytes(8)
+		return false, err
+	case op >= 0x45 && op <= 0xC4: // numeric
+		return false, nil
+	case op == 0xD0: // ref.null
+		_, err := r.byte()
+		return false, err
+	case op == 0xFC:
+		return false, r.miscInstruction()
+	case op == 0xFD:
+		return false, r.vectorInstruction()
+	case op == 0xFE:
+		return false, r.atomicInstruction()
+	}
+	return false, fmt.Errorf("%w: opcode 0x%02x at offset %d", ErrUnsupported, op, r.pos-1)
+}
+
+func (r *reader) miscInstruction() error {
+	sub, err := r.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case sub <= 7: // trunc_sat
+		return nil
+	case sub == 8, sub == 10, sub == 12, sub == 14: // memory.init, memory.copy, table.init, table.copy
+		if err := r.leb(); err != nil {
+			return err
+		}
+		return r.leb()
+	case sub <= 17:
+		return r.leb()
+	}
+	return fmt.Errorf("%w: 0xFC %d", ErrUnsupported, sub)
+}
+
+func (r *reader) vectorInstruction() error {
+	sub, err := r.u32()
+	if err != nil {
+		return err
+	}
+	switch {
+	case sub <= 11, sub == 92, sub == 93: // loads and stores
+		return r.memarg()
+	case sub == 12, sub == 13: // v128.const, i8x16.shuffle
+		_, err := r.bytes(16)
+		return err
+	case sub >= 21 && sub <= 34: // extract/replace lane
+		_, err := r.byte()
+		return err
+	case sub >= 84 && sub <= 91: // load/store lane
+		if err := r.memarg(); err != nil {
+			return err
+		}
+		_, err := r.byte()
+		return err
+	}
+	return nil
+}
+
+func (r *reader) atomicInstruction() error {
+	sub, err := r.u32()
+	if err != nil {
+		return err
+	}
+	if sub == 0x03 { // atomic.fence
+		_, err := r.byte()
+		return err
+	}
+	return r.memarg()
+}
+
+func appendU32(out []byte, v uint32) []byte {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if v == 0 {
+			return out
+		}
+	}
+}
+
+func appendS64(out []byte, v int64) []byte {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
@@ -0,0 +1,172 @@
+package gojinn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultTenantIdleTimeout = 10 * time.Minute
+
+	// reapInterval is how often the node looks for idle tenants.
+	reapInterval = 30 * time.Second
+)
+
+// ErrTenantLimit is returned when provisioning a tenant would exceed
+// max_tenants.
+var ErrTenantLimit = errors.New("tenant limit reached")
+
+// setupReaper starts the loop evicting the workers of tenants that have been
+// idle for tenant_idle_timeout.
+func (r *Gojinn) setupReaper() {
+	r.reaperStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(reapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				r.reapIdleTenants(now)
+			case <-r.reaperStop:
+				return
+			}
+		}
+	}()
+}
+
+// admitTenant marks tenantID as active on this node before its workers are
+// provisioned. A tenant that is not hot yet takes the place of the least
+// recently active one when max_hot_tenants is reached. Callers hold subsMu.
+func (r *Gojinn) admitTenant(tenantID string) {
+	if _, hot := r.tenantSubs[tenantID]; !hot && r.MaxHotTenants > 0 {
+		for len(r.tenantSubs) >= r.MaxHotTenants {
+			victim, oldest := "", time.Time{}
+			for id := range r.tenantSubs {
+				if seen := r.tenantLastSeen[id]; victim == "" || seen.Before(oldest) {
+					victim, oldest = id, seen
+				}
+			}
+			r.evictTenant(victim, "lru")
+		}
+	}
+	r.tenantLastSeen[tenantID] = time.Now()
+}
+
+// touchTenant records activity of a tenant whose workers are running, so a
+// tenant draining a backlog without new requests is not reaped.
+func (r *Gojinn) touchTenant(tenantID string) {
+	r.subsMu.Lock()
+	defer r.subsMu.Unlock()
+	if _, hot := r.tenantSubs[tenantID]; hot {
+		r.tenantLastSeen[tenantID] = time.Now()
+	}
+}
+
+// reapIdleTenants evicts the tenants without activity for longer than the
+// idle timeout. A tenant whose consumers still hold messages is kept.
+func (r *Gojinn) reapIdleTenants(now time.Time) {
+	timeout := time.Duration(r.TenantIdleTimeout)
+
+	r.subsMu.Lock()
+	for tenantID := range r.tenantLastSeen {
+		if _, hot := r.tenantSubs[tenantID]; !hot {
+			delete(r.tenantLastSeen, tenantID)
+		}
+	}
+	// Tenants provisioned without ever running here are checked again next
+	// time rather than cached for good.
+	r.provisioned.Range(func(k, _ any) bool {
+		if _, hot := r.tenantSubs[k.(string)]; !hot {
+			r.provisioned.Delete(k)
+		}
+		return true
+	})
+	idle := make(map[string][]*workerPool)
+	for tenantID, pools := range r.tenantSubs {
+		if now.Sub(r.tenantLastSeen[tenantID]) > timeout {
+			for _, pool := range pools {
+				idle[tenantID] = append(idle[tenantID], pool)
+			}
+		}
+	}
+	r.subsMu.Unlock()
+
+	for tenantID, pools := range idle {
+		if r.hasBacklog(pools) {
+			continue
+		}
+		r.subsMu.Lock()
+		if _, hot := r.tenantSubs[tenantID]; hot && now.Sub(r.tenantLastSeen[tenantID]) > timeout {
+			r.evictTenant(tenantID, "idle")
+		}
+		r.subsMu.Unlock()
+	}
+}
+
+func (r *Gojinn) hasBacklog(pools []*workerPool) bool {
+	for _, pool := range pools {
+		info, err := r.js.ConsumerInfo(pool.stream, pool.consumer)
+		if err == nil && (info.NumPending > 0 || info.NumAckPending > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// evictTenant drains the workers of tenantID, which closes their runtimes,
+// and forgets its rate limiter. Its streams and buckets are kept, so the
+// next request or job provisions it again. Callers hold subsMu.
+func (r *Gojinn) evictTenant(tenantID, reason string) {
+	for _, pool := range r.tenantSubs[tenantID] {
+		r.dropWorkerPool(pool)
+	}
+	delete(r.tenantSubs, tenantID)
+	delete(r.tenantLastSeen, tenantID)
+	r.stateBuckets.Delete(tenantID)
+	r.provisioned.Delete(tenantID)
+
+	r.limitersMu.Lock()
+	delete(r.limiters, tenantID)
+	r.limitersMu.Unlock()
+
+	r.logger.Info("Tenant Evicted", zap.String("tenant", tenantID), zap.String("reason", reason), zap.Int("hot_tenants", len(r.tenantSubs)))
+}
+
+// knownTenant reports whether tenantID was declared in the configuration: it
+// has an API key, or it is the tenant of internal triggers. Known tenants are
+// provisioned regardless of max_tenants; registry entries, which only set
+// limits, do not make a tenant known.
+func (r *Gojinn) knownTenant(tenantID string) bool {
+	if tenantID == DefaultTriggerTenant {
+		return true
+	}
+	for _, k := range r.APIKeys {
+		if k == tenantID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTenantLimit refuses to provision an unknown tenant once max_tenants
+// tenants have streams. Callers hold provisionMu.
+func (r *Gojinn) checkTenantLimit(tenantID string) error {
+	if r.MaxTenants <= 0 || r.knownTenant(tenantID) {
+		return nil
+	}
+	n := 0
+	for name := range r.js.StreamNames() {
+		if strings.HasPrefix(name, "WORKER_") {
+			n++
+		}
+	}
+	if n >= r.MaxTenants {
+		r.logger.Warn("Tenant provisioning refused", zap.String("tenant", tenantID), zap.Int("tenants", n))
+		return fmt.Errorf("%w: %d tenants provisioned", ErrTenantLimit, n)
+	}
+	return nil
+}
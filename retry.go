@@ -0,0 +1,226 @@
+package gojinn
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+const (
+	BackoffConstant    = "constant"
+	BackoffLinear      = "linear"
+	BackoffExponential = "exponential"
+
+	// Failure classes of a job attempt, as named in retry_on.
+	FailureTrap    = "trap"
+	FailureTimeout = "timeout"
+	FailureQuota   = "quota"
+	FailureFuel    = "fuel"
+	FailureFatal   = "fatal"
+
+	// ExitCodeNonRetryable is the exit code a function uses to report a
+	// failure that retrying cannot fix, such as invalid input (EX_DATAERR).
+	ExitCodeNonRetryable = 65
+)
+
+// RetryPolicy decides how often and how fast a failed job is retried before
+// it is moved to the dead-letter queue. Zero fields take the defaults: 5
+// attempts, linear 1s backoff, no jitter, retrying traps, timeouts and quota
+// violations.
+type RetryPolicy struct {
+	Max        int            `json:"max,omitempty"`
+	Backoff    string         `json:"backoff,omitempty"`
+	Initial    caddy.Duration `json:"initial,omitempty"`
+	MaxBackoff caddy.Duration `json:"max_backoff,omitempty"`
+	Jitter     float64        `json:"jitter,omitempty"`
+	RetryOn    []string       `json:"retry_on,omitempty"`
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Max <= 0 {
+		p.Max = MaxRetries
+	}
+	if p.Backoff == "" {
+		p.Backoff = BackoffLinear
+	}
+	if p.Initial <= 0 {
+		p.Initial = caddy.Duration(time.Second)
+	}
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = []string{FailureTrap, FailureTimeout, FailureQuota}
+	}
+	return p
+}
+
+// maxDeliver is the JetStream redelivery limit backing the policy. It leaves
+// one delivery of slack so that a job whose last attempt was lost with its
+// worker still reaches the dead-letter decision.
+func (p RetryPolicy) maxDeliver() int {
+	return p.Max + 1
+}
+
+// retries reports whether a failure of the given class is worth another
+// attempt. Fuel exhaustion and fatal failures never are: the same input
+// fails the same way again.
+func (p RetryPolicy) retries(class string) bool {
+	if class == FailureFuel || class == FailureFatal {
+		return false
+	}
+	for _, c := range p.RetryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the backoff before the attempt following attempt number n.
+func (p RetryPolicy) delay(n uint64) time.Duration {
+	base := time.Duration(p.Initial)
+	var d time.Duration
+	switch p.Backoff {
+	case BackoffConstant:
+		d = base
+	case BackoffExponential:
+		f := float64(base) * math.Pow(2, float64(n-1))
+		if f >= math.MaxInt64/2 {
+			f = math.MaxInt64 / 2
+		}
+		d = time.Duration(f)
+	default:
+		d = base * time.Duration(n) //nolint:gosec
+	}
+	if p.MaxBackoff > 0 && d > time.Duration(p.MaxBackoff) {
+		d = time.Duration(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// classifyFailure names the class of a failed attempt run under ctx.
+func classifyFailure(ctx context.Context, err error) string {
+	if errors.Is(err, ErrFuelExhausted) {
+		return FailureFuel
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == ExitCodeNonRetryable {
+		return FailureFatal
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return FailureTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		// Only the output cap cancels an attempt before its deadline.
+		return FailureQuota
+	}
+	return FailureTrap
+}
+
+// reconcileConsumer drops the durable consumer of a worker pool when its
+// redelivery limit no longer matches the retry policy, which JetStream would
+// otherwise refuse to bind to. Pending messages stay in the stream.
+func (r *Gojinn) reconcileConsumer(stream, durable string, maxDeliver int) {
+	info, err := r.js.ConsumerInfo(stream, durable)
+	if err != nil || info.Config.MaxDeliver == maxDeliver {
+		return
+	}
+	_ = r.js.DeleteConsumer(stream, durable)
+}
+
+// asyncRetryPolicy is the policy bounding redeliveries on the async stream,
+// which serves every module: the most permissive of the declared ones.
+func (r *Gojinn) asyncRetryPolicy() RetryPolicy {
+	policy := r.defaultFunction().Retry
+	if table := r.routeTable.Load(); table != nil {
+		for _, fn := range table.functions {
+			if fn.Retry.Max > policy.Max {
+				policy.Max = fn.Retry.Max
+			}
+		}
+	}
+	return policy
+}
+
+// parseRetry reads a retry block:
+//
+//	retry {
+//	    max      10
+//	    backoff  exponential 500ms 5m
+//	    jitter   20%
+//	    retry_on trap timeout
+//	}
+func parseRetry(h httpcaddyfile.Helper) (*RetryPolicy, error) {
+	policy := &RetryPolicy{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "max":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			val, err := strconv.Atoi(h.Val())
+			if err != nil || val < 1 {
+				return nil, h.Errf("invalid retry max '%s': must be a positive number of attempts", h.Val())
+			}
+			policy.Max = val
+		case "backoff":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 3 {
+				return nil, h.Err("backoff expects <constant|linear|exponential> [initial] [max]")
+			}
+			switch args[0] {
+			case BackoffConstant, BackoffLinear, BackoffExponential:
+				policy.Backoff = args[0]
+			default:
+				return nil, h.Errf("unknown backoff '%s'", args[0])
+			}
+			for i, arg := range args[1:] {
+				val, err := caddy.ParseDuration(arg)
+				if err != nil || val < 0 {
+					return nil, h.Errf("invalid backoff duration '%s'", arg)
+				}
+				if i == 0 {
+					policy.Initial = caddy.Duration(val)
+				} else {
+					policy.MaxBackoff = caddy.Duration(val)
+				}
+			}
+		case "jitter":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			val, err := strconv.ParseFloat(strings.TrimSuffix(h.Val(), "%"), 64)
+			if err != nil || val < 0 || val > 100 {
+				return nil, h.Errf("invalid jitter '%s': expects a percentage between 0%% and 100%%", h.Val())
+			}
+			policy.Jitter = val / 100
+		case "retry_on":
+			for _, arg := range h.RemainingArgs() {
+				for _, class := range strings.Split(arg, ",") {
+					switch class {
+					case FailureTrap, FailureTimeout, FailureQuota:
+						policy.RetryOn = append(policy.RetryOn, class)
+					case "":
+					default:
+						return nil, h.Errf("unknown retry_on class '%s': expects %s, %s or %s", class, FailureTrap, FailureTimeout, FailureQuota)
+					}
+				}
+			}
+			if len(policy.RetryOn) == 0 {
+				return nil, h.Err("retry_on expects at least one failure class")
+			}
+		default:
+			return nil, h.Errf("unknown retry option '%s'", h.Val())
+		}
+	}
+	return policy, nil
+}
@@ -0,0 +1,238 @@
+package gojinn
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// functionSpec is the resolved execution profile of one module served by a
+// gojinn block: either its top-level wasm file or an entry of its route table.
+// Every spec owns its own subject, worker pool and limits.
+type functionSpec struct {
+	Name        string
+	Key         string
+	WasmFile    string
+	Mode        string
+	PoolSize    int
+	PoolMin     int
+	PoolMax     int
+	Timeout     time.Duration
+	MemoryLimit string
+	FuelLimit   uint64
+	Env         map[string]string
+	Perms       Permissions
+	Retry       RetryPolicy
+}
+
+func (f *functionSpec) Subject(tenantID string) string {
+	return fmt.Sprintf("gojinn.tenant.%s.exec.%s", tenantID, f.Key)
+}
+
+func (f *functionSpec) QueueGroup(tenantID string) string {
+	return fmt.Sprintf("WORKERS_%s_%s", tenantID, f.Key[:12])
+}
+
+var wildcardPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(\.\.\.)?\}`)
+
+// defaultFunction resolves the top-level wasm file of the block.
+func (r *Gojinn) defaultFunction() *functionSpec {
+	var retry RetryPolicy
+	if r.Retry != nil {
+		retry = *r.Retry
+	}
+	return &functionSpec{
+		Name:        r.Path,
+		Key:         hashString(r.Path),
+		WasmFile:    r.Path,
+		Mode:        r.Mode,
+		PoolSize:    r.PoolSize,
+		PoolMin:     r.PoolMin,
+		PoolMax:     r.PoolMax,
+		Timeout:     time.Duration(r.Timeout),
+		MemoryLimit: r.MemoryLimit,
+		FuelLimit:   r.FuelLimit,
+		Env:         r.Env,
+		Perms:       r.Perms,
+		Retry:       retry.withDefaults(),
+	}
+}
+
+// routeFunction resolves a route table entry, inheriting every limit it does
+// not override from the enclosing block.
+func (r *Gojinn) routeFunction(route Route) *functionSpec {
+	fn := r.defaultFunction()
+	fn.Name = strings.TrimSpace(route.Method + " " + route.Pattern)
+	fn.Key = hashString(fn.Name)
+	fn.WasmFile = route.WasmFile
+
+	if route.Mode != "" {
+		fn.Mode = route.Mode
+	}
+	if route.PoolSize > 0 {
+		fn.PoolSize = route.PoolSize
+	}
+	if route.PoolMin > 0 {
+		fn.PoolMin = route.PoolMin
+	}
+	if route.PoolMax > 0 {
+		fn.PoolMax = route.PoolMax
+	}
+	if route.Timeout > 0 {
+		fn.Timeout = time.Duration(route.Timeout)
+	}
+	if route.MemoryLimit != "" {
+		fn.MemoryLimit = route.MemoryLimit
+	}
+	if route.FuelLimit > 0 {
+		fn.FuelLimit = route.FuelLimit
+	}
+	if len(route.Env) > 0 {
+		env := make(map[string]string, len(r.Env)+len(route.Env))
+		for k, v := range r.Env {
+			env[k] = v
+		}
+		for k, v := range route.Env {
+			env[k] = v
+		}
+		fn.Env = env
+	}
+	if route.Perms != nil {
+		fn.Perms = *route.Perms
+	}
+	if route.Retry != nil {
+		fn.Retry = route.Retry.withDefaults()
+	}
+	return fn
+}
+
+// routeTable is the dispatch state derived from the block configuration. It
+// is swapped atomically so hot patches never race with in-flight requests.
+type routeTable struct {
+	functions []*functionSpec
+	mux       *http.ServeMux
+}
+
+type routeMatch struct {
+	fn     *functionSpec
+	params map[string]string
+}
+
+type routeMatchKey struct{}
+
+// buildRouter compiles the route table into a ServeMux whose handlers only
+// record which function matched, so dispatch follows net/http pattern rules.
+func (r *Gojinn) buildRouter() (err error) {
+	table := &routeTable{}
+
+	if len(r.Routes) == 0 {
+		if r.Path != "" {
+			table.functions = []*functionSpec{r.defaultFunction()}
+		}
+		r.routeTable.Store(table)
+		return nil
+	}
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("invalid route table: %v", rec)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	for _, route := range r.Routes {
+		fn := r.routeFunction(route)
+		names := wildcardPattern.FindAllStringSubmatch(route.Pattern, -1)
+
+		pattern := route.Pattern
+		if route.Method != "" && route.Method != "*" {
+			pattern = route.Method + " " + route.Pattern
+		}
+
+		mux.HandleFunc(pattern, func(_ http.ResponseWriter, req *http.Request) {
+			m, _ := req.Context().Value(routeMatchKey{}).(*routeMatch)
+			if m == nil {
+				return
+			}
+			m.fn = fn
+			m.params = make(map[string]string, len(names))
+			for _, n := range names {
+				m.params[n[1]] = req.PathValue(n[1])
+			}
+		})
+		table.functions = append(table.functions, fn)
+	}
+	table.mux = mux
+	r.routeTable.Store(table)
+	return nil
+}
+
+// matchFunction returns the function serving req, its path parameters and,
+// when nothing matched, the HTTP status to answer with.
+func (r *Gojinn) matchFunction(req *http.Request) (*functionSpec, map[string]string, int) {
+	table := r.routeTable.Load()
+	if table == nil {
+		return nil, nil, http.StatusNotFound
+	}
+	if table.mux == nil {
+		if len(table.functions) == 0 {
+			return nil, nil, http.StatusNotFound
+		}
+		return table.functions[0], nil, 0
+	}
+
+	m := &routeMatch{}
+	probe := &statusRecorder{header: make(http.Header)}
+	table.mux.ServeHTTP(probe, req.WithContext(context.WithValue(req.Context(), routeMatchKey{}, m)))
+
+	if m.fn == nil {
+		if probe.status == http.StatusMethodNotAllowed {
+			return nil, nil, http.StatusMethodNotAllowed
+		}
+		return nil, nil, http.StatusNotFound
+	}
+	return m.fn, m.params, 0
+}
+
+// lookupFunction returns the configured function with the given key, routed
+// or run by a cron, MQTT or on_kv_change trigger, or nil when the
+// configuration no longer has it.
+func (r *Gojinn) lookupFunction(key string) *functionSpec {
+	if table := r.routeTable.Load(); table != nil {
+		for _, fn := range table.functions {
+			if fn.Key == key {
+				return fn
+			}
+		}
+	}
+	for _, job := range r.CronJobs {
+		if fn := r.cronFunction(job); fn.Key == key {
+			return fn
+		}
+	}
+	for _, sub := range r.MQTTSubs {
+		if fn := r.mqttFunction(sub); fn.Key == key {
+			return fn
+		}
+	}
+	for _, t := range r.KVTriggers {
+		if fn := r.kvTriggerFunction(t); fn.Key == key {
+			return fn
+		}
+	}
+	return nil
+}
+
+// statusRecorder swallows whatever the router writes for unmatched requests
+// while keeping the status it chose.
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (s *statusRecorder) Header() http.Header         { return s.header }
+func (s *statusRecorder) Write(p []byte) (int, error) { return len(p), nil }
+func (s *statusRecorder) WriteHeader(status int)      { s.status = status }
@@ -2,23 +2,69 @@ package gojinn
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"path/filepath"
+	"sync"
 
 	"github.com/dustin/go-humanize"
+	"github.com/pauloappbr/gojinn/pkg/metering"
 	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"go.uber.org/zap"
+)
+
+// ErrFuelExhausted is returned when an invocation spends its whole fuel_limit.
+var ErrFuelExhausted = errors.New("fuel exhausted")
+
+var (
+	compilationCaches   = make(map[string]wazero.CompilationCache)
+	compilationCachesMu sync.Mutex
 )
 
 type EnginePair struct {
-	Runtime wazero.Runtime
-	Code    wazero.CompiledModule
+	Runtime   wazero.Runtime
+	Code      wazero.CompiledModule
+	FuelLimit uint64
 }
 
-func (r *Gojinn) createWazeroRuntime(wasmBytes []byte) (*EnginePair, error) {
+// sharedCompilationCache returns the process-wide compilation cache persisted
+// under dataDir. Every runtime created for any tenant, worker or sync job uses
+// it, so a module is compiled once and survives restarts. wazero keys entries
+// by the SHA-256 of the module bytes (and its own version), so a modified
+// binary misses the cache and is recompiled.
+func sharedCompilationCache(dataDir string) (wazero.CompilationCache, error) {
+	dir := filepath.Join(dataDir, "wazero_cache")
+
+	compilationCachesMu.Lock()
+	defer compilationCachesMu.Unlock()
+
+	if cache, ok := compilationCaches[dir]; ok {
+		return cache, nil
+	}
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	compilationCaches[dir] = cache
+	return cache, nil
+}
+
+// createWazeroRuntime compiles wasmBytes into a fresh runtime. A non-zero
+// fuelLimit compiles a metered copy of the module instead (see pkg/metering).
+func (r *Gojinn) createWazeroRuntime(wasmBytes []byte, memLimit string, fuelLimit uint64) (*EnginePair, error) {
 	ctxWazero := context.Background()
 	rConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
 
-	memLimit := r.MemoryLimit
+	if cache, err := sharedCompilationCache(r.DataDir); err == nil {
+		rConfig = rConfig.WithCompilationCache(cache)
+	} else {
+		r.logger.Warn("Compilation cache unavailable, compiling without it", zap.Error(err))
+	}
+
 	if memLimit == "" {
 		memLimit = "128MB"
 	}
@@ -41,10 +87,55 @@ func (r *Gojinn) createWazeroRuntime(wasmBytes []byte) (*EnginePair, error) {
 
 	wasi_snapshot_preview1.MustInstantiate(ctxWazero, engine)
 
+	if fuelLimit > 0 {
+		wasmBytes, err = metering.Instrument(wasmBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to instrument wasm binary for fuel metering: %w", err)
+		}
+	}
+
 	code, err := engine.CompileModule(ctxWazero, wasmBytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile wasm binary: %w", err)
 	}
 
-	return &EnginePair{Runtime: engine, Code: code}, nil
+	return &EnginePair{Runtime: engine, Code: code, FuelLimit: fuelLimit}, nil
+}
+
+// runModule instantiates the guest and runs its _start entry point. Metered
+// modules are instantiated without start functions so that the invocation's
+// budget can be loaded into the fuel global before any guest code runs.
+func (r *Gojinn) runModule(ctx context.Context, pair *EnginePair, modConfig wazero.ModuleConfig) (api.Module, error) {
+	if pair.FuelLimit == 0 {
+		return pair.Runtime.InstantiateModule(ctx, pair.Code, modConfig)
+	}
+
+	mod, err := pair.Runtime.InstantiateModule(ctx, pair.Code, modConfig.WithStartFunctions())
+	if err != nil {
+		return nil, err
+	}
+
+	fuel, ok := mod.ExportedGlobal(metering.ExportName).(api.MutableGlobal)
+	if !ok {
+		_ = mod.Close(ctx)
+		return nil, fmt.Errorf("metered module does not export %s", metering.ExportName)
+	}
+	fuel.Set(api.EncodeI64(int64(min(pair.FuelLimit, math.MaxInt64)))) //nolint:gosec
+
+	if start := mod.ExportedFunction("_start"); start != nil {
+		_, err = start.Call(ctx)
+	}
+
+	if int64(fuel.Get()) < 0 { //nolint:gosec
+		_ = mod.Close(ctx)
+		return nil, fmt.Errorf("%w: budget of %d units spent", ErrFuelExhausted, pair.FuelLimit)
+	}
+	if err != nil {
+		var exitErr *sys.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 0 {
+			_ = mod.Close(ctx)
+			return nil, err
+		}
+	}
+	return mod, nil
 }
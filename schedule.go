@@ -0,0 +1,232 @@
+package gojinn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"go.uber.org/zap"
+)
+
+const (
+	scheduledStream   = "SCHEDULED"
+	scheduledConsumer = "SCHEDULER"
+
+	headerRunAt    = "Gojinn-Run-At"
+	headerTarget   = "Gojinn-Target"
+	headerFunction = "Gojinn-Function"
+
+	// maxScheduleHop bounds how long a scheduled message waits between two
+	// deliveries, so its job record is refreshed before job_retention
+	// expires it and a cancellation is noticed well before the due time.
+	maxScheduleHop = time.Hour
+
+	// releaseRetryDelay is how long a due job waits before a node that could
+	// not start its workers tries to release it again.
+	releaseRetryDelay = 10 * time.Second
+)
+
+func scheduledSubject(tenantID string) string {
+	return fmt.Sprintf("gojinn.scheduled.%s", tenantID)
+}
+
+// parseRunAt reads an X-Gojinn-Run-At value: an RFC 3339 timestamp, or a
+// delay such as 90s or 2h relative to now.
+func parseRunAt(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := caddy.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("run-at must be an RFC 3339 time or a delay, got %q", value)
+	}
+	if d < 0 {
+		return time.Time{}, fmt.Errorf("run-at delay must not be negative")
+	}
+	return now.Add(d), nil
+}
+
+// setupScheduler provisions the stream holding deferred jobs and joins this
+// node to the cluster-wide consumer that releases them when due. Every node
+// shares one durable consumer, so each job is released once and a job held
+// by a node that dies is redelivered to another.
+func (r *Gojinn) setupScheduler() error {
+	if _, err := r.js.StreamInfo(scheduledStream); err != nil {
+		_, err = r.js.AddStream(&nats.StreamConfig{
+			Name:      scheduledStream,
+			Subjects:  []string{"gojinn.scheduled.>"},
+			Storage:   nats.FileStorage,
+			Retention: nats.WorkQueuePolicy,
+			Replicas:  r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision scheduled jobs stream: %w", err)
+		}
+	}
+
+	_, err := r.js.QueueSubscribe("gojinn.scheduled.>", scheduledConsumer, r.releaseScheduledJob,
+		nats.Durable(scheduledConsumer),
+		nats.BindStream(scheduledStream),
+		nats.ManualAck(),
+		nats.MaxDeliver(-1),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to start job scheduler: %w", err)
+	}
+	return nil
+}
+
+// scheduleJob defers msg, complete as it would be published for immediate
+// execution, until runAt. fnKey names the function whose workers must be
+// running when the job is released.
+func (r *Gojinn) scheduleJob(tenantID, jobID string, msg *nats.Msg, fnKey string, runAt time.Time) error {
+	deferred := nats.NewMsg(scheduledSubject(tenantID))
+	deferred.Data = msg.Data
+	for k, v := range msg.Header {
+		deferred.Header[k] = v
+	}
+	deferred.Header.Set(headerJobID, jobID)
+	deferred.Header.Set(headerTarget, msg.Subject)
+	deferred.Header.Set(headerFunction, fnKey)
+	deferred.Header.Set(headerRunAt, runAt.UTC().Format(time.RFC3339Nano))
+
+	if err := r.recordJobScheduled(tenantID, jobID, runAt); err != nil {
+		return fmt.Errorf("failed to record scheduled job: %w", err)
+	}
+	if _, err := r.js.PublishMsg(deferred, nats.MsgId(jobID)); err != nil {
+		r.updateJob(tenantID, jobID, func(j *JobRecord) {
+			j.State = JobDead
+			j.Error = err.Error()
+		})
+		return fmt.Errorf("failed to persist scheduled job: %w", err)
+	}
+	return nil
+}
+
+func (r *Gojinn) releaseScheduledJob(m *nats.Msg) {
+	tenantID := strings.TrimPrefix(m.Subject, "gojinn.scheduled.")
+	jobID := m.Header.Get(headerJobID)
+	logger := r.logger.With(zap.String("tenant", tenantID), zap.String("job_id", jobID))
+
+	rec, err := r.GetJob(context.Background(), tenantID, jobID, 0)
+	if err == nil && rec.State != JobScheduled {
+		// Cancelled, or released by a node that died before acking.
+		_ = m.Ack()
+		return
+	}
+
+	runAt, err := time.Parse(time.RFC3339Nano, m.Header.Get(headerRunAt))
+	if err != nil {
+		logger.Error("Dropping scheduled job with invalid run-at", zap.Error(err))
+		_ = m.Term()
+		return
+	}
+
+	if wait := time.Until(runAt); wait > 0 {
+		if wait > maxScheduleHop {
+			wait = maxScheduleHop
+			_, _ = r.transitionJob(tenantID, jobID, JobScheduled, func(*JobRecord) {})
+		}
+		_ = m.NakWithDelay(wait)
+		return
+	}
+
+	// Published without workers on this node, the job could sit on its
+	// stream with nothing consuming it.
+	if err := r.ensureJobWorkers(tenantID, m.Header, m.Header.Get(headerFunction)); err != nil {
+		logger.Warn("Scheduled job held back, no local workers", zap.Error(err))
+		_ = m.NakWithDelay(releaseRetryDelay)
+		return
+	}
+
+	released, err := r.transitionJob(tenantID, jobID, JobScheduled, func(j *JobRecord) {
+		j.State = JobQueued
+	})
+	if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+		logger.Warn("Failed to release scheduled job", zap.Error(err))
+		_ = m.NakWithDelay(time.Second)
+		return
+	}
+	if err == nil && !released {
+		_ = m.Ack()
+		return
+	}
+
+	out := nats.NewMsg(m.Header.Get(headerTarget))
+	out.Data = m.Data
+	for k, v := range m.Header {
+		switch k {
+		case headerTarget, headerFunction, headerRunAt, "Nats-Msg-Id":
+			continue
+		}
+		out.Header[k] = v
+	}
+	if _, err := r.js.PublishMsg(out, nats.MsgId(jobID)); err != nil {
+		logger.Error("Failed to queue scheduled job", zap.Error(err))
+		r.updateJob(tenantID, jobID, func(j *JobRecord) { j.State = JobScheduled })
+		_ = m.NakWithDelay(time.Second)
+		return
+	}
+	_ = m.Ack()
+	logger.Info("Scheduled Job Released", zap.Time("run_at", runAt))
+}
+
+// cancelJob implements DELETE /_sys/jobs/{id}: a scheduled job of the calling
+// tenant is cancelled before it is released.
+func (r *Gojinn) cancelJob(rw http.ResponseWriter, tenantID, jobID string) error {
+	cancelled, err := r.transitionJob(tenantID, jobID, JobScheduled, func(j *JobRecord) {
+		j.State = JobCancelled
+	})
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if !cancelled {
+		http.Error(rw, "Only scheduled jobs can be cancelled", http.StatusConflict)
+		return nil
+	}
+
+	r.logger.Info("Scheduled job cancelled", zap.String("tenant", tenantID), zap.String("job_id", jobID))
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (r *Gojinn) serveScheduledJob(rw http.ResponseWriter, req *http.Request, tenantID string, msg *nats.Msg, fn *functionSpec, runAt time.Time, idemKey string) error {
+	jobID := nuid.Next()
+	if idemKey != "" {
+		jobID = idempotentJobID(fn, idemKey)
+	}
+	err := r.scheduleJob(tenantID, jobID, msg, fn.Key, runAt)
+	if errors.Is(err, nats.ErrKeyExists) {
+		return r.serveDuplicateJob(rw, req, tenantID, jobID, fn)
+	}
+	if err != nil {
+		r.logger.Error("Failed to Schedule Job (JetStream)", zap.Error(err))
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("persistence failed: %v", err))
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Gojinn-Job-ID", jobID)
+	rw.Header().Set("X-Gojinn-Tenant", tenantID)
+	rw.WriteHeader(http.StatusAccepted)
+
+	return json.NewEncoder(rw).Encode(map[string]interface{}{
+		"status": "scheduled",
+		"job_id": jobID,
+		"run_at": runAt.UTC(),
+		"tenant": tenantID,
+		"msg":    "Job persisted and will be queued at run_at.",
+	})
+}
@@ -50,3 +50,15 @@ func send(status int, contentType string, body string) {
 	}
 	json.NewEncoder(os.Stdout).Encode(resp)
 }
+
+// ExitNonRetryable is the exit code Gojinn reads as a failure that must not
+// be retried.
+const ExitNonRetryable = 65
+
+// Fail ends the invocation with a failure that retrying cannot fix, such as
+// invalid input. The job is dead-lettered after this attempt instead of being
+// retried; the message is written to stderr and recorded on the job.
+func Fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "FATAL: %s\n", fmt.Sprintf(format, a...))
+	os.Exit(ExitNonRetryable)
+}
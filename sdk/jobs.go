@@ -0,0 +1,107 @@
+//go:build wasip1 || wasm
+
+package sdk
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_enqueue_job
+func host_enqueue_job(fPtr, fLen, pPtr, pLen, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_schedule_job
+func host_schedule_job(fPtr, fLen, pPtr, pLen uint32, runAtMs int64, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_map
+func host_map(fPtr, fLen, pPtr, pLen, k, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_map_result
+func host_map_result(outPtr, outMaxLen uint32) uint32
+
+var errEnqueue = errors.New("gojinn enqueue rejected (check the enqueue permission and logs)")
+
+type JobQueue struct{}
+
+var Jobs = JobQueue{}
+
+// Enqueue queues a background run of the module at wasmFile with payload as
+// its request body and returns the job ID, which can be polled on
+// /_sys/jobs/{id}. The job runs under the caller's tenant.
+func (j JobQueue) Enqueue(wasmFile, payload string) (string, error) {
+	fPtr := uintptr(unsafe.Pointer(unsafe.StringData(wasmFile)))
+	pPtr := uintptr(unsafe.Pointer(unsafe.StringData(payload)))
+
+	buffer := make([]byte, 64)
+	outPtr := uintptr(unsafe.Pointer(&buffer[0]))
+
+	n := host_enqueue_job(uint32(fPtr), uint32(len(wasmFile)), uint32(pPtr), uint32(len(payload)), uint32(outPtr), uint32(len(buffer)))
+	if n == 0xFFFFFFFF {
+		return "", errEnqueue
+	}
+	return string(buffer[:n]), nil
+}
+
+// Schedule queues a run of the module at wasmFile that starts no earlier than
+// runAt and returns the job ID. Until then the job is "scheduled" and can be
+// cancelled with DELETE /_sys/jobs/{id}.
+func (j JobQueue) Schedule(wasmFile, payload string, runAt time.Time) (string, error) {
+	fPtr := uintptr(unsafe.Pointer(unsafe.StringData(wasmFile)))
+	pPtr := uintptr(unsafe.Pointer(unsafe.StringData(payload)))
+
+	buffer := make([]byte, 64)
+	outPtr := uintptr(unsafe.Pointer(&buffer[0]))
+
+	n := host_schedule_job(uint32(fPtr), uint32(len(wasmFile)), uint32(pPtr), uint32(len(payload)), runAt.UnixMilli(), uint32(outPtr), uint32(len(buffer)))
+	if n == 0xFFFFFFFF {
+		return "", errEnqueue
+	}
+	return string(buffer[:n]), nil
+}
+
+// EnqueueAfter is Schedule with a delay relative to now.
+func (j JobQueue) EnqueueAfter(wasmFile, payload string, delay time.Duration) (string, error) {
+	return j.Schedule(wasmFile, payload, time.Now().Add(delay))
+}
+
+// Map runs the module at wasmFile once per payload, in parallel on the
+// tenant's workers across the cluster, and waits for every result. Results
+// are in payload order. The wait is bounded by the caller's own timeout;
+// invocations still running then are reported in their current state.
+func (j JobQueue) Map(wasmFile string, payloads []string) ([]MapResult, error) {
+	return j.MapFirst(wasmFile, payloads, len(payloads))
+}
+
+// MapFirst is Map returning as soon as k invocations have finished. The
+// others keep running in the background.
+func (j JobQueue) MapFirst(wasmFile string, payloads []string, k int) ([]MapResult, error) {
+	data, err := json.Marshal(payloads)
+	if err != nil {
+		return nil, err
+	}
+	fPtr := uintptr(unsafe.Pointer(unsafe.StringData(wasmFile)))
+	pPtr := uintptr(unsafe.Pointer(&data[0]))
+
+	buffer := make([]byte, 64*1024)
+	outPtr := uintptr(unsafe.Pointer(&buffer[0]))
+
+	n := host_map(uint32(fPtr), uint32(len(wasmFile)), uint32(pPtr), uint32(len(data)), uint32(k), uint32(outPtr), uint32(len(buffer)))
+	if n == 0xFFFFFFFF {
+		return nil, errEnqueue
+	}
+	if int(n) > len(buffer) {
+		buffer = make([]byte, n)
+		outPtr = uintptr(unsafe.Pointer(&buffer[0]))
+		if host_map_result(uint32(outPtr), uint32(len(buffer))) == 0xFFFFFFFF {
+			return nil, errEnqueue
+		}
+	}
+
+	var results []MapResult
+	if err := json.Unmarshal(buffer[:n], &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -3,6 +3,9 @@
 package sdk
 
 import (
+	"encoding/json"
+	"errors"
+	"time"
 	"unsafe"
 )
 
@@ -12,6 +15,26 @@ func host_kv_set(kPtr, kLen, vPtr, vLen uint32)
 //go:wasmimport gojinn host_kv_get
 func host_kv_get(kPtr, kLen, outPtr, outMaxLen uint32) uint32
 
+//go:wasmimport gojinn host_kv_set_ttl
+func host_kv_set_ttl(kPtr, kLen, vPtr, vLen uint32, ttlMs int64) uint32
+
+//go:wasmimport gojinn host_kv_delete
+func host_kv_delete(kPtr, kLen uint32) uint32
+
+//go:wasmimport gojinn host_kv_get_rev
+func host_kv_get_rev(kPtr, kLen, outPtr, outMaxLen, revPtr uint32) uint32
+
+//go:wasmimport gojinn host_kv_cas
+func host_kv_cas(kPtr, kLen, vPtr, vLen uint32, expected uint64) uint64
+
+//go:wasmimport gojinn host_kv_keys
+func host_kv_keys(pPtr, pLen, cPtr, cLen, limit, outPtr, outMaxLen uint32) uint32
+
+//go:wasmimport gojinn host_kv_history
+func host_kv_history(kPtr, kLen, outPtr, outMaxLen uint32) uint32
+
+var errKV = errors.New("gojinn kv call rejected (check the kv permissions and logs)")
+
 type KVStore struct{}
 
 var KV = KVStore{}
@@ -41,3 +64,98 @@ func (k KVStore) Get(key string) (string, bool) {
 
 	return string(buffer[:retLen]), true
 }
+
+// SetWithTTL stores value under key for ttl, after which reads no longer
+// find it and the host deletes it. Set uses the TTL configured for the key's
+// namespace, if any.
+func (k KVStore) SetWithTTL(key, value string, ttl time.Duration) bool {
+	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
+	vPtr := uintptr(unsafe.Pointer(unsafe.StringData(value)))
+
+	return host_kv_set_ttl(uint32(kPtr), uint32(len(key)), uint32(vPtr), uint32(len(value)), ttl.Milliseconds()) == 1
+}
+
+// Delete removes key. Its history keeps a delete marker.
+func (k KVStore) Delete(key string) bool {
+	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
+	return host_kv_delete(uint32(kPtr), uint32(len(key))) == 1
+}
+
+// GetRevision is Get also returning the revision of the value, to pass to
+// CompareAndSwap.
+func (k KVStore) GetRevision(key string) (string, uint64, bool) {
+	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
+
+	buffer := make([]byte, 4096)
+	outPtr := uintptr(unsafe.Pointer(&buffer[0]))
+	var revision uint64
+	revPtr := uintptr(unsafe.Pointer(&revision))
+
+	n := host_kv_get_rev(uint32(kPtr), uint32(len(key)), uint32(outPtr), uint32(len(buffer)), uint32(revPtr))
+	if n == 0xFFFFFFFF {
+		return "", 0, false
+	}
+	return string(buffer[:n]), revision, true
+}
+
+// CompareAndSwap sets key to value only if its revision is still expected,
+// or only if it does not exist when expected is 0. It returns the new
+// revision, or false when another writer got there first.
+//
+//	for {
+//	    val, rev, _ := sdk.KV.GetRevision("counter")
+//	    n, _ := strconv.Atoi(val)
+//	    if _, ok := sdk.KV.CompareAndSwap("counter", strconv.Itoa(n+1), rev); ok {
+//	        break
+//	    }
+//	}
+func (k KVStore) CompareAndSwap(key, value string, expected uint64) (uint64, bool) {
+	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
+	vPtr := uintptr(unsafe.Pointer(unsafe.StringData(value)))
+
+	revision := host_kv_cas(uint32(kPtr), uint32(len(key)), uint32(vPtr), uint32(len(value)), expected)
+	return revision, revision != 0
+}
+
+// Keys lists the readable keys starting with prefix, in order, up to limit
+// per page (100 when 0). Pass the returned cursor to get the next page; it is
+// empty after the last one.
+func (k KVStore) Keys(prefix, cursor string, limit int) ([]string, string, error) {
+	pPtr := uintptr(unsafe.Pointer(unsafe.StringData(prefix)))
+	cPtr := uintptr(unsafe.Pointer(unsafe.StringData(cursor)))
+
+	buffer := make([]byte, 64*1024)
+	outPtr := uintptr(unsafe.Pointer(&buffer[0]))
+
+	n := host_kv_keys(uint32(pPtr), uint32(len(prefix)), uint32(cPtr), uint32(len(cursor)), uint32(limit), uint32(outPtr), uint32(len(buffer)))
+	if n == 0xFFFFFFFF {
+		return nil, "", errKV
+	}
+	var page struct {
+		Keys []string `json:"keys"`
+		Next string   `json:"next"`
+	}
+	if err := json.Unmarshal(buffer[:n], &page); err != nil {
+		return nil, "", err
+	}
+	return page.Keys, page.Next, nil
+}
+
+// History returns the recent revisions of key, oldest first, as deep as the
+// history configured for its namespace.
+func (k KVStore) History(key string) ([]KVEntry, error) {
+	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
+
+	buffer := make([]byte, 64*1024)
+	outPtr := uintptr(unsafe.Pointer(&buffer[0]))
+
+	n := host_kv_history(uint32(kPtr), uint32(len(key)), uint32(outPtr), uint32(len(buffer)))
+	if n == 0xFFFFFFFF {
+		return nil, errKV
+	}
+	var entries []KVEntry
+	if err := json.Unmarshal(buffer[:n], &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -2,18 +2,32 @@
 
 package sdk
 
-import "unsafe"
+import (
+	"time"
+	"unsafe"
+)
 
-//go:wasmimport
+//go:wasmimport gojinn host_mutex_lock
 func host_mutex_lock(kPtr uint32, kLen uint32, ttlSeconds uint32) uint32
 
-//go:wasmimport
+//go:wasmimport gojinn host_mutex_unlock
 func host_mutex_unlock(kPtr uint32, kLen uint32) uint32
 
+//go:wasmimport gojinn host_mutex_acquire
+func host_mutex_acquire(kPtr uint32, kLen uint32, ttlMs int64, waitMs int64) uint64
+
+//go:wasmimport gojinn host_mutex_renew
+func host_mutex_renew(kPtr uint32, kLen uint32, token uint64, ttlMs int64) uint32
+
+//go:wasmimport gojinn host_mutex_release
+func host_mutex_release(kPtr uint32, kLen uint32, token uint64) uint32
+
 type MutexService struct{}
 
 var Mutex = MutexService{}
 
+// TryLock takes the lock key for ttlSeconds (30 when 0) without waiting. The
+// lock is released by Unlock in the same execution or when the lease ends.
 func (m MutexService) TryLock(key string, ttlSeconds uint32) bool {
 	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
 	kLen := uint32(len(key))
@@ -22,6 +36,7 @@ func (m MutexService) TryLock(key string, ttlSeconds uint32) bool {
 	return success == 1
 }
 
+// Unlock releases a lock taken by TryLock in this execution.
 func (m MutexService) Unlock(key string) bool {
 	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
 	kLen := uint32(len(key))
@@ -29,3 +44,26 @@ func (m MutexService) Unlock(key string) bool {
 	success := host_mutex_unlock(uint32(kPtr), kLen)
 	return success == 1
 }
+
+// Acquire takes the lock key for ttl, waiting up to wait while another owner
+// holds it. It returns the fencing token of the lease, which grows with every
+// acquisition: pass it along with writes so stale holders can be rejected.
+func (m MutexService) Acquire(key string, ttl, wait time.Duration) (uint64, bool) {
+	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
+
+	token := host_mutex_acquire(uint32(kPtr), uint32(len(key)), ttl.Milliseconds(), wait.Milliseconds())
+	return token, token != 0
+}
+
+// Renew extends the lease held with token to ttl from now. It fails once the
+// lease has been taken over by another owner.
+func (m MutexService) Renew(key string, token uint64, ttl time.Duration) bool {
+	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
+	return host_mutex_renew(uint32(kPtr), uint32(len(key)), token, ttl.Milliseconds()) == 1
+}
+
+// Release frees the lock if it is still held with token.
+func (m MutexService) Release(key string, token uint64) bool {
+	kPtr := uintptr(unsafe.Pointer(unsafe.StringData(key)))
+	return host_mutex_release(uint32(kPtr), uint32(len(key)), token) == 1
+}
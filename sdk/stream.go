@@ -0,0 +1,67 @@
+//go:build wasip1 || wasm
+
+package sdk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+//go:wasmimport gojinn host_stream_open
+func host_stream_open(status uint32, hPtr uint32, hLen uint32) uint32
+
+//go:wasmimport gojinn host_stream_write
+func host_stream_write(dPtr uint32, dLen uint32) uint32
+
+//go:wasmimport gojinn host_stream_flush
+func host_stream_flush() uint32
+
+var errStream = errors.New("gojinn stream operation failed")
+
+type StreamWriter struct{}
+
+var Stream = StreamWriter{}
+
+// Open sends the response status and headers. It is optional: the first
+// Write opens the stream with status 200 when it was not called.
+func (s StreamWriter) Open(status int, headers map[string][]string) error {
+	hBytes, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	hPtr := uintptr(unsafe.Pointer(unsafe.SliceData(hBytes)))
+
+	if host_stream_open(uint32(status), uint32(hPtr), uint32(len(hBytes))) != 0 {
+		return errStream
+	}
+	return nil
+}
+
+func (s StreamWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	dPtr := uintptr(unsafe.Pointer(&p[0]))
+
+	if host_stream_write(uint32(dPtr), uint32(len(p))) != 0 {
+		return 0, errStream
+	}
+	return len(p), nil
+}
+
+func (s StreamWriter) Flush() error {
+	if host_stream_flush() != 0 {
+		return errStream
+	}
+	return nil
+}
+
+// SSE writes a single Server-Sent Event and flushes it to the client.
+func (s StreamWriter) SSE(event, data string) error {
+	if _, err := s.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data))); err != nil {
+		return err
+	}
+	return s.Flush()
+}
@@ -2,7 +2,10 @@
 
 package sdk
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 type DBHandlerStub struct{}
 
@@ -16,6 +19,20 @@ type KVStoreStub struct{}
 
 func (k KVStoreStub) Set(key, value string)         {}
 func (k KVStoreStub) Get(key string) (string, bool) { return "", false }
+func (k KVStoreStub) Delete(key string) bool        { return false }
+func (k KVStoreStub) SetWithTTL(key, value string, ttl time.Duration) bool {
+	return false
+}
+func (k KVStoreStub) GetRevision(key string) (string, uint64, bool) { return "", 0, false }
+func (k KVStoreStub) CompareAndSwap(key, value string, expected uint64) (uint64, bool) {
+	return 0, false
+}
+func (k KVStoreStub) Keys(prefix, cursor string, limit int) ([]string, string, error) {
+	return nil, "", errors.New("cannot run sdk.KV on host machine (wasm only)")
+}
+func (k KVStoreStub) History(key string) ([]KVEntry, error) {
+	return nil, errors.New("cannot run sdk.KV on host machine (wasm only)")
+}
 
 var KV = KVStoreStub{}
 
@@ -23,5 +40,43 @@ type MutexServiceStub struct{}
 
 func (m MutexServiceStub) TryLock(key string, ttlSeconds uint32) bool { return false }
 func (m MutexServiceStub) Unlock(key string) bool                     { return false }
+func (m MutexServiceStub) Acquire(key string, ttl, wait time.Duration) (uint64, bool) {
+	return 0, false
+}
+func (m MutexServiceStub) Renew(key string, token uint64, ttl time.Duration) bool { return false }
+func (m MutexServiceStub) Release(key string, token uint64) bool                  { return false }
 
 var Mutex = MutexServiceStub{}
+
+type StreamWriterStub struct{}
+
+func (s StreamWriterStub) Open(status int, headers map[string][]string) error {
+	return errors.New("cannot run sdk.Stream on host machine (wasm only)")
+}
+func (s StreamWriterStub) Write(p []byte) (int, error) {
+	return 0, errors.New("cannot run sdk.Stream on host machine (wasm only)")
+}
+func (s StreamWriterStub) Flush() error                 { return nil }
+func (s StreamWriterStub) SSE(event, data string) error { return nil }
+
+var Stream = StreamWriterStub{}
+
+type JobQueueStub struct{}
+
+func (j JobQueueStub) Enqueue(wasmFile, payload string) (string, error) {
+	return "", errors.New("cannot run sdk.Jobs on host machine (wasm only)")
+}
+func (j JobQueueStub) Schedule(wasmFile, payload string, runAt time.Time) (string, error) {
+	return "", errors.New("cannot run sdk.Jobs on host machine (wasm only)")
+}
+func (j JobQueueStub) EnqueueAfter(wasmFile, payload string, delay time.Duration) (string, error) {
+	return "", errors.New("cannot run sdk.Jobs on host machine (wasm only)")
+}
+func (j JobQueueStub) Map(wasmFile string, payloads []string) ([]MapResult, error) {
+	return nil, errors.New("cannot run sdk.Jobs on host machine (wasm only)")
+}
+func (j JobQueueStub) MapFirst(wasmFile string, payloads []string, k int) ([]MapResult, error) {
+	return nil, errors.New("cannot run sdk.Jobs on host machine (wasm only)")
+}
+
+var Jobs = JobQueueStub{}
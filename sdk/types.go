@@ -1,13 +1,33 @@
 package sdk
 
+import "time"
+
 type Request struct {
 	Method  string              `json:"method"`
 	URI     string              `json:"uri"`
 	Headers map[string][]string `json:"headers"`
 	Body    string              `json:"body"`
+	Params  map[string]string   `json:"params,omitempty"`
 	TraceID string              `json:"trace_id,omitempty"`
 }
 
+// MapResult is the outcome of one invocation started by Jobs.Map.
+type MapResult struct {
+	JobID  string `json:"job_id"`
+	State  string `json:"state"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// KVEntry is one revision of a key returned by KV.History. Operation is
+// "put", "delete" or "purge".
+type KVEntry struct {
+	Revision  uint64    `json:"revision"`
+	Operation string    `json:"operation"`
+	Value     string    `json:"value,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
 type Response struct {
 	Status  int                 `json:"status"`
 	Headers map[string][]string `json:"headers"`
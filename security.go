@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"go.uber.org/zap"
 
@@ -55,6 +56,13 @@ func (g *Gojinn) loadWasmSecurely(path string) ([]byte, error) {
 	return cleanBytes, nil
 }
 
+func (g *Gojinn) signingSecret() string {
+	if g.StoreCipherKey != "" {
+		return g.StoreCipherKey
+	}
+	return "gojinn-default-audit-secret"
+}
+
 func (g *Gojinn) saveCrashDump(filename string, data []byte) {
 	if g.CrashPath == "" {
 		g.CrashPath = "./crashes"
@@ -72,3 +80,17 @@ func (g *Gojinn) saveCrashDump(filename string, data []byte) {
 		g.logger.Info("Crash Dump Saved (Time Travel Ready)", zap.String("file", fullPath))
 	}
 }
+
+func (g *Gojinn) checkEgress(hostname string) error {
+	if len(g.AllowedHosts) == 0 {
+		return nil
+	}
+	hostname = strings.ToLower(hostname)
+	for _, host := range g.AllowedHosts {
+		host = strings.ToLower(host)
+		if host == "*" || hostname == host || strings.HasSuffix(hostname, "."+host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("egress denied to %s", hostname)
+}
@@ -0,0 +1,123 @@
+package gojinn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	headerStream = "Gojinn-Stream"
+	streamOpen   = "open"
+	streamChunk  = "chunk"
+
+	streamChunkSize = 256 * 1024
+)
+
+type streamHead struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// responseStream forwards partial output written by the guest through the
+// host_stream_* functions. In sync mode chunks are published to the reply
+// inbox as they are flushed; without a waiting client they are appended to
+// the job's regular stdout instead.
+type responseStream struct {
+	nc       *nats.Conn
+	replyTo  string
+	fallback io.Writer
+
+	buf    bytes.Buffer
+	opened bool
+}
+
+func newResponseStream(nc *nats.Conn, replyTo string, fallback io.Writer) *responseStream {
+	return &responseStream{nc: nc, replyTo: replyTo, fallback: fallback}
+}
+
+func (s *responseStream) Open(status int, headers map[string][]string) error {
+	if s.opened {
+		return fmt.Errorf("stream already opened")
+	}
+	s.opened = true
+	if s.replyTo == "" {
+		return nil
+	}
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+	head, err := json.Marshal(streamHead{Status: status, Headers: headers})
+	if err != nil {
+		return err
+	}
+	return s.publish(streamOpen, head)
+}
+
+func (s *responseStream) Write(p []byte) (int, error) {
+	if s.replyTo == "" {
+		return s.fallback.Write(p)
+	}
+	if !s.opened {
+		if err := s.Open(http.StatusOK, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	n, _ := s.buf.Write(p)
+	if s.buf.Len() >= streamChunkSize {
+		return n, s.Flush()
+	}
+	return n, nil
+}
+
+func (s *responseStream) Flush() error {
+	if s.replyTo == "" || s.buf.Len() == 0 {
+		return nil
+	}
+	err := s.publish(streamChunk, s.buf.Bytes())
+	s.buf.Reset()
+	return err
+}
+
+// Started reports whether the client has already received the response head,
+// after which the function's stdout no longer shapes the HTTP response.
+func (s *responseStream) Started() bool {
+	return s.opened && s.replyTo != ""
+}
+
+func (s *responseStream) publish(kind string, data []byte) error {
+	msg := nats.NewMsg(s.replyTo)
+	msg.Header.Set(headerStream, kind)
+	msg.Data = data
+	return s.nc.PublishMsg(msg)
+}
+
+// writeStreamHead starts a streamed HTTP response from an open message.
+func writeStreamHead(rw http.ResponseWriter, data []byte) {
+	var head streamHead
+	_ = json.Unmarshal(data, &head)
+
+	for k, values := range head.Headers {
+		for _, v := range values {
+			rw.Header().Add(k, v)
+		}
+	}
+	if rw.Header().Get("Content-Type") == "" {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+	}
+	rw.Header().Del("Content-Length")
+
+	if head.Status == 0 {
+		head.Status = http.StatusOK
+	}
+	rw.WriteHeader(head.Status)
+	if f, ok := rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
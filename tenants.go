@@ -0,0 +1,302 @@
+package gojinn
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/dustin/go-humanize"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+const (
+	tenantRegistryBucket = "GOJINN_TENANTS"
+
+	// headerAdminKey carries the admin_key the tenant registry API requires.
+	headerAdminKey = "X-Gojinn-Admin-Key"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[-_=A-Za-z0-9]+$`)
+
+// TenantConfig overrides the block-level execution limits for one tenant.
+// Zero values inherit the Caddyfile (or route) setting; Env is merged on top
+// of it and Perms, when present, replaces it.
+type TenantConfig struct {
+	PoolSize     int               `json:"pool_size,omitempty"`
+	PoolMin      int               `json:"pool_min,omitempty"`
+	PoolMax      int               `json:"pool_max,omitempty"`
+	MemoryLimit  string            `json:"memory_limit,omitempty"`
+	FuelLimit    uint64            `json:"fuel_limit,omitempty"`
+	Timeout      caddy.Duration    `json:"timeout,omitempty"`
+	JobRetention caddy.Duration    `json:"job_retention,omitempty"`
+	DedupeWindow caddy.Duration    `json:"dedupe_window,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	Perms        *Permissions      `json:"permissions,omitempty"`
+	RateLimit    float64           `json:"rate_limit,omitempty"`
+	RateBurst    int               `json:"rate_burst,omitempty"`
+}
+
+func (c *TenantConfig) validate() error {
+	if c.PoolSize < 0 || c.PoolMin < 0 || c.PoolMax < 0 {
+		return fmt.Errorf("pool sizes must not be negative")
+	}
+	if c.Timeout < 0 || c.JobRetention < 0 || c.DedupeWindow < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if c.MemoryLimit != "" {
+		if _, err := humanize.ParseBytes(c.MemoryLimit); err != nil {
+			return fmt.Errorf("invalid memory_limit: %w", err)
+		}
+	}
+	return nil
+}
+
+// setupTenantRegistry loads the tenant overrides and keeps them in sync with
+// the registry bucket, so changes made on any node apply cluster-wide.
+func (r *Gojinn) setupTenantRegistry() error {
+	kv, err := r.js.KeyValue(tenantRegistryBucket)
+	if err != nil {
+		kv, err = r.js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      tenantRegistryBucket,
+			Description: "Per-tenant configuration overrides",
+			Storage:     nats.FileStorage,
+			History:     5,
+			Replicas:    r.ClusterReplicas,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to provision tenant registry: %w", err)
+		}
+	}
+	r.tenantRegistry = kv
+
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return fmt.Errorf("failed to watch tenant registry: %w", err)
+	}
+	r.tenantWatcher = watcher
+
+	// The watcher delivers every stored entry followed by a nil marker.
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		r.applyTenantEntry(entry)
+	}
+
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				r.applyTenantEntry(entry)
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *Gojinn) applyTenantEntry(entry nats.KeyValueEntry) {
+	tenantID := entry.Key()
+
+	var cfg *TenantConfig
+	if entry.Operation() == nats.KeyValuePut {
+		cfg = &TenantConfig{}
+		if err := json.Unmarshal(entry.Value(), cfg); err != nil {
+			r.logger.Error("Ignoring invalid tenant config", zap.String("tenant", tenantID), zap.Error(err))
+			return
+		}
+	}
+
+	r.tenantConfigsMu.Lock()
+	if cfg == nil {
+		delete(r.tenantConfigs, tenantID)
+	} else {
+		r.tenantConfigs[tenantID] = cfg
+	}
+	r.tenantConfigsMu.Unlock()
+
+	r.limitersMu.Lock()
+	delete(r.limiters, tenantID)
+	r.limitersMu.Unlock()
+
+	r.recycleTenantWorkers(tenantID)
+	r.logger.Info("Tenant configuration applied", zap.String("tenant", tenantID), zap.Bool("override", cfg != nil))
+}
+
+// recycleTenantWorkers drains the workers of tenantID so the next request
+// provisions them again with the current configuration.
+func (r *Gojinn) recycleTenantWorkers(tenantID string) {
+	r.subsMu.Lock()
+	defer r.subsMu.Unlock()
+
+	for _, pool := range r.tenantSubs[tenantID] {
+		r.dropWorkerPool(pool)
+	}
+	delete(r.tenantSubs, tenantID)
+	delete(r.tenantLastSeen, tenantID)
+	// The dedupe window and job retention may have changed as well.
+	r.provisioned.Delete(tenantID)
+}
+
+func (r *Gojinn) tenantConfig(tenantID string) *TenantConfig {
+	r.tenantConfigsMu.RLock()
+	defer r.tenantConfigsMu.RUnlock()
+	return r.tenantConfigs[tenantID]
+}
+
+// tenantFunction returns fn with the overrides registered for tenantID applied.
+func (r *Gojinn) tenantFunction(tenantID string, fn *functionSpec) *functionSpec {
+	cfg := r.tenantConfig(tenantID)
+	if cfg == nil {
+		return fn
+	}
+
+	out := *fn
+	if cfg.PoolSize > 0 {
+		out.PoolSize = cfg.PoolSize
+	}
+	if cfg.PoolMin > 0 {
+		out.PoolMin = cfg.PoolMin
+	}
+	if cfg.PoolMax > 0 {
+		out.PoolMax = cfg.PoolMax
+	}
+	if cfg.MemoryLimit != "" {
+		out.MemoryLimit = cfg.MemoryLimit
+	}
+	if cfg.FuelLimit > 0 {
+		out.FuelLimit = cfg.FuelLimit
+	}
+	if cfg.Timeout > 0 {
+		out.Timeout = time.Duration(cfg.Timeout)
+	}
+	if len(cfg.Env) > 0 {
+		env := make(map[string]string, len(fn.Env)+len(cfg.Env))
+		for k, v := range fn.Env {
+			env[k] = v
+		}
+		for k, v := range cfg.Env {
+			env[k] = v
+		}
+		out.Env = env
+	}
+	if cfg.Perms != nil {
+		out.Perms = *cfg.Perms
+	}
+	return &out
+}
+
+func (r *Gojinn) adminAuthorized(req *http.Request) bool {
+	if r.AdminKey == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get(headerAdminKey)), []byte(r.AdminKey)) == 1
+}
+
+// tenantLabel is how the registry API lists tenantID. With api_keys the tenant
+// IDs are the keys themselves, so they are listed by fingerprint instead.
+func (r *Gojinn) tenantLabel(tenantID string) string {
+	if len(r.APIKeys) == 0 || tenantID == DefaultTriggerTenant {
+		return tenantID
+	}
+	return "key-" + hashString(tenantID)[:16]
+}
+
+// serveTenantAdmin implements the tenant registry API:
+//
+//	GET    /_sys/tenants        list every override
+//	GET    /_sys/tenants/{id}   read one override
+//	PUT    /_sys/tenants/{id}   create or replace an override
+//	DELETE /_sys/tenants/{id}   drop an override
+//
+// Every method requires the admin_key; without one configured the API is
+// closed.
+func (r *Gojinn) serveTenantAdmin(rw http.ResponseWriter, req *http.Request) error {
+	if !r.adminAuthorized(req) {
+		http.Error(rw, "admin key required", http.StatusUnauthorized)
+		return nil
+	}
+	if r.tenantRegistry == nil {
+		http.Error(rw, "tenant registry not ready", http.StatusServiceUnavailable)
+		return nil
+	}
+
+	tenantID := strings.Trim(strings.TrimPrefix(req.URL.Path, "/_sys/tenants"), "/")
+	if tenantID == "" {
+		if req.Method != http.MethodGet {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return nil
+		}
+		r.tenantConfigsMu.RLock()
+		configs := make(map[string]*TenantConfig, len(r.tenantConfigs))
+		for id, cfg := range r.tenantConfigs {
+			configs[r.tenantLabel(id)] = cfg
+		}
+		r.tenantConfigsMu.RUnlock()
+		rw.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(rw).Encode(configs)
+	}
+
+	if !tenantIDPattern.MatchString(tenantID) {
+		http.Error(rw, "invalid tenant id", http.StatusBadRequest)
+		return nil
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		entry, err := r.tenantRegistry.Get(tenantID)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			http.Error(rw, "tenant has no configuration override", http.StatusNotFound)
+			return nil
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_, err = rw.Write(entry.Value())
+		return err
+
+	case http.MethodPut:
+		var cfg TenantConfig
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			http.Error(rw, "invalid tenant config: "+err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if err := cfg.validate(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+
+		data, _ := json.Marshal(cfg)
+		if _, err := r.tenantRegistry.Put(tenantID, data); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		r.logger.Info("Tenant configuration updated", zap.String("tenant", tenantID))
+
+		rw.Header().Set("Content-Type", "application/json")
+		_, err := rw.Write(data)
+		return err
+
+	case http.MethodDelete:
+		if err := r.tenantRegistry.Delete(tenantID); err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		rw.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	return nil
+}
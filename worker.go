@@ -3,11 +3,9 @@ package gojinn
 import (
 	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +15,8 @@ import (
 )
 
 const (
+	// MaxRetries is the number of attempts a job gets when its function has
+	// no retry policy.
 	MaxRetries     = 5
 	MaxOutputBytes = 5 * 1024 * 1024
 )
@@ -52,7 +52,7 @@ func (r *Gojinn) runSyncJob(ctx context.Context, wasmPath string, input string)
 		return "", err
 	}
 
-	pair, err := r.createWazeroRuntime(wasmBytes)
+	pair, err := r.createWazeroRuntime(wasmBytes, r.MemoryLimit, r.FuelLimit)
 	if err != nil {
 		return "", err
 	}
@@ -67,6 +67,8 @@ func (r *Gojinn) runSyncJob(ctx context.Context, wasmPath string, input string)
 	cwOut := &cappedWriter{buf: stdout, limit: MaxOutputBytes, cancel: cancel}
 	cwErr := &cappedWriter{buf: stderr, limit: MaxOutputBytes, cancel: cancel}
 
+	execCtx = withInvocation(execCtx, &invocation{TenantID: DefaultTriggerTenant, Stream: newResponseStream(r.natsConn, "", cwOut)})
+
 	fsConfig := wazero.NewFSConfig()
 	for host, guest := range r.Mounts {
 		fsConfig = fsConfig.WithDirMount(host, guest)
@@ -84,7 +86,7 @@ func (r *Gojinn) runSyncJob(ctx context.Context, wasmPath string, input string)
 		modConfig = modConfig.WithEnv(k, v)
 	}
 
-	mod, err := pair.Runtime.InstantiateModule(execCtx, pair.Code, modConfig)
+	mod, err := r.runModule(execCtx, pair, modConfig)
 	if err != nil {
 		return "", fmt.Errorf("wasm sync execution failed: %w | stderr: %s", err, stderr.String())
 	}
@@ -93,122 +95,230 @@ func (r *Gojinn) runSyncJob(ctx context.Context, wasmPath string, input string)
 	return stdout.String(), nil
 }
 
-func (r *Gojinn) startTenantWorker(tenantID string, streamName string, id int, topic string, wasmBytes []byte) (*nats.Subscription, error) {
-	pair, err := r.createWazeroRuntime(wasmBytes)
+func (r *Gojinn) startTenantWorker(tenantID string, streamName string, id int, fn *functionSpec, wasmBytes []byte, pool *workerPool) (*nats.Subscription, error) {
+	pair, err := r.createWazeroRuntime(wasmBytes, fn.MemoryLimit, fn.FuelLimit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create wazero runtime for tenant %s worker %d: %w", tenantID, id, err)
 	}
 
-	queueGroup := fmt.Sprintf("WORKERS_%s", tenantID)
-
-	sub, err := r.js.QueueSubscribe(topic, queueGroup, func(m *nats.Msg) {
+	sub, err := r.js.QueueSubscribe(fn.Subject(tenantID), fn.QueueGroup(tenantID), func(m *nats.Msg) {
 		meta, err := m.Metadata()
 		if err != nil {
 			r.logger.Error("Failed to get msg metadata", zap.Error(err))
 			_ = m.Nak()
 			return
 		}
+		// Jobs released by the scheduler keep the ID they were given when
+		// scheduled; everything else is known by its stream sequence.
+		jobID := m.Header.Get(headerJobID)
+		if jobID == "" {
+			jobID = strconv.FormatUint(meta.Sequence.Stream, 10)
+		}
+		r.executeJob(m, meta, tenantID, jobID, fn, pair)
+		pool.observe(meta.Timestamp)
+	}, nats.ManualAck(), nats.BindStream(streamName), nats.MaxDeliver(fn.Retry.maxDeliver()))
+	if err != nil {
+		_ = pair.Runtime.Close(context.Background())
+		return nil, err
+	}
 
-		deliverCount := meta.NumDelivered
-		_ = m.InProgress()
+	sub.SetClosedHandler(func(string) {
+		_ = pair.Runtime.Close(context.Background())
+	})
+	return sub, nil
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout))
-		defer cancel()
+// ensureJobWorkers starts the workers a job needs on this node, which may not
+// have served the tenant since it started: the async pool when its headers
+// name a module, the pool of the function with key fnKey otherwise.
+func (r *Gojinn) ensureJobWorkers(tenantID string, h nats.Header, fnKey string) error {
+	if _, err := r.EnsureTenantResources(tenantID); err != nil {
+		return err
+	}
+	if h.Get(headerAsyncModule) != "" {
+		return r.ensureAsyncWorkers(tenantID)
+	}
+	fn := r.lookupFunction(fnKey)
+	if fn == nil {
+		return fmt.Errorf("function %s is no longer configured", fnKey)
+	}
+	return r.ensureFunctionWorkers(tenantID, r.tenantFunction(tenantID, fn))
+}
 
-		stdoutBuf := bufferPool.Get().(*bytes.Buffer)
-		stdoutBuf.Reset()
-		defer bufferPool.Put(stdoutBuf)
+// executeJob runs one delivery of a job message in pair and settles it:
+// acked when it succeeds or is dead, redelivered with backoff otherwise.
+func (r *Gojinn) executeJob(m *nats.Msg, meta *nats.MsgMetadata, tenantID, jobID string, fn *functionSpec, pair *EnginePair) {
+	deliverCount := meta.NumDelivered
+	_ = m.InProgress()
 
-		stderrBuf := bufferPool.Get().(*bytes.Buffer)
-		stderrBuf.Reset()
-		defer bufferPool.Put(stderrBuf)
+	r.touchTenant(tenantID)
+	// A job that has not started yet waits for a slot as long as it takes.
+	release, _ := r.acquireSandbox(context.Background(), m)
+	defer func() { release() }()
 
-		cwOut := &cappedWriter{buf: stdoutBuf, limit: MaxOutputBytes, cancel: cancel}
-		cwErr := &cappedWriter{buf: stderrBuf, limit: MaxOutputBytes, cancel: cancel}
+	r.updateJob(tenantID, jobID, func(j *JobRecord) {
+		j.State = JobRunning
+		j.Attempts = int(deliverCount) //nolint:gosec
+	})
 
-		fsConfig := wazero.NewFSConfig()
-		for host, guest := range r.Mounts {
-			fsConfig = fsConfig.WithDirMount(host, guest)
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), fn.Timeout)
+	defer cancel()
 
-		modConfig := wazero.NewModuleConfig().
-			WithStdout(cwOut).
-			WithStderr(cwErr).
-			WithStdin(bytes.NewReader(m.Data)).
-			WithSysWalltime().
-			WithSysNanotime().
-			WithFSConfig(fsConfig)
+	stdoutBuf := bufferPool.Get().(*bytes.Buffer)
+	stdoutBuf.Reset()
+	defer bufferPool.Put(stdoutBuf)
 
-		for k, v := range r.Env {
-			modConfig = modConfig.WithEnv(k, v)
-		}
+	stderrBuf := bufferPool.Get().(*bytes.Buffer)
+	stderrBuf.Reset()
+	defer bufferPool.Put(stderrBuf)
 
-		mod, err := pair.Runtime.InstantiateModule(ctx, pair.Code, modConfig)
-		if err != nil {
-			errMsg := fmt.Sprintf("Wasm Error/Quota Exceeded: %v | Stderr: %s", err, stderrBuf.String())
-
-			if deliverCount >= MaxRetries {
-				snapshot := CrashSnapshot{
-					Timestamp: time.Now(),
-					Error:     errMsg,
-					Input:     json.RawMessage(m.Data),
-					Env:       r.Env,
-					WasmFile:  r.Path,
+	cwOut := &cappedWriter{buf: stdoutBuf, limit: MaxOutputBytes, cancel: cancel}
+	cwErr := &cappedWriter{buf: stderrBuf, limit: MaxOutputBytes, cancel: cancel}
+
+	var asyncWorker *nats.Subscription
+	if m.Header.Get(headerAsyncModule) != "" {
+		asyncWorker = m.Sub
+	}
+	inv := &invocation{
+		TenantID:    tenantID,
+		JobID:       jobID,
+		Function:    fn,
+		Stream:      newResponseStream(r.natsConn, m.Header.Get(headerReplyTo), cwOut),
+		AsyncWorker: asyncWorker,
+		Yield: func() func() error {
+			release()
+			release = func() {}
+			return func() error {
+				rel, err := r.acquireSandbox(ctx, m)
+				if err != nil {
+					return err
 				}
-				dumpBytes, _ := json.MarshalIndent(snapshot, "", "  ")
-				filename := fmt.Sprintf("crash_tenant_%s_%s_seq%d.json", tenantID, time.Now().Format("20060102-150405"), meta.Sequence.Stream)
-				r.saveCrashDump(filename, dumpBytes)
-				_ = m.Ack()
-				return
+				release = rel
+				return nil
 			}
+		},
+	}
+	ctx = withInvocation(ctx, inv)
 
-			backoff := time.Duration(deliverCount) * time.Second
-			_ = m.NakWithDelay(backoff)
-			return
+	fsConfig := wazero.NewFSConfig()
+	for host, guest := range r.Mounts {
+		fsConfig = fsConfig.WithDirMount(host, guest)
+	}
+
+	modConfig := wazero.NewModuleConfig().
+		WithStdout(cwOut).
+		WithStderr(cwErr).
+		WithStdin(bytes.NewReader(m.Data)).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithFSConfig(fsConfig)
+
+	for k, v := range fn.Env {
+		modConfig = modConfig.WithEnv(k, v)
+	}
+
+	mod, err := r.runModule(ctx, pair, modConfig)
+	if err != nil {
+		errMsg := fmt.Sprintf("Wasm Error/Quota Exceeded: %v | Stderr: %s", err, stderrBuf.String())
+
+		class := classifyFailure(ctx, err)
+		fuelExhausted := class == FailureFuel
+		if fuelExhausted && r.metrics != nil {
+			r.metrics.fuelExhausted.WithLabelValues(fn.Name).Inc()
 		}
 
-		if stdoutBuf.Len() > 0 {
-			r.logger.Info("Tenant Worker Output", zap.String("tenant", tenantID), zap.String("stdout", strings.TrimSpace(stdoutBuf.String())))
+		// Once the client has the head of a streamed response, a retry would
+		// send it a second head and body, so the job fails for good.
+		if deliverCount >= uint64(fn.Retry.Max) || !fn.Retry.retries(class) || inv.Stream.Started() { //nolint:gosec
+			r.buryJob(m, tenantID, jobID, fn, stdoutBuf.String(), stderrBuf.String(), errMsg, fuelExhausted)
+			return
 		}
-		if stderrBuf.Len() > 0 {
-			r.logger.Info("Tenant Worker Log", zap.String("tenant", tenantID), zap.String("stderr", strings.TrimSpace(stderrBuf.String())))
+
+		r.finishJob(m, tenantID, jobID, JobFailed, stdoutBuf.String(), stderrBuf.String(), errMsg)
+		_ = m.NakWithDelay(fn.Retry.delay(deliverCount))
+		return
+	}
+
+	if stdoutBuf.Len() > 0 {
+		r.logger.Info("Tenant Worker Output", zap.String("tenant", tenantID), zap.String("stdout", strings.TrimSpace(stdoutBuf.String())))
+	}
+	if stderrBuf.Len() > 0 {
+		r.logger.Info("Tenant Worker Log", zap.String("tenant", tenantID), zap.String("stderr", strings.TrimSpace(stderrBuf.String())))
+	}
+
+	kvBucket := fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID))
+	kv, kvErr := r.js.KeyValue(kvBucket)
+	if kvErr == nil {
+		outStr := strings.TrimSpace(stdoutBuf.String())
+		errStr := strings.TrimSpace(stderrBuf.String())
+		timestamp := time.Now().UTC().Format(time.RFC3339)
+
+		payload := fmt.Sprintf("tenant:%s|job:%s|out:%s|err:%s|ts:%s", tenantID, jobID, outStr, errStr, timestamp)
+
+		signature := signPayload(r.signingSecret(), []byte(payload))
+
+		auditData := map[string]interface{}{
+			"job_id":    jobID,
+			"timestamp": timestamp,
+			"signature": signature,
+			"status":    "success",
 		}
+		auditJSON, _ := json.Marshal(auditData)
 
-		kvBucket := fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID))
-		kv, kvErr := r.js.KeyValue(kvBucket)
-		if kvErr == nil {
-			outStr := strings.TrimSpace(stdoutBuf.String())
-			errStr := strings.TrimSpace(stderrBuf.String())
-			timestamp := time.Now().UTC().Format(time.RFC3339)
+		auditKey := kvAuditPrefix + jobID
+		_, _ = kv.Put(auditKey, auditJSON)
 
-			payload := fmt.Sprintf("tenant:%s|job:%d|out:%s|err:%s|ts:%s", tenantID, meta.Sequence.Stream, outStr, errStr, timestamp)
+		r.logger.Info("Signed Audit Log Saved", zap.String("tenant", tenantID), zap.String("audit_key", auditKey), zap.String("signature", signature[:16]+"..."))
+	}
 
-			secret := r.StoreCipherKey
-			if secret == "" {
-				secret = "gojinn-default-audit-secret"
-			}
-			mac := hmac.New(sha256.New, []byte(secret))
-			mac.Write([]byte(payload))
-			signature := hex.EncodeToString(mac.Sum(nil))
-
-			auditData := map[string]interface{}{
-				"job_id":    meta.Sequence.Stream,
-				"timestamp": timestamp,
-				"signature": signature,
-				"status":    "success",
-			}
-			auditJSON, _ := json.Marshal(auditData)
+	if err := inv.Stream.Flush(); err != nil {
+		r.logger.Warn("Failed to flush response stream", zap.String("tenant", tenantID), zap.Error(err))
+	}
 
-			auditKey := fmt.Sprintf("audit.job.%d", meta.Sequence.Stream)
-			_, _ = kv.Put(auditKey, auditJSON)
+	mod.Close(ctx)
+	r.finishJob(m, tenantID, jobID, JobSucceeded, stdoutBuf.String(), stderrBuf.String(), "")
+	_ = m.Ack()
+}
 
-			r.logger.Info("Signed Audit Log Saved", zap.String("tenant", tenantID), zap.String("audit_key", auditKey), zap.String("signature", signature[:16]+"..."))
+// finishJob records the outcome of an attempt in the job store and, once the
+// job is terminal, queues its completion webhook, advances the workflow it is
+// a step of and publishes it to the reply inbox carried in its headers if the
+// submitter is waiting for one (sync mode).
+func (r *Gojinn) finishJob(m *nats.Msg, tenantID, jobID, state, stdout, stderr, errMsg string) *JobRecord {
+	rec := r.updateJob(tenantID, jobID, func(j *JobRecord) {
+		j.State = state
+		j.Stdout = stdout
+		j.Stderr = stderr
+		j.Error = errMsg
+		if errMsg != "" {
+			j.recordAttempt(errMsg)
 		}
+	})
 
-		mod.Close(ctx)
-		_ = m.Ack()
+	if r.metrics != nil {
+		r.metrics.jobsTotal.WithLabelValues(state).Inc()
+	}
+
+	if state == JobFailed {
+		return rec
+	}
+	r.enqueueCallback(m, tenantID, rec)
+	r.settleWorkflowStep(m.Header, tenantID, rec)
 
-	}, nats.ManualAck(), nats.BindStream(streamName), nats.MaxDeliver(MaxRetries+1))
+	replyTo := m.Header.Get(headerReplyTo)
+	if replyTo == "" {
+		return rec
+	}
 
-	return sub, err
+	reply := nats.NewMsg(replyTo)
+	reply.Header.Set(headerJobStatus, state)
+	if errMsg != "" {
+		reply.Header.Set(headerJobError, errMsg)
+	}
+	reply.Data = []byte(stdout)
+
+	if err := r.natsConn.PublishMsg(reply); err != nil {
+		r.logger.Warn("Failed to publish sync job result", zap.String("reply_to", replyTo), zap.Error(err))
+	}
+	return rec
 }
@@ -0,0 +1,724 @@
+package gojinn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"go.uber.org/zap"
+)
+
+const (
+	WorkflowRunning      = "running"
+	WorkflowSucceeded    = "succeeded"
+	WorkflowCompensating = "compensating"
+	WorkflowCompensated  = "compensated"
+	WorkflowFailed       = "failed"
+
+	StepWaiting            = "waiting"
+	StepPending            = "pending"
+	StepSucceeded          = "succeeded"
+	StepFailed             = "failed"
+	StepCompensating       = "compensating"
+	StepCompensated        = "compensated"
+	StepCompensationFailed = "compensation_failed"
+
+	headerWorkflowID    = "Gojinn-Workflow-Id"
+	headerWorkflowStep  = "Gojinn-Workflow-Step"
+	headerWorkflowPhase = "Gojinn-Workflow-Phase"
+
+	workflowPhaseCompensate = "compensate"
+
+	// maxWorkflowConflicts bounds the optimistic retries of a run update
+	// racing with the other steps of its stage.
+	maxWorkflowConflicts = 16
+
+	// workflowResumeInterval is how often each node looks for runs left
+	// behind by a crash; workflowResumeGrace keeps it off runs that are
+	// simply being advanced right now.
+	workflowResumeInterval = time.Minute
+	workflowResumeGrace    = 30 * time.Second
+)
+
+var workflowNamePattern = regexp.MustCompile(`^[-_A-Za-z0-9]+$`)
+
+var errWorkflowNotFound = errors.New("workflow not found")
+
+// Workflow chains functions into a saga. Stages run in order and the steps
+// of a stage run in parallel, each as an async job with its own retries. When
+// a step fails for good, the compensating functions of the steps that
+// already succeeded run in reverse order.
+type Workflow struct {
+	Name   string           `json:"name"`
+	Stages [][]WorkflowStep `json:"stages"`
+}
+
+type WorkflowStep struct {
+	Name       string `json:"name"`
+	WasmFile   string `json:"wasm_file"`
+	Compensate string `json:"compensate,omitempty"`
+}
+
+func (w *Workflow) validate() error {
+	if !workflowNamePattern.MatchString(w.Name) {
+		return fmt.Errorf("invalid workflow name %q", w.Name)
+	}
+	if len(w.Stages) == 0 {
+		return fmt.Errorf("workflow %s has no steps", w.Name)
+	}
+	seen := make(map[string]bool)
+	for _, stage := range w.Stages {
+		if len(stage) == 0 {
+			return fmt.Errorf("workflow %s has an empty parallel block", w.Name)
+		}
+		for _, step := range stage {
+			if !workflowNamePattern.MatchString(step.Name) {
+				return fmt.Errorf("workflow %s: invalid step name %q", w.Name, step.Name)
+			}
+			if seen[step.Name] {
+				return fmt.Errorf("workflow %s: duplicate step %q", w.Name, step.Name)
+			}
+			seen[step.Name] = true
+			if step.WasmFile == "" {
+				return fmt.Errorf("workflow %s: step %s has no wasm file", w.Name, step.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// WorkflowRun is the persisted state of one execution of a workflow. It
+// carries the definition it was started with, so a configuration reload does
+// not change the course of runs in flight.
+type WorkflowRun struct {
+	ID        string               `json:"id"`
+	Workflow  string               `json:"workflow"`
+	Tenant    string               `json:"tenant"`
+	State     string               `json:"state"`
+	Stage     int                  `json:"stage"`
+	Input     string               `json:"input"`
+	Output    string               `json:"output,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	Stages    [][]*WorkflowStepRun `json:"stages"`
+	CreatedAt time.Time            `json:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at"`
+}
+
+type WorkflowStepRun struct {
+	WorkflowStep
+	State             string `json:"state"`
+	JobID             string `json:"job_id,omitempty"`
+	Input             string `json:"input,omitempty"`
+	Output            string `json:"output,omitempty"`
+	Error             string `json:"error,omitempty"`
+	CompensationJobID string `json:"compensation_job_id,omitempty"`
+}
+
+// stepDispatch is a job a run update decided to start.
+type stepDispatch struct {
+	step       *WorkflowStepRun
+	compensate bool
+}
+
+// workflowKey is where the state of a run is kept in the tenant STATE bucket,
+// under the reserved prefix so functions cannot forge step results.
+func workflowKey(runID string) string {
+	return kvReservedPrefix + "workflow." + runID
+}
+
+func newWorkflowRun(wf *Workflow, runID, tenantID, input string) *WorkflowRun {
+	now := time.Now().UTC()
+	run := &WorkflowRun{
+		ID:        runID,
+		Workflow:  wf.Name,
+		Tenant:    tenantID,
+		State:     WorkflowRunning,
+		Input:     input,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, stage := range wf.Stages {
+		steps := make([]*WorkflowStepRun, 0, len(stage))
+		for _, step := range stage {
+			steps = append(steps, &WorkflowStepRun{WorkflowStep: step, State: StepWaiting})
+		}
+		run.Stages = append(run.Stages, steps)
+	}
+	return run
+}
+
+func (run *WorkflowRun) step(name string) *WorkflowStepRun {
+	for _, stage := range run.Stages {
+		for _, s := range stage {
+			if s.Name == name {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// startStage marks the steps of stage pending on input and returns their jobs.
+// Job IDs derive from the run, so a step dispatched twice is one job.
+func (run *WorkflowRun) startStage(stage int, input string) []stepDispatch {
+	run.Stage = stage
+	var jobs []stepDispatch
+	for _, s := range run.Stages[stage] {
+		s.State = StepPending
+		s.JobID = run.ID + "." + s.Name
+		s.Input = input
+		jobs = append(jobs, stepDispatch{step: s})
+	}
+	return jobs
+}
+
+// applyResult records the terminal outcome of a step job, or of its
+// compensation, and returns the jobs to start next. Outcomes of steps that
+// already settled are ignored, so a redelivered job is harmless.
+func (run *WorkflowRun) applyResult(name string, compensate bool, rec *JobRecord) []stepDispatch {
+	s := run.step(name)
+	if s == nil {
+		return nil
+	}
+	output, errMsg := jobOutcome(rec)
+
+	if compensate {
+		if s.State != StepCompensating {
+			return nil
+		}
+		s.State = StepCompensated
+		if errMsg != "" {
+			s.State = StepCompensationFailed
+			s.Error = errMsg
+		}
+		return run.nextCompensation()
+	}
+
+	if s.State != StepPending {
+		return nil
+	}
+	if errMsg != "" {
+		s.State = StepFailed
+		s.Error = errMsg
+		if run.State == WorkflowRunning {
+			run.State = WorkflowCompensating
+			run.Error = fmt.Sprintf("step %s failed: %s", name, errMsg)
+		}
+	} else {
+		s.State = StepSucceeded
+		s.Output = output
+	}
+
+	for _, sibling := range run.Stages[run.Stage] {
+		if sibling.State == StepPending {
+			return nil
+		}
+	}
+	if run.State == WorkflowCompensating {
+		return run.nextCompensation()
+	}
+
+	out := run.stageOutput(run.Stage)
+	if run.Stage == len(run.Stages)-1 {
+		run.State = WorkflowSucceeded
+		run.Output = out
+		return nil
+	}
+	return run.startStage(run.Stage+1, out)
+}
+
+// nextCompensation starts the compensation of the latest succeeded step that
+// has one. Compensations run one at a time; when none is left the run ends.
+func (run *WorkflowRun) nextCompensation() []stepDispatch {
+	for stage := run.Stage; stage >= 0; stage-- {
+		steps := run.Stages[stage]
+		for i := len(steps) - 1; i >= 0; i-- {
+			s := steps[i]
+			if s.State == StepCompensating {
+				return nil
+			}
+			if s.State == StepSucceeded && s.Compensate != "" {
+				s.State = StepCompensating
+				s.CompensationJobID = s.JobID + ".undo"
+				return []stepDispatch{{step: s, compensate: true}}
+			}
+		}
+	}
+
+	run.State = WorkflowCompensated
+	for _, stage := range run.Stages {
+		for _, s := range stage {
+			if s.State == StepCompensationFailed {
+				run.State = WorkflowFailed
+			}
+		}
+	}
+	return nil
+}
+
+// stageOutput is the input of the stage after stage: the output of its only
+// step, or a JSON object of the outputs of its parallel steps by name.
+func (run *WorkflowRun) stageOutput(stage int) string {
+	steps := run.Stages[stage]
+	if len(steps) == 1 {
+		return steps[0].Output
+	}
+	outputs := make(map[string]json.RawMessage, len(steps))
+	for _, s := range steps {
+		if s.Output != "" && json.Valid([]byte(s.Output)) {
+			outputs[s.Name] = json.RawMessage(s.Output)
+		} else {
+			outputs[s.Name], _ = json.Marshal(s.Output)
+		}
+	}
+	data, _ := json.Marshal(outputs)
+	return string(data)
+}
+
+// jobOutcome reads the output of a terminal job, or why it failed. A
+// function response with an error status counts as a failure.
+func jobOutcome(rec *JobRecord) (string, string) {
+	if rec.State != JobSucceeded {
+		if rec.Error != "" {
+			return "", rec.Error
+		}
+		return "", "job " + rec.State
+	}
+	var resp FunctionResponse
+	if err := json.Unmarshal(bytes.TrimSpace([]byte(rec.Stdout)), &resp); err != nil {
+		return strings.TrimSpace(rec.Stdout), ""
+	}
+	if resp.Status >= http.StatusBadRequest {
+		return "", fmt.Sprintf("status %d: %s", resp.Status, resp.Body)
+	}
+	return resp.Body, ""
+}
+
+func (r *Gojinn) lookupWorkflow(name string) *Workflow {
+	for i := range r.Workflows {
+		if r.Workflows[i].Name == name {
+			return &r.Workflows[i]
+		}
+	}
+	return nil
+}
+
+// setupWorkflows validates the declared workflows and starts the sweep that
+// resumes runs whose progress was lost with a node.
+func (r *Gojinn) setupWorkflows() error {
+	seen := make(map[string]bool)
+	for i := range r.Workflows {
+		if err := r.Workflows[i].validate(); err != nil {
+			return err
+		}
+		if seen[r.Workflows[i].Name] {
+			return fmt.Errorf("duplicate workflow %q", r.Workflows[i].Name)
+		}
+		seen[r.Workflows[i].Name] = true
+	}
+	if len(r.Workflows) == 0 {
+		return nil
+	}
+
+	r.workflowStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(workflowResumeInterval)
+		defer ticker.Stop()
+		for {
+			r.resumeWorkflows()
+			select {
+			case <-ticker.C:
+			case <-r.workflowStop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// StartWorkflow starts a run of the named workflow for tenantID on input. A
+// run with the same ID that already exists is returned instead, with
+// started set to false.
+func (r *Gojinn) StartWorkflow(tenantID, name, runID, input string) (*WorkflowRun, bool, error) {
+	wf := r.lookupWorkflow(name)
+	if wf == nil {
+		return nil, false, errWorkflowNotFound
+	}
+	kv, err := r.EnsureTenantResources(tenantID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	run := newWorkflowRun(wf, runID, tenantID, input)
+	jobs := run.startStage(0, input)
+	data, _ := json.Marshal(run)
+	if _, err := kv.Create(workflowKey(runID), data); err != nil {
+		if errors.Is(err, nats.ErrKeyExists) {
+			existing, err := r.GetWorkflowRun(tenantID, runID)
+			return existing, false, err
+		}
+		return nil, false, fmt.Errorf("failed to persist workflow run: %w", err)
+	}
+
+	r.logger.Info("Workflow Started", zap.String("tenant", tenantID), zap.String("workflow", name), zap.String("run_id", runID))
+	return run, true, r.dispatchSteps(run, jobs)
+}
+
+// GetWorkflowRun returns the stored state of a run of tenantID.
+func (r *Gojinn) GetWorkflowRun(tenantID, runID string) (*WorkflowRun, error) {
+	if r.js == nil {
+		return nil, fmt.Errorf("JetStream not ready")
+	}
+	kv, err := r.js.KeyValue(fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID)))
+	if err != nil {
+		return nil, nats.ErrKeyNotFound
+	}
+	entry, err := kv.Get(workflowKey(runID))
+	if err != nil {
+		return nil, err
+	}
+	var run WorkflowRun
+	if err := json.Unmarshal(entry.Value(), &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// advanceWorkflow applies mutate to the stored run and starts the jobs it
+// returns. The steps of a stage finish concurrently, possibly on different
+// nodes, so the write is a compare-and-swap retried on conflict.
+func (r *Gojinn) advanceWorkflow(tenantID, runID string, mutate func(*WorkflowRun) []stepDispatch) error {
+	kv, err := r.js.KeyValue(fmt.Sprintf("STATE_%s", strings.ToUpper(tenantID)))
+	if err != nil {
+		return err
+	}
+	key := workflowKey(runID)
+
+	for attempt := 0; attempt < maxWorkflowConflicts; attempt++ {
+		entry, err := kv.Get(key)
+		if err != nil {
+			return err
+		}
+		var run WorkflowRun
+		if err := json.Unmarshal(entry.Value(), &run); err != nil {
+			return err
+		}
+
+		jobs := mutate(&run)
+		data, _ := json.Marshal(run)
+		if bytes.Equal(data, entry.Value()) {
+			return nil
+		}
+		run.UpdatedAt = time.Now().UTC()
+		data, _ = json.Marshal(run)
+
+		if _, err := kv.Update(key, data, entry.Revision()); err != nil {
+			if errors.Is(err, nats.ErrKeyExists) {
+				continue
+			}
+			return err
+		}
+		if run.State != WorkflowRunning && run.State != WorkflowCompensating {
+			r.logger.Info("Workflow Finished", zap.String("tenant", tenantID), zap.String("run_id", runID), zap.String("state", run.State))
+		}
+		return r.dispatchSteps(&run, jobs)
+	}
+	return fmt.Errorf("workflow run %s: too many concurrent updates", runID)
+}
+
+// dispatchSteps queues the jobs of a run on the async stream of its tenant,
+// where they get the retry policy and dead-letter handling of any async job.
+func (r *Gojinn) dispatchSteps(run *WorkflowRun, jobs []stepDispatch) error {
+	for _, job := range jobs {
+		s := job.step
+		jobID, wasmFile, method, input := s.JobID, s.WasmFile, "WORKFLOW", s.Input
+		extra := nats.Header{}
+		extra.Set(headerWorkflowID, run.ID)
+		extra.Set(headerWorkflowStep, s.Name)
+
+		if job.compensate {
+			jobID, wasmFile, method = s.CompensationJobID, s.Compensate, "COMPENSATE"
+			data, _ := json.Marshal(map[string]string{
+				"step":   s.Name,
+				"input":  s.Input,
+				"output": s.Output,
+				"error":  run.Error,
+			})
+			input = string(data)
+			extra.Set(headerWorkflowPhase, workflowPhaseCompensate)
+		}
+
+		jobReq := JobRequest{
+			Method: method,
+			URI:    fmt.Sprintf("internal://workflow/%s/%s/%s", run.Workflow, run.ID, s.Name),
+			Headers: map[string][]string{
+				"X-Source":        {"workflow"},
+				"X-Workflow-Id":   {run.ID},
+				"X-Workflow-Step": {s.Name},
+			},
+			Body: input,
+		}
+		if err := r.submitAsyncJob(context.Background(), run.Tenant, jobID, wasmFile, jobReq, extra, time.Time{}); err != nil {
+			return fmt.Errorf("failed to start step %s of workflow run %s: %w", s.Name, run.ID, err)
+		}
+	}
+	return nil
+}
+
+// settleWorkflowStep advances the run a terminal job belongs to, if any. A
+// failure here is not lost: the resume sweep finds the terminal job later.
+func (r *Gojinn) settleWorkflowStep(h nats.Header, tenantID string, rec *JobRecord) {
+	runID := h.Get(headerWorkflowID)
+	if runID == "" {
+		return
+	}
+	step := h.Get(headerWorkflowStep)
+	compensate := h.Get(headerWorkflowPhase) == workflowPhaseCompensate
+
+	err := r.advanceWorkflow(tenantID, runID, func(run *WorkflowRun) []stepDispatch {
+		return run.applyResult(step, compensate, rec)
+	})
+	if err != nil {
+		r.logger.Warn("Failed to advance workflow", zap.String("tenant", tenantID), zap.String("run_id", runID), zap.String("step", step), zap.Error(err))
+	}
+}
+
+// resumeWorkflows scans the tenant stores for runs that stopped making
+// progress and resumes them.
+func (r *Gojinn) resumeWorkflows() {
+	for bucket := range r.js.KeyValueStoreNames() {
+		if !strings.HasPrefix(bucket, "STATE_") {
+			continue
+		}
+		kv, err := r.js.KeyValue(bucket)
+		if err != nil {
+			continue
+		}
+		watcher, err := kv.Watch(workflowKey("*"), nats.IgnoreDeletes())
+		if err != nil {
+			continue
+		}
+
+		var stalled []*WorkflowRun
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				break
+			}
+			var run WorkflowRun
+			if err := json.Unmarshal(entry.Value(), &run); err != nil {
+				continue
+			}
+			if (run.State == WorkflowRunning || run.State == WorkflowCompensating) && time.Since(run.UpdatedAt) > workflowResumeGrace {
+				stalled = append(stalled, &run)
+			}
+		}
+		_ = watcher.Stop()
+
+		for _, run := range stalled {
+			r.resumeWorkflow(run)
+		}
+	}
+}
+
+// resumeWorkflow picks up a run from the jobs of its unsettled steps: a job
+// that was never queued is queued now, a terminal one is applied to the run,
+// and one still queued gets workers on this node to run it.
+func (r *Gojinn) resumeWorkflow(run *WorkflowRun) {
+	logger := r.logger.With(zap.String("tenant", run.Tenant), zap.String("run_id", run.ID))
+	if _, err := r.EnsureTenantResources(run.Tenant); err != nil {
+		logger.Warn("Failed to provision tenant for workflow run", zap.Error(err))
+		return
+	}
+	if err := r.ensureAsyncWorkers(run.Tenant); err != nil {
+		logger.Warn("Failed to start workers for workflow run", zap.Error(err))
+		return
+	}
+
+	for _, stage := range run.Stages {
+		for _, s := range stage {
+			job := stepDispatch{step: s}
+			jobID := s.JobID
+			switch s.State {
+			case StepPending:
+			case StepCompensating:
+				job.compensate = true
+				jobID = s.CompensationJobID
+			default:
+				continue
+			}
+
+			rec, err := r.GetJob(context.Background(), run.Tenant, jobID, 0)
+			switch {
+			case errors.Is(err, nats.ErrKeyNotFound):
+				err = r.dispatchSteps(run, []stepDispatch{job})
+			case err == nil && rec.Terminal():
+				err = r.advanceWorkflow(run.Tenant, run.ID, func(stored *WorkflowRun) []stepDispatch {
+					return stored.applyResult(s.Name, job.compensate, rec)
+				})
+			}
+			if err != nil {
+				logger.Warn("Failed to resume workflow step", zap.String("step", s.Name), zap.Error(err))
+				continue
+			}
+			logger.Info("Workflow Step Resumed", zap.String("step", s.Name))
+		}
+	}
+}
+
+// serveWorkflows implements, for the calling tenant:
+//
+//	GET  /_sys/workflows               the declared workflows
+//	POST /_sys/workflows/{name}        start a run; the body is its input
+//	GET  /_sys/workflows/{name}/{id}   the state of a run
+func (r *Gojinn) serveWorkflows(rw http.ResponseWriter, req *http.Request) error {
+	tenantID, err := r.extractTenantAndHandleMiddleware(rw, req)
+	if err != nil {
+		return nil
+	}
+
+	var parts []string
+	if rest := strings.Trim(strings.TrimPrefix(req.URL.Path, "/_sys/workflows"), "/"); rest != "" {
+		parts = strings.Split(rest, "/")
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	switch {
+	case len(parts) == 0 && req.Method == http.MethodGet:
+		workflows := r.Workflows
+		if workflows == nil {
+			workflows = []Workflow{}
+		}
+		return json.NewEncoder(rw).Encode(map[string]interface{}{"workflows": workflows})
+
+	case len(parts) == 1 && req.Method == http.MethodPost:
+		key := idempotencyKey(req)
+		if err := validateIdempotencyKey(key); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		runID := nuid.Next()
+		if key != "" {
+			runID = hashString("workflow|" + parts[0] + "|" + key)[:24]
+		}
+		input, _ := io.ReadAll(req.Body)
+
+		run, started, err := r.StartWorkflow(tenantID, parts[0], runID, string(input))
+		if errors.Is(err, errWorkflowNotFound) {
+			http.Error(rw, "Workflow not found", http.StatusNotFound)
+			return nil
+		}
+		if err != nil {
+			r.logger.Error("Failed to start workflow", zap.String("workflow", parts[0]), zap.Error(err))
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+
+		status := http.StatusAccepted
+		if !started {
+			rw.Header().Set("X-Gojinn-Idempotent-Replay", "true")
+			status = http.StatusOK
+		}
+		rw.Header().Set("X-Gojinn-Workflow-ID", run.ID)
+		rw.Header().Set("X-Gojinn-Tenant", tenantID)
+		rw.WriteHeader(status)
+		return json.NewEncoder(rw).Encode(run)
+
+	case len(parts) == 2 && req.Method == http.MethodGet:
+		run, err := r.GetWorkflowRun(tenantID, parts[1])
+		if err != nil || run.Workflow != parts[0] {
+			http.Error(rw, "Workflow run not found", http.StatusNotFound)
+			return nil
+		}
+		return json.NewEncoder(rw).Encode(run)
+	}
+
+	http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	return nil
+}
+
+// parseWorkflow reads a workflow block. Steps run in order; the steps of a
+// parallel block run at the same time:
+//
+//	workflow checkout {
+//	    step reserve ./functions/reserve.wasm {
+//	        compensate ./functions/release.wasm
+//	    }
+//	    parallel {
+//	        step charge ./functions/charge.wasm {
+//	            compensate ./functions/refund.wasm
+//	        }
+//	        step email ./functions/email.wasm
+//	    }
+//	}
+func parseWorkflow(h httpcaddyfile.Helper) (Workflow, error) {
+	var wf Workflow
+	if !h.NextArg() {
+		return wf, h.Err("workflow expects a name")
+	}
+	wf.Name = h.Val()
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "step":
+			step, err := parseWorkflowStep(h)
+			if err != nil {
+				return wf, err
+			}
+			wf.Stages = append(wf.Stages, []WorkflowStep{step})
+		case "parallel":
+			var stage []WorkflowStep
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				if h.Val() != "step" {
+					return wf, h.Errf("unknown parallel option '%s'", h.Val())
+				}
+				step, err := parseWorkflowStep(h)
+				if err != nil {
+					return wf, err
+				}
+				stage = append(stage, step)
+			}
+			if len(stage) == 0 {
+				return wf, h.Err("parallel expects at least one step")
+			}
+			wf.Stages = append(wf.Stages, stage)
+		default:
+			return wf, h.Errf("unknown workflow option '%s'", h.Val())
+		}
+	}
+	if len(wf.Stages) == 0 {
+		return wf, h.Errf("workflow %s has no steps", wf.Name)
+	}
+	return wf, nil
+}
+
+func parseWorkflowStep(h httpcaddyfile.Helper) (WorkflowStep, error) {
+	var step WorkflowStep
+	args := h.RemainingArgs()
+	if len(args) != 2 {
+		return step, h.Err("step expects <name> <wasm_file>")
+	}
+	step.Name, step.WasmFile = args[0], args[1]
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "compensate":
+			if !h.NextArg() {
+				return step, h.ArgErr()
+			}
+			step.Compensate = h.Val()
+		default:
+			return step, h.Errf("unknown step option '%s'", h.Val())
+		}
+	}
+	return step, nil
+}